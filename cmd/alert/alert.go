@@ -1,15 +1,59 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/lifecycle"
 )
 
+var draining atomic.Bool
+
 func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/health", http.HandlerFunc(health))
-	http.ListenAndServe(":9000", mux)
+	server := &http.Server{Addr: ":9000", Handler: mux}
+
+	err := lifecycle.New(shutdownConfig()).
+		OnDrain(func() { draining.Store(true) }).
+		Run(context.Background(), server, server.ListenAndServe)
+	if err != nil {
+		log.Printf("alert service stopped: %v", err)
+		os.Exit(1)
+	}
+}
+
+// shutdownConfig reads the drain period and timeout of the shutdown from
+// ALERT_SHUTDOWN_DRAIN and ALERT_SHUTDOWN_TIMEOUT, e.g. "10s".
+func shutdownConfig() lifecycle.Config {
+	var cfg lifecycle.Config
+	for env, d := range map[string]*time.Duration{
+		"ALERT_SHUTDOWN_DRAIN":   &cfg.Drain,
+		"ALERT_SHUTDOWN_TIMEOUT": &cfg.Timeout,
+	} {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("ignoring %s: %v", env, err)
+			continue
+		}
+		*d = parsed
+	}
+	return cfg
 }
 
 func health(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Alert service is shutting down"))
+		return
+	}
 	w.Write([]byte("Alert service is available"))
 }
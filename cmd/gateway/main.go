@@ -3,18 +3,24 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/swavan.io/gateway/config"
 	srvConfig "github.com/swavan.io/gateway/internal/config"
 	"github.com/swavan.io/gateway/internal/db"
 	"github.com/swavan.io/gateway/internal/handler"
+	"github.com/swavan.io/gateway/internal/lifecycle"
+	"github.com/swavan.io/gateway/internal/route"
 	"github.com/swavan.io/gateway/pkg/authentication"
 )
 
 func main() {
-	err := config.New(config.Configuration(), &srvConfig.Config)
+	loader := config.NewLoader(config.Configuration())
+	err := loader.Load(&srvConfig.Config)
 	if err != nil {
 		panic(fmt.Errorf("could not load configuration: %v", err))
 	}
@@ -39,7 +45,53 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	routes, err := route.New(connection.GetDB(), &srvConfig.Config.Routes)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	mux := http.NewServeMux()
-	handler.Run(context.Background(), mux, authentication)
-	http.ListenAndServe(srvConfig.Config.Server.Port, mux)
+	gateway, err := handler.Run(ctx, mux, authentication, routes)
+	if err != nil {
+		panic(err)
+	}
+
+	reload := func() {
+		var cfg srvConfig.Configuration
+		if err := loader.Load(&cfg); err != nil {
+			log.Printf("reload skipped: %v", err)
+			return
+		}
+		if err := gateway.Reload(cfg); err != nil {
+			log.Printf("reload rejected, keeping current routes: %v", err)
+		}
+	}
+	loader.Watch(reload)
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reload()
+		}
+	}()
+
+	err = lifecycle.New(srvConfig.Config.Shutdown).
+		OnDrain(gateway.Drain).
+		Await(gateway.WaitStreams).
+		OnTimeout(gateway.CloseStreams).
+		OnClose("gateway", func(context.Context) error {
+			cancel()
+			return nil
+		}).
+		OnClose("database", func(ctx context.Context) error {
+			connection.Close(ctx)
+			return nil
+		}).
+		Run(ctx, gateway.Server(), gateway.ListenAndServe)
+	if err != nil {
+		log.Printf("gateway stopped: %v", err)
+		os.Exit(1)
+	}
 }
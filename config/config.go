@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
@@ -38,16 +40,42 @@ func (prop *ConfigProp) SetFileExtension(data string) *ConfigProp {
 }
 
 func New(prop *ConfigProp, data any) error {
-	viper.AddConfigPath(prop.ConfigFilePath)
-	viper.SetConfigName(prop.ConfigFileName)
-	viper.SetConfigType(prop.ConfigExtension)
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer(`.`, `_`))
-	if err := viper.ReadInConfig(); err != nil {
+	return NewLoader(prop).Load(data)
+}
+
+// Loader reads one configuration file and can keep watching it for changes.
+type Loader struct {
+	mu    sync.Mutex
+	viper *viper.Viper
+}
+
+func NewLoader(prop *ConfigProp) *Loader {
+	v := viper.New()
+	v.AddConfigPath(prop.ConfigFilePath)
+	v.SetConfigName(prop.ConfigFileName)
+	v.SetConfigType(prop.ConfigExtension)
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer(`.`, `_`))
+	return &Loader{viper: v}
+}
+
+// Load reads the file from disk and decodes it into data.
+func (l *Loader) Load(data any) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.viper.ReadInConfig(); err != nil {
 		return fmt.Errorf("error loading config file: %s", err)
 	}
-	if err := viper.Unmarshal(data); err != nil {
+	if err := l.viper.Unmarshal(data); err != nil {
 		return fmt.Errorf("error reading config file: %s", err)
 	}
 	return nil
 }
+
+// Watch calls onChange every time the file is written.
+func (l *Loader) Watch(onChange func()) {
+	l.viper.OnConfigChange(func(fsnotify.Event) {
+		onChange()
+	})
+	l.viper.WatchConfig()
+}
@@ -1,21 +1,574 @@
 package config
 
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	loader "github.com/swavan.io/gateway/config"
+	"github.com/swavan.io/gateway/internal/lifecycle"
+	"github.com/swavan.io/gateway/internal/route"
+)
+
 type Server struct {
-	Host string `mapstructure:"host"`
-	Port string `mapstructure:"port"`
+	Host              string        `mapstructure:"host"`
+	Port              string        `mapstructure:"port"`
+	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	MaxHeaderBytes    int           `mapstructure:"max_header_bytes"`
+	// H2C accepts HTTP/2 without TLS, needed by plaintext gRPC clients.
+	H2C bool `mapstructure:"h2c"`
+	TLS TLS  `mapstructure:"tls"`
+}
+
+type Certificate struct {
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+}
+
+// TLS terminates HTTPS on the gateway. Certificates are picked by SNI from
+// the names they were issued for, the first one is the default.
+type TLS struct {
+	Certificates []Certificate `mapstructure:"certificates"`
+	ClientCA     string        `mapstructure:"client_ca"`
+	// ClientAuth is one of request, require, verify_if_given or verify.
+	ClientAuth string `mapstructure:"client_auth"`
+	// ClientUser maps verified client certificates onto users by their
+	// common_name or email.
+	ClientUser string `mapstructure:"client_user"`
+}
+
+func (t TLS) Enabled() bool {
+	return len(t.Certificates) > 0
+}
+
+// UpstreamTLS configures the TLS connections to the upstreams of a resource.
+type UpstreamTLS struct {
+	CA                 string `mapstructure:"ca"`
+	Cert               string `mapstructure:"cert"`
+	Key                string `mapstructure:"key"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+func (s Server) SetDefaultIfEmpty() Server {
+	if s.ReadHeaderTimeout <= 0 {
+		s.ReadHeaderTimeout = 10 * time.Second
+	}
+	if s.IdleTimeout <= 0 {
+		s.IdleTimeout = 2 * time.Minute
+	}
+	if s.MaxHeaderBytes <= 0 {
+		s.MaxHeaderBytes = 1 << 20
+	}
+	return s
+}
+
+type Destination struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+type Balancer struct {
+	Strategy string `mapstructure:"strategy"`
+	Header   string `mapstructure:"header"`
+	Cookie   string `mapstructure:"cookie"`
+}
+
+type HealthCheck struct {
+	Path               string        `mapstructure:"path"`
+	Interval           time.Duration `mapstructure:"interval"`
+	Timeout            time.Duration `mapstructure:"timeout"`
+	HealthyThreshold   int           `mapstructure:"healthy_threshold"`
+	UnhealthyThreshold int           `mapstructure:"unhealthy_threshold"`
+	PassiveFailures    int           `mapstructure:"passive_failures"`
+}
+
+// Enabled reports whether upstreams of the resource should be probed. Passive
+// checks need the probes as well, it's how ejected upstreams come back.
+func (hc HealthCheck) Enabled() bool {
+	return hc.Path != "" || hc.Interval > 0 || hc.PassiveFailures > 0
+}
+
+func (hc HealthCheck) SetDefaultIfEmpty() HealthCheck {
+	if hc.Interval <= 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	return hc
+}
+
+type CircuitBreaker struct {
+	Enabled          bool          `mapstructure:"enabled"`
+	FailureRate      float64       `mapstructure:"failure_rate"`
+	MinRequests      int           `mapstructure:"min_requests"`
+	Window           time.Duration `mapstructure:"window"`
+	OpenTimeout      time.Duration `mapstructure:"open_timeout"`
+	HalfOpenRequests int           `mapstructure:"half_open_requests"`
+}
+
+func (cb CircuitBreaker) SetDefaultIfEmpty() CircuitBreaker {
+	if cb.FailureRate <= 0 {
+		cb.FailureRate = 50
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = 10
+	}
+	if cb.Window <= 0 {
+		cb.Window = 30 * time.Second
+	}
+	if cb.OpenTimeout <= 0 {
+		cb.OpenTimeout = 15 * time.Second
+	}
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = 1
+	}
+	return cb
+}
+
+type Retry struct {
+	Attempts         int           `mapstructure:"attempts"`
+	Backoff          time.Duration `mapstructure:"backoff"`
+	MaxBackoff       time.Duration `mapstructure:"max_backoff"`
+	StatusCodes      []int         `mapstructure:"status_codes"`
+	ConnectionErrors bool          `mapstructure:"connection_errors"`
+	Methods          []string      `mapstructure:"methods"`
+	MaxBodyBytes     int64         `mapstructure:"max_body_bytes"`
+}
+
+func (r Retry) SetDefaultIfEmpty() Retry {
+	if r.Backoff <= 0 {
+		r.Backoff = 50 * time.Millisecond
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = time.Second
+	}
+	if len(r.StatusCodes) == 0 && !r.ConnectionErrors {
+		r.StatusCodes = []int{502, 503, 504}
+		r.ConnectionErrors = true
+	}
+	if len(r.Methods) == 0 {
+		r.Methods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+	}
+	if r.MaxBodyBytes <= 0 {
+		r.MaxBodyBytes = 1 << 20
+	}
+	return r
+}
+
+// Transport tunes the connections to the upstreams. Over HTTP/2 (the http2,
+// grpc and grpc-json protocols) every upstream shares one multiplexed
+// connection, the MaxIdleConns, MaxIdleConnsPerHost and MaxConnsPerHost
+// limits don't apply there.
+type Transport struct {
+	DialTimeout           time.Duration `mapstructure:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `mapstructure:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+	RequestTimeout        time.Duration `mapstructure:"request_timeout"`
+	IdleConnTimeout       time.Duration `mapstructure:"idle_conn_timeout"`
+	MaxIdleConns          int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int           `mapstructure:"max_conns_per_host"`
+	TLS                   UpstreamTLS   `mapstructure:"tls"`
+}
+
+func (t Transport) SetDefaultIfEmpty() Transport {
+	if t.DialTimeout <= 0 {
+		t.DialTimeout = 30 * time.Second
+	}
+	if t.TLSHandshakeTimeout <= 0 {
+		t.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if t.IdleConnTimeout <= 0 {
+		t.IdleConnTimeout = 90 * time.Second
+	}
+	if t.MaxIdleConns <= 0 {
+		t.MaxIdleConns = 100
+	}
+	return t
+}
+
+type Rewrite struct {
+	StripPrefix string `mapstructure:"strip_prefix"`
+	AddPrefix   string `mapstructure:"add_prefix"`
+	Regex       string `mapstructure:"regex"`
+	Replacement string `mapstructure:"replacement"`
+	From        string `mapstructure:"from"`
+	To          string `mapstructure:"to"`
+}
+
+func (r Rewrite) IsEmpty() bool {
+	return r == Rewrite{}
+}
+
+type KeyValue struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+type Rename struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// Field is a JSON value placed at a JSON pointer.
+type Field struct {
+	Pointer string `mapstructure:"pointer"`
+	Value   any    `mapstructure:"value"`
+}
+
+// HeaderTransform edits headers. Set values are templates executed with the
+// claims of the authenticated user, e.g. "{{ .Domain.ID }}".
+type HeaderTransform struct {
+	Set    []KeyValue `mapstructure:"set"`
+	Remove []string   `mapstructure:"remove"`
+	Rename []Rename   `mapstructure:"rename"`
+}
+
+// BodyTransform edits JSON bodies, fields are addressed by JSON pointer.
+// String values added are templates like the header values.
+type BodyTransform struct {
+	Add    []Field  `mapstructure:"add"`
+	Remove []string `mapstructure:"remove"`
+	Rename []Rename `mapstructure:"rename"`
+}
+
+func (b BodyTransform) IsEmpty() bool {
+	return len(b.Add) == 0 && len(b.Remove) == 0 && len(b.Rename) == 0
+}
+
+type MessageTransform struct {
+	Headers HeaderTransform `mapstructure:"headers"`
+	Body    BodyTransform   `mapstructure:"body"`
+}
+
+// Transform edits the requests sent upstream and the responses sent back,
+// Status maps upstream status codes onto the ones returned to the client.
+// MaxBodyBytes bounds the response bodies held back for editing.
+type Transform struct {
+	Request      MessageTransform `mapstructure:"request"`
+	Response     MessageTransform `mapstructure:"response"`
+	Status       map[int]int      `mapstructure:"status"`
+	MaxBodyBytes int64            `mapstructure:"max_body_bytes"`
+}
+
+func (t Transform) SetDefaultIfEmpty() Transform {
+	if t.MaxBodyBytes <= 0 {
+		t.MaxBodyBytes = 1 << 20
+	}
+	return t
+}
+
+func (t Transform) IsEmpty() bool {
+	for _, m := range []MessageTransform{t.Request, t.Response} {
+		h := m.Headers
+		if len(h.Set) > 0 || len(h.Remove) > 0 || len(h.Rename) > 0 || !m.Body.IsEmpty() {
+			return false
+		}
+	}
+	return len(t.Status) == 0
+}
+
+// Match narrows a resource down beyond its endpoint. Every configured
+// predicate must match; a header or query entry without value only requires
+// the key to be present.
+type Match struct {
+	Hosts   []string   `mapstructure:"hosts"`
+	Methods []string   `mapstructure:"methods"`
+	Headers []KeyValue `mapstructure:"headers"`
+	Query   []KeyValue `mapstructure:"query"`
+}
+
+// UpstreamGroup is one version of a backend receiving Weight percent of the
+// traffic of a resource.
+type UpstreamGroup struct {
+	Name         string        `mapstructure:"name"`
+	Weight       int           `mapstructure:"weight"`
+	Destinations []Destination `mapstructure:"destinations"`
+	Balancer     Balancer      `mapstructure:"balancer"`
+}
+
+type Sticky struct {
+	By     string `mapstructure:"by"`
+	Cookie string `mapstructure:"cookie"`
+}
+
+// Mirror duplicates a sample of the traffic of a resource to a shadow
+// upstream whose responses are discarded. The credentials of the client are
+// stripped from the copies unless KeepCredentials is set.
+type Mirror struct {
+	Destination     string        `mapstructure:"destination"`
+	Percentage      float64       `mapstructure:"percentage"`
+	Timeout         time.Duration `mapstructure:"timeout"`
+	MaxBodyBytes    int64         `mapstructure:"max_body_bytes"`
+	MaxInFlight     int           `mapstructure:"max_in_flight"`
+	KeepCredentials bool          `mapstructure:"keep_credentials"`
+}
+
+func (m Mirror) SetDefaultIfEmpty() Mirror {
+	if m.Percentage <= 0 {
+		m.Percentage = 100
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = 10 * time.Second
+	}
+	if m.MaxBodyBytes <= 0 {
+		m.MaxBodyBytes = 1 << 20
+	}
+	if m.MaxInFlight <= 0 {
+		m.MaxInFlight = 100
+	}
+	return m
+}
+
+// Stream limits the WebSocket and Server-Sent Events connections of a
+// resource. Zero values disable the respective limit.
+type Stream struct {
+	MaxConnections int           `mapstructure:"max_connections"`
+	IdleTimeout    time.Duration `mapstructure:"idle_timeout"`
+	Heartbeat      time.Duration `mapstructure:"heartbeat"`
+}
+
+// Transcode maps REST calls onto the gRPC methods of a protobuf descriptor
+// set, built with `protoc --include_imports --descriptor_set_out`, using their
+// google.api.http annotations.
+type Transcode struct {
+	Descriptors string   `mapstructure:"descriptors"`
+	Services    []string `mapstructure:"services"`
+}
+
+// Cache stores the GET responses of a resource following their
+// Cache-Control headers. TTL replaces the lifetime sent by the upstream.
+type Cache struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	TTL           time.Duration `mapstructure:"ttl"`
+	MaxEntryBytes int64         `mapstructure:"max_entry_bytes"`
+}
+
+func (c Cache) SetDefaultIfEmpty() Cache {
+	if c.MaxEntryBytes <= 0 {
+		c.MaxEntryBytes = 1 << 20
+	}
+	return c
+}
+
+// CacheStore bounds the in-memory response cache shared by all resources.
+type CacheStore struct {
+	MaxBytes int64 `mapstructure:"max_bytes"`
+}
+
+func (c CacheStore) SetDefaultIfEmpty() CacheStore {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 64 << 20
+	}
+	return c
+}
+
+// Limits reject requests before they are authenticated or proxied. Empty
+// lists allow everything, content types may end in a wildcard like "text/*".
+type Limits struct {
+	MaxBodyBytes int64    `mapstructure:"max_body_bytes"`
+	ContentTypes []string `mapstructure:"content_types"`
+	Methods      []string `mapstructure:"methods"`
+}
+
+func (l Limits) IsEmpty() bool {
+	return l.MaxBodyBytes <= 0 && len(l.ContentTypes) == 0 && len(l.Methods) == 0
 }
 
 type Resource struct {
-	Name          string `mapstructure:"name"`
-	Endpoint      string `mapstructure:"endpoint"`
-	Authenticated bool   `mapstructure:"authenticated"`
-	Destination   string `mapstructure:"destination"`
-	Active        bool   `mapstructure:"active"`
+	Name           string          `mapstructure:"name"`
+	Endpoint       string          `mapstructure:"endpoint"`
+	Protocol       string          `mapstructure:"protocol"`
+	Priority       int             `mapstructure:"priority"`
+	Match          Match           `mapstructure:"match"`
+	Authenticated  bool            `mapstructure:"authenticated"`
+	Destination    string          `mapstructure:"destination"`
+	Destinations   []Destination   `mapstructure:"destinations"`
+	Balancer       Balancer        `mapstructure:"balancer"`
+	Groups         []UpstreamGroup `mapstructure:"groups"`
+	Sticky         Sticky          `mapstructure:"sticky"`
+	HealthCheck    HealthCheck     `mapstructure:"health_check"`
+	CircuitBreaker CircuitBreaker  `mapstructure:"circuit_breaker"`
+	Retry          Retry           `mapstructure:"retry"`
+	Transport      Transport       `mapstructure:"transport"`
+	Rewrite        Rewrite         `mapstructure:"rewrite"`
+	Mirror         Mirror          `mapstructure:"mirror"`
+	Stream         Stream          `mapstructure:"stream"`
+	Transcode      Transcode       `mapstructure:"transcode"`
+	Cache          Cache           `mapstructure:"cache"`
+	Transform      Transform       `mapstructure:"transform"`
+	Limits         Limits          `mapstructure:"limits"`
+	Active         bool            `mapstructure:"active"`
+}
+
+// Upstreams returns every configured destination of the resource, including
+// the legacy single `destination` entry, outside of the upstream groups.
+func (r Resource) Upstreams() []Destination {
+	upstreams := []Destination{}
+	if r.Destination != "" {
+		upstreams = append(upstreams, Destination{URL: r.Destination, Weight: 1})
+	}
+	return append(upstreams, withDefaultWeight(r.Destinations)...)
+}
+
+// UpstreamGroups returns the traffic split of the resource. Resources
+// without groups get a single "default" group with all their upstreams.
+func (r Resource) UpstreamGroups() []UpstreamGroup {
+	if len(r.Groups) == 0 {
+		return []UpstreamGroup{{
+			Name:         "default",
+			Weight:       100,
+			Destinations: r.Upstreams(),
+			Balancer:     r.Balancer,
+		}}
+	}
+	groups := make([]UpstreamGroup, 0, len(r.Groups))
+	for _, g := range r.Groups {
+		g.Destinations = withDefaultWeight(g.Destinations)
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func withDefaultWeight(destinations []Destination) []Destination {
+	out := make([]Destination, 0, len(destinations))
+	for _, d := range destinations {
+		if d.Weight <= 0 {
+			d.Weight = 1
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// Identity forwards the caller of authenticated resources to the upstreams
+// as a short-lived PASETO signed with a key kept for that purpose only. The
+// Authorization header of the client is removed unless KeepAuthorization is
+// set.
+type Identity struct {
+	Enabled           bool          `mapstructure:"enabled"`
+	Header            string        `mapstructure:"header"`
+	Key               string        `mapstructure:"key"`
+	Issuer            string        `mapstructure:"issuer"`
+	TTL               time.Duration `mapstructure:"ttl"`
+	KeepAuthorization bool          `mapstructure:"keep_authorization"`
+}
+
+func (i Identity) SetDefaultIfEmpty() Identity {
+	if i.Header == "" {
+		i.Header = "X-Gateway-Identity"
+	}
+	if i.Key == "" {
+		i.Key = "gateway-identity"
+	}
+	if i.Issuer == "" {
+		i.Issuer = "gateway"
+	}
+	if i.TTL <= 0 {
+		i.TTL = time.Minute
+	}
+	return i
+}
+
+// Cookie controls whether tokens issued at login are also set as HttpOnly
+// cookies next to the JSON response.
+type Cookie struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Domain   string `mapstructure:"domain"`
+	Path     string `mapstructure:"path"`
+	Secure   bool   `mapstructure:"secure"`
+	SameSite string `mapstructure:"same_site"`
+}
+
+// Tokens configures the access and refresh tokens issued by the gateway.
+type Tokens struct {
+	Issuer     string        `mapstructure:"issuer"`
+	AccessTTL  time.Duration `mapstructure:"access_ttl"`
+	RefreshTTL time.Duration `mapstructure:"refresh_ttl"`
+	Cookie     Cookie        `mapstructure:"cookie"`
+	// RevocationRefresh is how often revocations made through other gateway
+	// instances are picked up.
+	RevocationRefresh time.Duration `mapstructure:"revocation_refresh"`
+}
+
+func (t Tokens) SetDefaultIfEmpty() Tokens {
+	if t.Issuer == "" {
+		t.Issuer = "haas"
+	}
+	if t.AccessTTL <= 0 {
+		t.AccessTTL = 10 * time.Minute
+	}
+	if t.RefreshTTL <= 0 {
+		t.RefreshTTL = 7 * 24 * time.Hour
+	}
+	if t.RevocationRefresh <= 0 {
+		t.RevocationRefresh = 30 * time.Second
+	}
+	if t.Cookie.Path == "" {
+		t.Cookie.Path = "/"
+	}
+	return t
+}
+
+type Configuration struct {
+	Server    Server           `mapstructure:"server"`
+	Resources []Resource       `mapstructure:"resources"`
+	Routes    route.Config     `mapstructure:"routes"`
+	Shutdown  lifecycle.Config `mapstructure:"shutdown"`
+	Cache     CacheStore       `mapstructure:"cache"`
+	Identity  Identity         `mapstructure:"identity"`
+	Tokens    Tokens           `mapstructure:"tokens"`
+}
+
+// Validate checks the parts of the configuration that can't be reloaded into
+// a working routing table.
+func (c Configuration) Validate() error {
+	names := make(map[string]bool, len(c.Resources))
+	for _, r := range c.Resources {
+		if r.Name == "" {
+			return fmt.Errorf("resource with endpoint %q has no name", r.Endpoint)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("resource %s is declared more than once", r.Name)
+		}
+		names[r.Name] = true
+		if !strings.HasPrefix(r.Endpoint, "/") {
+			return fmt.Errorf("resource %s: endpoint must start with /", r.Name)
+		}
+		if !r.Active {
+			continue
+		}
+		for _, g := range r.UpstreamGroups() {
+			if len(g.Destinations) == 0 {
+				return fmt.Errorf("resource %s has no destination in group %s", r.Name, g.Name)
+			}
+			if g.Weight < 0 {
+				return fmt.Errorf("resource %s: group %s has a negative weight", r.Name, g.Name)
+			}
+		}
+	}
+	return nil
 }
 
-type configuration struct {
-	Server    Server     `mapstructure:"server"`
-	Resources []Resource `mapstructure:"resources"`
+// Path resolves a file referenced by the configuration relative to the
+// directory of the configuration file.
+func Path(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(loader.Configuration().ConfigFilePath, name)
 }
 
-var Config configuration
+var Config Configuration
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/internal/route"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+func routeResource(rt route.Route) config.Resource {
+	destinations := make([]config.Destination, 0, len(rt.Destinations))
+	for _, d := range rt.Destinations {
+		destinations = append(destinations, config.Destination{URL: d.URL, Weight: d.Weight})
+	}
+	return config.Resource{
+		Name:          rt.Name,
+		Endpoint:      rt.Endpoint,
+		Authenticated: rt.Authenticated,
+		Destinations:  destinations,
+		Active:        rt.Active,
+	}
+}
+
+func (g *Gateway) storedResources(ctx context.Context) ([]config.Resource, error) {
+	if g.routes == nil {
+		return nil, nil
+	}
+	routes, err := g.routes.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]config.Resource, 0, len(routes))
+	for _, rt := range routes {
+		resources = append(resources, routeResource(rt))
+	}
+	return resources, nil
+}
+
+// validateRoute makes sure a stored route can't break the next reload.
+func (g *Gateway) validateRoute(ctx context.Context, rt *route.Route) error {
+	g.mu.Lock()
+	cfg := g.cfg
+	g.mu.Unlock()
+
+	for _, resource := range cfg.Resources {
+		if resource.Name == rt.Name {
+			return fmt.Errorf("name %s is used by a configured resource", rt.Name)
+		}
+	}
+	stored, err := g.routes.All(ctx)
+	if err != nil {
+		return err
+	}
+	for _, other := range stored {
+		if other.Name == rt.Name && other.ID != rt.ID {
+			return fmt.Errorf("name %s is used by route %s", rt.Name, other.ID)
+		}
+	}
+
+	// The route has to fit in with everything Reload merges it with.
+	resource := routeResource(*rt)
+	merged := cfg
+	merged.Resources = append([]config.Resource{}, cfg.Resources...)
+	for _, other := range stored {
+		if other.ID != rt.ID {
+			merged.Resources = append(merged.Resources, routeResource(other))
+		}
+	}
+	merged.Resources = append(merged.Resources, resource)
+	if err := merged.Validate(); err != nil {
+		return err
+	}
+	if len(resource.Destinations) == 0 {
+		return errors.New("route has no destination")
+	}
+	_, err = NewReverseProxy(resource)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func modifier(r *http.Request) string {
+	if claims, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok {
+		return claims.Username
+	}
+	return ""
+}
+
+func (g *Gateway) listRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, err := g.routes.All(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+func (g *Gateway) getRoute(w http.ResponseWriter, r *http.Request) {
+	rt, err := g.routes.Find(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rt == nil {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, rt)
+}
+
+func (g *Gateway) createRoute(w http.ResponseWriter, r *http.Request) {
+	rt := route.NewRoute()
+	if err := json.NewDecoder(r.Body).Decode(rt); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rt.SetID("")
+	g.saveRoute(w, r, rt, nil, http.StatusCreated)
+}
+
+func (g *Gateway) updateRoute(w http.ResponseWriter, r *http.Request) {
+	existing, err := g.routes.Find(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+	rt := route.NewRoute()
+	if err := json.NewDecoder(r.Body).Decode(rt); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rt.SetID(existing.ID)
+	g.saveRoute(w, r, rt, existing, http.StatusOK)
+}
+
+// saveRoute stores rt and loads it. previous is the stored version of an
+// update, it is put back when the table can't be loaded with rt.
+func (g *Gateway) saveRoute(w http.ResponseWriter, r *http.Request, rt, previous *route.Route, status int) {
+	if err := g.validateRoute(r.Context(), rt); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rt.SetModifier(modifier(r))
+	err := g.routes.Save(r.Context(), rt)
+	if errors.Is(err, route.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := g.Refresh(); err != nil {
+		// A route the table can't load would fail every later reload.
+		var restored error
+		if previous != nil {
+			restored = g.routes.Save(r.Context(), previous)
+		} else {
+			restored = g.routes.Delete(r.Context(), rt.ID)
+		}
+		if restored != nil {
+			log.Printf("restoring route %s failed: %v", rt.ID, restored)
+		}
+		writeError(w, http.StatusBadRequest, "route not loaded: "+err.Error())
+		return
+	}
+	writeJSON(w, status, rt)
+}
+
+func (g *Gateway) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	err := g.routes.Delete(r.Context(), r.PathValue("id"))
+	if errors.Is(err, route.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := g.Refresh(); err != nil {
+		writeError(w, http.StatusInternalServerError, "route deleted but table not reloaded: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeCache drops cached responses of a route and/or with a key prefix,
+// nothing is purged without either of them.
+func (g *Gateway) purgeCache(w http.ResponseWriter, r *http.Request) {
+	name, prefix := r.URL.Query().Get("route"), r.URL.Query().Get("prefix")
+	if name == "" && prefix == "" {
+		writeError(w, http.StatusBadRequest, "route or prefix is required")
+		return
+	}
+	purged := g.cache.Purge(func(e *cacheEntry) bool {
+		return (name == "" || e.route == name) && strings.HasPrefix(e.path, prefix)
+	})
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
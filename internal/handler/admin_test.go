@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/internal/route"
+)
+
+// memoryRoutes keeps routes the way route_store does.
+type memoryRoutes struct {
+	mu     sync.Mutex
+	routes map[string]route.Route
+	loads  int
+}
+
+func newMemoryRoutes() *memoryRoutes {
+	return &memoryRoutes{routes: map[string]route.Route{}}
+}
+
+func (m *memoryRoutes) Migration(context.Context) error { return nil }
+func (m *memoryRoutes) Config() *route.Config           { return &route.Config{} }
+
+func (m *memoryRoutes) All(context.Context) ([]route.Route, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads++
+	routes := []route.Route{}
+	for _, rt := range m.routes {
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+func (m *memoryRoutes) Find(_ context.Context, id string) (*route.Route, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rt, ok := m.routes[id]; ok {
+		return &rt, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryRoutes) Save(_ context.Context, rt *route.Route) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rt.IsNew() {
+		rt.SetID(uuid.New().String())
+	} else if _, ok := m.routes[rt.ID]; !ok {
+		return route.ErrNotFound
+	}
+	m.routes[rt.ID] = *rt
+	return nil
+}
+
+func (m *memoryRoutes) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.routes[id]; !ok {
+		return route.ErrNotFound
+	}
+	delete(m.routes, id)
+	return nil
+}
+
+func adminMux(g *Gateway) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/routes", g.listRoutes)
+	mux.HandleFunc("POST /admin/routes", g.createRoute)
+	mux.HandleFunc("GET /admin/routes/{id}", g.getRoute)
+	mux.HandleFunc("PUT /admin/routes/{id}", g.updateRoute)
+	mux.HandleFunc("DELETE /admin/routes/{id}", g.deleteRoute)
+	return mux
+}
+
+func call(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminRoutes(t *testing.T) {
+	upstream := backend(t, "stored")
+	g := testGateway(t)
+	store := newMemoryRoutes()
+	g.routes = store
+	mux := adminMux(g)
+
+	w := call(mux, "POST", "/admin/routes", `{"name":"stored","endpoint":"/stored/*","authenticated":false,"destinations":[{"url":"`+upstream.URL+`"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+	created := route.NewRoute()
+	json.NewDecoder(w.Body).Decode(created)
+	if code, body := get(t, g.router, "/stored/x"); code != http.StatusOK || body != "stored" {
+		t.Fatalf("created route answered %d %q", code, body)
+	}
+
+	if w := call(mux, "POST", "/admin/routes", `{"name":"stored","endpoint":"/other/*","destinations":[{"url":"`+upstream.URL+`"}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("duplicate name answered %d", w.Code)
+	}
+	if w := call(mux, "POST", "/admin/routes", `{"name":"empty","endpoint":"/empty/*"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("route without destination answered %d", w.Code)
+	}
+	if w := call(mux, "GET", "/admin/routes/unknown", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get unknown answered %d", w.Code)
+	}
+	if w := call(mux, "PUT", "/admin/routes/unknown", `{}`); w.Code != http.StatusNotFound {
+		t.Fatalf("update unknown answered %d", w.Code)
+	}
+
+	if w := call(mux, "DELETE", "/admin/routes/"+created.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete answered %d", w.Code)
+	}
+	if code, _ := get(t, g.router, "/stored/x"); code != http.StatusNotFound {
+		t.Fatalf("deleted route answered %d", code)
+	}
+}
+
+func TestAdminDeleteUnknownRoute(t *testing.T) {
+	g := testGateway(t)
+	store := newMemoryRoutes()
+	g.routes = store
+
+	w := call(adminMux(g), "DELETE", "/admin/routes/unknown", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("delete unknown answered %d", w.Code)
+	}
+	if store.loads != 0 {
+		t.Fatal("table reloaded for an unknown route")
+	}
+}
+
+// racingRoutes has another instance store a route named like the first one
+// saved here, right after it was validated.
+type racingRoutes struct {
+	*memoryRoutes
+	raced bool
+}
+
+func (m *racingRoutes) Save(ctx context.Context, rt *route.Route) error {
+	if !m.raced {
+		m.raced = true
+		other := *rt
+		other.SetID("")
+		m.memoryRoutes.Save(ctx, &other)
+	}
+	return m.memoryRoutes.Save(ctx, rt)
+}
+
+func TestAdminRejectedRouteNotStored(t *testing.T) {
+	upstream := backend(t, "stored")
+	g := testGateway(t)
+	store := newMemoryRoutes()
+	g.routes = store
+	if err := g.Reload(config.Configuration{Resources: []config.Resource{resourceTo("app", "/app/*", upstream.URL)}}); err != nil {
+		t.Fatal(err)
+	}
+	mux := adminMux(g)
+
+	if w := call(mux, "POST", "/admin/routes", `{"name":"app","endpoint":"/other/*","destinations":[{"url":"`+upstream.URL+`"}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("name of a configured resource answered %d", w.Code)
+	}
+	if len(store.routes) != 0 {
+		t.Fatalf("rejected route stored: %v", store.routes)
+	}
+
+	racing := &racingRoutes{memoryRoutes: store}
+	g.routes = racing
+	if w := call(mux, "POST", "/admin/routes", `{"name":"shop","endpoint":"/shop/*","active":true,"destinations":[{"url":"`+upstream.URL+`"}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("route failing the reload answered %d", w.Code)
+	}
+	if len(store.routes) != 1 {
+		t.Fatalf("route failing the reload kept: %v", store.routes)
+	}
+	if err := g.Refresh(); err != nil {
+		t.Fatalf("reload after rejected route: %v", err)
+	}
+}
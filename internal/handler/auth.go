@@ -1,35 +1,309 @@
 package handler
 
 import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/refresh"
+	"github.com/swavan.io/gateway/pkg/authentication/salt"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
+	"github.com/swavan.io/gateway/pkg/identity"
 )
 
+const invalidCredentials = "invalid username or password"
+
+// decoyPassword is compared against for unknown users so a login takes
+// about as long whether the user exists or not.
+var decoyPassword = sync.OnceValue(func() string {
+	hash, _ := salt.HashPassword("")
+	return hash
+})
+
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+type credentials struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+// readCredentials accepts JSON and HTML form posts.
+func readCredentials(r *http.Request) (*credentials, error) {
+	payload := new(credentials)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			return nil, err
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		payload.Username = r.PostFormValue("username")
+		payload.Password = r.PostFormValue("password")
+	default:
+		return nil, errors.New("unsupported content type")
+	}
+	payload.Username = strings.TrimSpace(payload.Username)
+	if payload.Username == "" || payload.Password == "" {
+		return nil, errors.New("username and password are required")
+	}
+	return payload, nil
+}
+
 func (a *Auth) Login(w http.ResponseWriter, r *http.Request) {
-	payload := new(struct {
-		Username string `json:"username" form:"username"`
-		Password string `json:"password" form:"password"`
-	})
-	err := json.NewDecoder(r.Body).Decode(payload)
+	payload, err := readCredentials(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// user, err := a.api.User().
-	// 	FindByUsername(
-	// 		r.Context(),
-	// 		payload.Username)
+	usr, err := a.api.User().GetUserForCredential(r.Context(), payload.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("login of %s failed: %v", payload.Username, err)
+		writeError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+	if err != nil || usr.Password == "" {
+		checkPassword(decoyPassword(), payload.Password)
+		writeError(w, http.StatusUnauthorized, invalidCredentials)
+		return
+	}
+	if err := checkPassword(usr.Password, payload.Password); err != nil {
+		writeError(w, http.StatusUnauthorized, invalidCredentials)
+		return
+	}
+	if salt.NeedsRehash(usr.Password) {
+		a.rehash(r.Context(), usr.Username, payload.Password)
+	}
 
-	// if err != nil {
-	// 	w.WriteHeader(http.StatusNotFound)
-	// 	return
-	// }
+	claims, err := a.userClaims(r.Context(), usr.User)
+	if err != nil {
+		log.Printf("login of %s failed: %v", payload.Username, err)
+		writeError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+	a.login(w, r, claims, session.MethodPassword)
+}
+
+// checkPassword compares password against the stored value of a user with
+// the parameters it was hashed with. Legacy values hold the password itself.
+func checkPassword(stored, password string) error {
+	if salt.IsLegacyPassword(stored) {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+			return salt.ErrInvalidPassword
+		}
+		return nil
+	}
+	pm, hash, err := salt.ParsePassword(stored)
+	if err != nil {
+		return err
+	}
+	if err := pm.Compare(hash, []byte(password)); err != nil {
+		return salt.ErrInvalidPassword
+	}
+	return nil
+}
 
-	if r.Header.Get("Content-Type") != "application/json" {
+// rehash stores password, which just matched, with the current parameters.
+// The login goes on when that fails, the old value still works.
+func (a *Auth) rehash(ctx context.Context, username, password string) {
+	hash, err := salt.HashPassword(password)
+	if err == nil {
+		err = a.api.User().ChangePassword(ctx, username, hash)
+	}
+	if err != nil {
+		log.Printf("rehashing password of %s failed: %v", username, err)
+	}
+}
+
+// login starts a session for claims, authenticated through method, and
+// answers with its first tokens.
+func (a *Auth) login(w http.ResponseWriter, r *http.Request, claims *authentication.Claims, method string) {
+	sess := session.NewSession().
+		SetID(uuid.New().String()).
+		SetUsername(claims.Username).
+		SetDomain(claims.Domain.ID).
+		SetIP(clientIP(r)).
+		SetUserAgent(r.UserAgent()).
+		SetMethod(method).
+		SetExpiresAt(time.Now().Add(a.tokens.RefreshTTL))
+	if err := a.api.Session().Save(r.Context(), sess); err != nil {
+		log.Printf("starting session of %s failed: %v", claims.Username, err)
+		writeError(w, http.StatusInternalServerError, "login failed")
 		return
 	}
+	a.issue(w, r, claims, refresh.NewRefreshToken().SetFamily(sess.ID))
+}
 
-	// Match password and generate token
+// Refresh exchanges a refresh token for a new pair. Each refresh token is
+// good for one exchange, presenting it again revokes every token descending
+// from the same login.
+func (a *Auth) Refresh(w http.ResponseWriter, r *http.Request) {
+	token := refreshToken(r)
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "refresh_token is required")
+		return
+	}
+	presented, _, err := authentication.ParseAsymmetricToken(token, a.refreshKey.PublicKey)
+	if err != nil || presented.ID == "" {
+		writeError(w, http.StatusUnauthorized, refresh.ErrInvalid.Error())
+		return
+	}
 
+	used, err := a.api.Refresh().Use(r.Context(), presented.ID)
+	switch {
+	case errors.Is(err, refresh.ErrReused):
+		// Somebody else holds a token of the session, neither of them gets
+		// to keep it.
+		if err := a.terminate(r.Context(), used.Family, used.Username); err != nil {
+			log.Printf("ending session %s of %s failed: %v", used.Family, used.Username, err)
+		}
+		log.Printf("refresh token of %s reused, session %s ended", used.Username, used.Family)
+		writeError(w, http.StatusUnauthorized, refresh.ErrInvalid.Error())
+		return
+	case errors.Is(err, refresh.ErrInvalid):
+		writeError(w, http.StatusUnauthorized, refresh.ErrInvalid.Error())
+		return
+	case err != nil:
+		log.Printf("refreshing token of %s failed: %v", presented.Username, err)
+		writeError(w, http.StatusInternalServerError, "refresh failed")
+		return
+	}
+
+	// Roles and domains may have changed since the login.
+	usr, err := a.api.User().FindByUsername(r.Context(), used.Username)
+	if err == nil && usr.Username == "" {
+		if err := a.terminate(r.Context(), used.Family, used.Username); err != nil {
+			log.Printf("ending session %s of %s failed: %v", used.Family, used.Username, err)
+		}
+		writeError(w, http.StatusUnauthorized, refresh.ErrInvalid.Error())
+		return
+	}
+	var claims *authentication.Claims
+	if err == nil {
+		claims, err = a.userClaims(r.Context(), usr)
+	}
+	if err != nil {
+		log.Printf("refreshing token of %s failed: %v", used.Username, err)
+		writeError(w, http.StatusInternalServerError, "refresh failed")
+		return
+	}
+	a.issue(w, r, claims, refresh.NewRefreshToken().SetFamily(used.Family).SetParent(used.ID))
+}
+
+// refreshToken takes the token from a JSON or form body, falling back to the
+// cookie set at login.
+func refreshToken(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		payload := new(struct {
+			RefreshToken string `json:"refresh_token"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(payload); err == nil && payload.RefreshToken != "" {
+			return payload.RefreshToken
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if token := r.PostFormValue(string(identity.RefreshToken)); token != "" {
+			return token
+		}
+	}
+	if cookie, err := r.Cookie(string(identity.RefreshToken)); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// issue answers with a new access and refresh token for claims. next is the
+// refresh token to store, its family, which is the session, and parent set
+// by the caller.
+func (a *Auth) issue(w http.ResponseWriter, r *http.Request, claims *authentication.Claims, next *refresh.RefreshToken) {
+	now := time.Now()
+	claims.SetSession(next.Family)
+	accessHeader := a.tokenHeader(claims, now, a.tokens.AccessTTL)
+	access, err := claims.GenerateAsymmetric(a.key.PrivateKey, "", accessHeader)
+	if err != nil {
+		log.Printf("issuing access token for %s failed: %v", claims.Username, err)
+		writeError(w, http.StatusInternalServerError, "issuing token failed")
+		return
+	}
+
+	header := a.tokenHeader(claims, now, a.tokens.RefreshTTL)
+	next.SetID(header.ID).
+		SetUsername(claims.Username).
+		SetExpiresAt(header.Expiration)
+	if err := a.api.Refresh().Save(r.Context(), next); err != nil {
+		log.Printf("storing refresh token for %s failed: %v", claims.Username, err)
+		writeError(w, http.StatusInternalServerError, "issuing token failed")
+		return
+	}
+	refreshed, err := claims.GenerateAsymmetric(a.refreshKey.PrivateKey, "", header)
+	if err != nil {
+		log.Printf("issuing refresh token for %s failed: %v", claims.Username, err)
+		writeError(w, http.StatusInternalServerError, "issuing token failed")
+		return
+	}
+	if err := a.api.Session().Touch(r.Context(), next.Family, accessHeader.ID, header.Expiration); err != nil {
+		log.Printf("updating session of %s failed: %v", claims.Username, err)
+	}
+
+	if a.tokens.Cookie.Enabled {
+		http.SetCookie(w, a.cookie(identity.AccessToken, access, a.tokens.Cookie.Path, a.tokens.AccessTTL))
+		// The refresh token is only needed by the auth endpoints.
+		http.SetCookie(w, a.cookie(identity.RefreshToken, refreshed, "/auth/", a.tokens.RefreshTTL))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, TokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(a.tokens.AccessTTL.Seconds()),
+		RefreshToken:     refreshed,
+		RefreshExpiresIn: int64(a.tokens.RefreshTTL.Seconds()),
+	})
+}
+
+func (a *Auth) tokenHeader(claims *authentication.Claims, now time.Time, ttl time.Duration) *authentication.TokenHeader {
+	return authentication.NewTokenHeader().
+		SetSubject(claims.Subject).
+		SetIssuer(a.tokens.Issuer).
+		SetIssuedAt(now).
+		SetNotBefore(now).
+		SetExpiresAt(now.Add(ttl))
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (a *Auth) cookie(name identity.Identity, value, path string, ttl time.Duration) *http.Cookie {
+	sameSite, ok := sameSiteModes[strings.ToLower(a.tokens.Cookie.SameSite)]
+	if !ok {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     string(name),
+		Value:    value,
+		Path:     path,
+		Domain:   a.tokens.Cookie.Domain,
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   a.tokens.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
 }
@@ -0,0 +1,616 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/key"
+	authoidc "github.com/swavan.io/gateway/pkg/authentication/oidc"
+	"github.com/swavan.io/gateway/pkg/authentication/refresh"
+	"github.com/swavan.io/gateway/pkg/authentication/revocation"
+	"github.com/swavan.io/gateway/pkg/authentication/salt"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
+	"github.com/swavan.io/gateway/pkg/authentication/user"
+)
+
+// memoryAPI keeps users, refresh tokens, revocations and sessions the way
+// their stores do. Everything else panics.
+type memoryAPI struct {
+	authentication.AuthenticationAPI
+	users       *memoryUsers
+	refresh     *memoryRefresh
+	revocations *memoryRevocations
+	sessions    *memorySessions
+	clients     authoidc.OauthClients
+}
+
+func (m *memoryAPI) User() user.UserAPI                   { return m.users }
+func (m *memoryAPI) Refresh() refresh.RefreshAPI          { return m.refresh }
+func (m *memoryAPI) Revocation() revocation.RevocationAPI { return m.revocations }
+func (m *memoryAPI) Session() session.SessionAPI          { return m.sessions }
+func (m *memoryAPI) Config() *authentication.AuthConfig   { return &authentication.AuthConfig{} }
+func (m *memoryAPI) OIDC() authoidc.OauthClients          { return m.clients }
+
+type memoryUsers struct {
+	user.UserAPI
+	mu        sync.Mutex
+	users     map[string]*user.User
+	passwords map[string]string
+}
+
+func (m *memoryUsers) add(usr *user.User, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[usr.Username] = usr
+	m.passwords[usr.Username] = password
+}
+
+func (m *memoryUsers) password(username string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.passwords[username]
+}
+
+func (m *memoryUsers) FindByUsername(_ context.Context, username string) (*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if usr, ok := m.users[username]; ok {
+		copied := *usr
+		return &copied, nil
+	}
+	return user.NewUser(), nil
+}
+
+func (m *memoryUsers) FindBySubject(_ context.Context, issuer, subject string) (*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, usr := range m.users {
+		if usr.Subject != "" && usr.Issuer == issuer && usr.Subject == subject {
+			copied := *usr
+			return &copied, nil
+		}
+	}
+	return user.NewUser(), nil
+}
+
+func (m *memoryUsers) Save(_ context.Context, usr *user.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *usr
+	if stored, ok := m.users[usr.Username]; ok {
+		copied.ID, copied.Issuer, copied.Subject = stored.ID, stored.Issuer, stored.Subject
+	} else {
+		copied.ID = "id-" + usr.Username
+	}
+	m.users[usr.Username] = &copied
+	return nil
+}
+
+func (m *memoryUsers) Link(_ context.Context, username, issuer, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if usr, ok := m.users[username]; ok {
+		usr.Issuer, usr.Subject = issuer, subject
+	}
+	return nil
+}
+
+func (m *memoryUsers) GetUserForCredential(ctx context.Context, username string) (*user.UserStore, error) {
+	usr, _ := m.FindByUsername(ctx, username)
+	if usr.Username == "" {
+		return nil, sql.ErrNoRows
+	}
+	return &user.UserStore{User: usr, Password: m.password(username)}, nil
+}
+
+func (m *memoryUsers) ChangePassword(_ context.Context, username, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passwords[username] = password
+	return nil
+}
+
+func (m *memoryUsers) GetDomains(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+type memoryRefresh struct {
+	refresh.RefreshAPI
+	mu     sync.Mutex
+	tokens map[string]*refresh.RefreshToken
+}
+
+func (m *memoryRefresh) Find(_ context.Context, id string) (*refresh.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if token, ok := m.tokens[id]; ok {
+		copied := *token
+		return &copied, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRefresh) Save(_ context.Context, token *refresh.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *token
+	m.tokens[token.ID] = &copied
+	return nil
+}
+
+func (m *memoryRefresh) Use(_ context.Context, id string) (*refresh.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[id]
+	switch {
+	case !ok || token.Revoked:
+		return nil, refresh.ErrInvalid
+	case token.Used:
+		copied := *token
+		m.revokeFamily(token.Family)
+		return &copied, refresh.ErrReused
+	}
+	token.Used = true
+	copied := *token
+	return &copied, nil
+}
+
+func (m *memoryRefresh) revokeFamily(family string) {
+	for _, token := range m.tokens {
+		if token.Family == family {
+			token.Revoked = true
+		}
+	}
+}
+
+func (m *memoryRefresh) RevokeFamily(_ context.Context, family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revokeFamily(family)
+	return nil
+}
+
+func (m *memoryRefresh) RevokeUser(_ context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.Username == username {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (m *memoryRefresh) DeleteExpired(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, token := range m.tokens {
+		if token.ExpiresAt.Before(time.Now()) {
+			delete(m.tokens, id)
+		}
+	}
+	return nil
+}
+
+type memoryRevocations struct {
+	mu          sync.Mutex
+	revocations []revocation.Revocation
+}
+
+func (m *memoryRevocations) Migration(context.Context) error { return nil }
+
+func (m *memoryRevocations) Save(_ context.Context, r *revocation.Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revocations = append(m.revocations, *r)
+	return nil
+}
+
+func (m *memoryRevocations) Active(context.Context) ([]revocation.Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := []revocation.Revocation{}
+	for _, r := range m.revocations {
+		if r.ExpiresAt.After(time.Now()) {
+			active = append(active, r)
+		}
+	}
+	return active, nil
+}
+
+func (m *memoryRevocations) DeleteExpired(ctx context.Context) error {
+	active, _ := m.Active(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revocations = active
+	return nil
+}
+
+type memorySessions struct {
+	session.SessionAPI
+	mu       sync.Mutex
+	sessions map[string]*session.Session
+	ended    map[string]bool
+	seen     int
+}
+
+func (m *memorySessions) active(s *session.Session) bool {
+	return !m.ended[s.ID] && s.ExpiresAt.After(time.Now())
+}
+
+func (m *memorySessions) Find(_ context.Context, id string) (*session.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok && m.active(s) {
+		copied := *s
+		return &copied, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memorySessions) FindByUser(_ context.Context, username string) ([]session.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := []session.Session{}
+	for _, s := range m.sessions {
+		if s.Username == username && m.active(s) {
+			sessions = append(sessions, *s)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *memorySessions) Save(_ context.Context, s *session.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *s
+	m.sessions[s.ID] = &copied
+	return nil
+}
+
+func (m *memorySessions) Touch(_ context.Context, id, accessJTI string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.AccessJTI, s.LastSeenAt, s.ExpiresAt = accessJTI, time.Now(), expiresAt
+	}
+	return nil
+}
+
+func (m *memorySessions) Seen(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok && !m.ended[id] {
+		s.LastSeenAt = time.Now()
+		m.seen++
+	}
+	return nil
+}
+
+func (m *memorySessions) End(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ended[id] = true
+	return nil
+}
+
+func (m *memorySessions) EndUser(_ context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.Username == username {
+			m.ended[id] = true
+		}
+	}
+	return nil
+}
+
+func (m *memorySessions) DeleteExpired(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if !m.active(s) {
+			delete(m.sessions, id)
+			delete(m.ended, id)
+		}
+	}
+	return nil
+}
+
+func testKey(t *testing.T) *key.Key {
+	t.Helper()
+	public, private, err := salt.New().GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.NewKey().SetPublicKey(public).SetPrivateKey(private)
+}
+
+func testAuth(t *testing.T) (*Auth, *memoryAPI) {
+	t.Helper()
+	api := &memoryAPI{
+		users:       &memoryUsers{users: map[string]*user.User{}, passwords: map[string]string{}},
+		refresh:     &memoryRefresh{tokens: map[string]*refresh.RefreshToken{}},
+		revocations: &memoryRevocations{},
+		sessions:    &memorySessions{sessions: map[string]*session.Session{}, ended: map[string]bool{}},
+	}
+	return &Auth{
+		api:         api,
+		key:         testKey(t),
+		refreshKey:  testKey(t),
+		oidcKey:     testKey(t),
+		tokens:      config.Tokens{}.SetDefaultIfEmpty(),
+		revocations: newRevocations(api.revocations),
+	}, api
+}
+
+func testUser(t *testing.T, api *memoryAPI, username, password string) {
+	t.Helper()
+	stored, err := salt.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.users.add(&user.User{ID: "id-" + username, Username: username}, stored)
+}
+
+// login posts credentials and decodes the tokens of a successful login.
+func login(t *testing.T, a *Auth, username, password string) (*httptest.ResponseRecorder, TokenResponse) {
+	t.Helper()
+	body, _ := json.Marshal(credentials{Username: username, Password: password})
+	w := call(http.HandlerFunc(a.Login), "POST", "/auth/login", string(body))
+	var tokens TokenResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, tokens
+}
+
+func TestLogin(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+
+	w, tokens := login(t, a, "alice", "correct horse")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login answered %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" || tokens.TokenType != "Bearer" {
+		t.Fatalf("response %v %+v", w.Header(), tokens)
+	}
+
+	claims, _, err := authentication.ParseAsymmetricToken(tokens.AccessToken, a.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "alice" || claims.Subject != "id-alice" || claims.Session == "" {
+		t.Fatalf("access claims %+v", claims)
+	}
+	if _, _, err := authentication.ParseAsymmetricToken(tokens.AccessToken, a.refreshKey.PublicKey); err == nil {
+		t.Fatal("access token passes as refresh token")
+	}
+
+	presented, _, err := authentication.ParseAsymmetricToken(tokens.RefreshToken, a.refreshKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := api.refresh.Find(context.Background(), presented.ID)
+	if err != nil || stored.Family != claims.Session || stored.Username != "alice" {
+		t.Fatalf("stored refresh token %+v, %v", stored, err)
+	}
+	sess, err := api.sessions.Find(context.Background(), claims.Session)
+	if err != nil || sess.Method != session.MethodPassword || sess.AccessJTI != claims.ID {
+		t.Fatalf("session %+v, %v", sess, err)
+	}
+}
+
+func TestLoginForm(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+
+	form := url.Values{"username": {" alice "}, "password": {"correct horse"}}
+	r := httptest.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.Login(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("form login answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	api.users.add(&user.User{Username: "oidc-only"}, "")
+
+	for _, tc := range []struct {
+		username, password string
+		status             int
+	}{
+		{"alice", "battery staple", http.StatusUnauthorized},
+		{"bob", "correct horse", http.StatusUnauthorized},
+		{"oidc-only", "anything", http.StatusUnauthorized},
+		{"alice", "", http.StatusBadRequest},
+		{"", "correct horse", http.StatusBadRequest},
+	} {
+		w, _ := login(t, a, tc.username, tc.password)
+		if w.Code != tc.status {
+			t.Errorf("%s/%s answered %d, want %d", tc.username, tc.password, w.Code, tc.status)
+		}
+	}
+	// Unknown users and wrong passwords can't be told apart.
+	wrong, _ := login(t, a, "alice", "battery staple")
+	unknown, _ := login(t, a, "bob", "battery staple")
+	if wrong.Body.String() != unknown.Body.String() {
+		t.Fatalf("answers differ: %s and %s", wrong.Body, unknown.Body)
+	}
+
+	w := call(http.HandlerFunc(a.Login), "POST", "/auth/login", `{`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid JSON answered %d", w.Code)
+	}
+	if len(api.sessions.sessions) != 0 {
+		t.Fatal("session started for a rejected login")
+	}
+}
+
+func TestLoginRehashesLegacyPassword(t *testing.T) {
+	a, api := testAuth(t)
+	api.users.add(&user.User{ID: "id-carol", Username: "carol"}, "plain secret")
+
+	if w, _ := login(t, a, "carol", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong legacy password answered %d", w.Code)
+	}
+	if api.users.password("carol") != "plain secret" {
+		t.Fatal("rehashed after a failed login")
+	}
+
+	if w, _ := login(t, a, "carol", "plain secret"); w.Code != http.StatusOK {
+		t.Fatalf("legacy login answered %d: %s", w.Code, w.Body)
+	}
+	stored := api.users.password("carol")
+	if salt.IsLegacyPassword(stored) || salt.NeedsRehash(stored) {
+		t.Fatalf("stored as %q after login", stored)
+	}
+	if w, _ := login(t, a, "carol", "plain secret"); w.Code != http.StatusOK {
+		t.Fatalf("login after rehash answered %d", w.Code)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	if err := checkPassword(decoyPassword(), "anything"); err == nil {
+		t.Fatal("decoy matched")
+	}
+	if salt.IsLegacyPassword(decoyPassword()) {
+		t.Fatal("decoy isn't hashed")
+	}
+	stored, _ := salt.HashPassword("secret")
+	if err := checkPassword(stored, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	for _, stored := range []string{"$argon2id$garbage", "secret-but-longer"} {
+		if err := checkPassword(stored, "secret"); err == nil {
+			t.Errorf("%q matched", stored)
+		}
+	}
+}
+
+func refreshWith(t *testing.T, a *Auth, token string) (*httptest.ResponseRecorder, TokenResponse) {
+	t.Helper()
+	w := call(http.HandlerFunc(a.Refresh), "POST", "/auth/refresh", `{"refresh_token":"`+token+`"}`)
+	var tokens TokenResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, tokens
+}
+
+// guarded tells whether Guard lets access through.
+func guarded(a *Auth, access string) bool {
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.Header.Set("Authorization", "Bearer "+access)
+	w := httptest.NewRecorder()
+	a.Guard(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	return w.Code == http.StatusOK
+}
+
+func TestRefreshRotation(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	_, first := login(t, a, "alice", "correct horse")
+
+	w, second := refreshWith(t, a, first.RefreshToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh answered %d: %s", w.Code, w.Body)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Fatal("tokens not rotated")
+	}
+	before, _, _ := authentication.ParseAsymmetricToken(first.AccessToken, a.key.PublicKey)
+	after, _, _ := authentication.ParseAsymmetricToken(second.AccessToken, a.key.PublicKey)
+	if after.Session != before.Session {
+		t.Fatalf("session changed from %s to %s", before.Session, after.Session)
+	}
+	presented, _, _ := authentication.ParseAsymmetricToken(second.RefreshToken, a.refreshKey.PublicKey)
+	parent, _, _ := authentication.ParseAsymmetricToken(first.RefreshToken, a.refreshKey.PublicKey)
+	stored, _ := api.refresh.Find(context.Background(), presented.ID)
+	if stored.Family != before.Session || stored.Parent != parent.ID {
+		t.Fatalf("stored refresh token %+v", stored)
+	}
+
+	// The refresh token also comes from the cookie set at login.
+	r := httptest.NewRequest("POST", "/auth/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: "refresh_token", Value: second.RefreshToken})
+	cookie := httptest.NewRecorder()
+	a.Refresh(cookie, r)
+	if cookie.Code != http.StatusOK {
+		t.Fatalf("refresh from cookie answered %d: %s", cookie.Code, cookie.Body)
+	}
+}
+
+func TestRefreshReuseEndsSession(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	_, first := login(t, a, "alice", "correct horse")
+	_, second := refreshWith(t, a, first.RefreshToken)
+
+	// The first token turns up again, e.g. stolen before it was used.
+	if w, _ := refreshWith(t, a, first.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused token answered %d", w.Code)
+	}
+	if w, _ := refreshWith(t, a, second.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token of the ended session answered %d", w.Code)
+	}
+	if guarded(a, second.AccessToken) {
+		t.Fatal("access token of the ended session accepted")
+	}
+	claims, _, _ := authentication.ParseAsymmetricToken(second.AccessToken, a.key.PublicKey)
+	if _, err := api.sessions.Find(context.Background(), claims.Session); err == nil {
+		t.Fatal("session still active")
+	}
+
+	// Other sessions of the user are left alone.
+	_, other := login(t, a, "alice", "correct horse")
+	if !guarded(a, other.AccessToken) {
+		t.Fatal("new session rejected")
+	}
+}
+
+func TestRefreshRejected(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	_, tokens := login(t, a, "alice", "correct horse")
+
+	if w := call(http.HandlerFunc(a.Refresh), "POST", "/auth/refresh", `{}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("missing token answered %d", w.Code)
+	}
+	if w, _ := refreshWith(t, a, tokens.AccessToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("access token answered %d", w.Code)
+	}
+	if w, _ := refreshWith(t, a, "garbage"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("garbage answered %d", w.Code)
+	}
+
+	// Users removed since the login lose their session.
+	api.users.mu.Lock()
+	delete(api.users.users, "alice")
+	api.users.mu.Unlock()
+	if w, _ := refreshWith(t, a, tokens.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("removed user answered %d", w.Code)
+	}
+	if guarded(a, tokens.AccessToken) {
+		t.Fatal("access token of removed user accepted")
+	}
+}
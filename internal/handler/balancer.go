@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+const (
+	RoundRobin       = "round_robin"
+	WeightedRandom   = "weighted_random"
+	LeastConnections = "least_connections"
+	ConsistentHash   = "consistent_hash"
+)
+
+type upstream struct {
+	url     *url.URL
+	weight  int
+	active  atomic.Int64
+	healthy atomic.Bool
+	// current is the running weight used by the smooth weighted round-robin.
+	current int
+	health  upstreamHealth
+}
+
+func newUpstream(dest config.Destination) (*upstream, error) {
+	u, err := url.Parse(dest.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url %q", dest.URL)
+	}
+	up := &upstream{url: u, weight: dest.Weight}
+	up.healthy.Store(true)
+	return up, nil
+}
+
+func (u *upstream) Name() string {
+	return u.url.Host
+}
+
+type balancer interface {
+	Next(r *http.Request, upstreams []*upstream) *upstream
+}
+
+func newBalancer(cfg config.Balancer) (balancer, error) {
+	switch cfg.Strategy {
+	case "", RoundRobin:
+		return &roundRobin{}, nil
+	case WeightedRandom:
+		return &weightedRandom{}, nil
+	case LeastConnections:
+		return &leastConnections{}, nil
+	case ConsistentHash:
+		return &consistentHash{header: cfg.Header, cookie: cfg.Cookie}, nil
+	}
+	return nil, fmt.Errorf("unknown balancer strategy %q", cfg.Strategy)
+}
+
+// roundRobin implements the smooth weighted round-robin used by nginx, which
+// spreads heavier upstreams evenly instead of sending them bursts.
+type roundRobin struct {
+	mu sync.Mutex
+}
+
+func (b *roundRobin) Next(_ *http.Request, upstreams []*upstream) *upstream {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var (
+		best  *upstream
+		total int
+	)
+	for _, u := range upstreams {
+		u.current += u.weight
+		total += u.weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	best.current -= total
+	return best
+}
+
+type weightedRandom struct{}
+
+func (b *weightedRandom) Next(_ *http.Request, upstreams []*upstream) *upstream {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	total := 0
+	for _, u := range upstreams {
+		total += u.weight
+	}
+	n := rand.Intn(total)
+	for _, u := range upstreams {
+		n -= u.weight
+		if n < 0 {
+			return u
+		}
+	}
+	return upstreams[len(upstreams)-1]
+}
+
+type leastConnections struct{}
+
+func (b *leastConnections) Next(_ *http.Request, upstreams []*upstream) *upstream {
+	var (
+		best      *upstream
+		bestScore float64
+	)
+	for _, u := range upstreams {
+		score := float64(u.active.Load()) / float64(u.weight)
+		if best == nil || score < bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+// consistentHash uses weighted rendezvous hashing so that a key keeps landing
+// on the same upstream while the set of available upstreams changes.
+type consistentHash struct {
+	header string
+	cookie string
+}
+
+func (b *consistentHash) key(r *http.Request) string {
+	if b.header != "" {
+		if v := r.Header.Get(b.header); v != "" {
+			return v
+		}
+	}
+	if b.cookie != "" {
+		if c, err := r.Cookie(b.cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return clientIP(r)
+}
+
+func (b *consistentHash) Next(r *http.Request, upstreams []*upstream) *upstream {
+	key := b.key(r)
+	var (
+		best      *upstream
+		bestScore float64
+	)
+	for _, u := range upstreams {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(u.url.String()))
+		// Map the hash into (0, 1) and weight it, see "Weighted Rendezvous Hashing".
+		x := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+		score := -float64(u.weight) / math.Log(x)
+		if best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+func weightedUpstreams(t *testing.T, weights ...int) []*upstream {
+	t.Helper()
+	upstreams := make([]*upstream, 0, len(weights))
+	for i, w := range weights {
+		u, err := newUpstream(config.Destination{URL: fmt.Sprintf("http://10.0.0.%d:8080", i+1), Weight: w})
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, strategy := range []string{"", RoundRobin, WeightedRandom, LeastConnections, ConsistentHash} {
+		if _, err := newBalancer(config.Balancer{Strategy: strategy}); err != nil {
+			t.Errorf("strategy %q: %v", strategy, err)
+		}
+	}
+	if _, err := newBalancer(config.Balancer{Strategy: "fastest"}); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
+func TestNewUpstreamRejectsRelativeURL(t *testing.T) {
+	if _, err := newUpstream(config.Destination{URL: "localhost:8080"}); err == nil {
+		t.Fatal("url without scheme accepted")
+	}
+}
+
+func TestRoundRobinIsSmooth(t *testing.T) {
+	upstreams := weightedUpstreams(t, 5, 1, 1)
+	b := &roundRobin{}
+	var order string
+	for i := 0; i < 7; i++ {
+		order += b.Next(nil, upstreams).url.Host[7:8]
+	}
+	// nginx spreads the heavy upstream instead of sending it five in a row.
+	if want := "1121311"; order != want {
+		t.Fatalf("order = %s, want %s", order, want)
+	}
+}
+
+func TestWeightedRandomFollowsWeights(t *testing.T) {
+	upstreams := weightedUpstreams(t, 3, 1)
+	b := &weightedRandom{}
+	counts := map[*upstream]int{}
+	for i := 0; i < 4000; i++ {
+		counts[b.Next(nil, upstreams)]++
+	}
+	if share := float64(counts[upstreams[0]]) / 4000; share < 0.7 || share > 0.8 {
+		t.Fatalf("share of weight 3 of 4 = %.2f", share)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	upstreams := weightedUpstreams(t, 1, 2)
+	upstreams[0].active.Store(2)
+	upstreams[1].active.Store(3)
+	b := &leastConnections{}
+	// 3 connections over weight 2 weigh less than 2 over weight 1.
+	if got := b.Next(nil, upstreams); got != upstreams[1] {
+		t.Fatalf("picked %s", got.url.Host)
+	}
+	if got := b.Next(nil, nil); got != nil {
+		t.Fatal("picked an upstream from none")
+	}
+}
+
+func TestConsistentHashKeepsKeys(t *testing.T) {
+	upstreams := weightedUpstreams(t, 1, 1, 1, 1)
+	b := &consistentHash{header: "X-User"}
+	picks := map[string]*upstream{}
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", fmt.Sprint("user-", i))
+		picks[r.Header.Get("X-User")] = b.Next(r, upstreams)
+	}
+
+	// Removing an upstream only moves the keys it had.
+	remaining := upstreams[1:]
+	for key, before := range picks {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", key)
+		after := b.Next(r, remaining)
+		if before != upstreams[0] && after != before {
+			t.Errorf("key %s moved from %s to %s", key, before.url.Host, after.url.Host)
+		}
+	}
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	b := &consistentHash{header: "X-User", cookie: "sid"}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.7:5555"
+	if got := b.key(r); got != "192.0.2.7" {
+		t.Fatalf("key = %q, want the client ip", got)
+	}
+	r.Header.Set("Cookie", "sid=abc")
+	if got := b.key(r); got != "abc" {
+		t.Fatalf("key = %q, want the cookie", got)
+	}
+	r.Header.Set("X-User", "bob")
+	if got := b.key(r); got != "bob" {
+		t.Fatalf("key = %q, want the header", got)
+	}
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+type breakerState string
+
+const (
+	BreakerClosed   breakerState = "closed"
+	BreakerOpen     breakerState = "open"
+	BreakerHalfOpen breakerState = "half-open"
+)
+
+type BreakerStatus struct {
+	State    breakerState `json:"state"`
+	Requests int          `json:"requests"`
+	Failures int          `json:"failures"`
+	OpenedAt time.Time    `json:"opened_at,omitempty"`
+}
+
+type circuitBreaker struct {
+	name string
+	cfg  config.CircuitBreaker
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// trials counts the requests let through while half-open.
+	trials    int
+	successes int
+}
+
+func newCircuitBreaker(name string, cfg config.CircuitBreaker) *circuitBreaker {
+	return &circuitBreaker{
+		name:        name,
+		cfg:         cfg.SetDefaultIfEmpty(),
+		state:       BreakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+func (cb *circuitBreaker) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := cb.allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeRequestError(w, r, http.StatusServiceUnavailable, "circuit breaker is open for "+cb.name)
+			return
+		}
+		rec := newStatusRecorder(w)
+		h.ServeHTTP(rec, r)
+		cb.record(rec.Status() < http.StatusInternalServerError)
+	})
+}
+
+// allow reports whether a request may pass, otherwise how long the caller
+// should wait before trying again.
+func (cb *circuitBreaker) allow() (time.Duration, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	switch cb.state {
+	case BreakerOpen:
+		if wait := cb.openedAt.Add(cb.cfg.OpenTimeout).Sub(now); wait > 0 {
+			return wait, false
+		}
+		cb.transition(BreakerHalfOpen)
+	case BreakerClosed:
+		if now.Sub(cb.windowStart) > cb.cfg.Window {
+			cb.resetWindow()
+		}
+		return 0, true
+	}
+
+	if cb.trials >= cb.cfg.HalfOpenRequests {
+		return cb.cfg.OpenTimeout, false
+	}
+	cb.trials++
+	return 0, true
+}
+
+func (cb *circuitBreaker) record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		if !success {
+			cb.trip()
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenRequests {
+			cb.transition(BreakerClosed)
+			cb.resetWindow()
+		}
+	case BreakerClosed:
+		cb.requests++
+		if !success {
+			cb.failures++
+		}
+		rate := float64(cb.failures) * 100 / float64(cb.requests)
+		if cb.requests >= cb.cfg.MinRequests && rate >= cb.cfg.FailureRate {
+			cb.trip()
+		}
+	}
+}
+
+func (cb *circuitBreaker) trip() {
+	cb.transition(BreakerOpen)
+	cb.openedAt = time.Now()
+}
+
+func (cb *circuitBreaker) transition(state breakerState) {
+	log.Printf("circuit breaker %s: %s -> %s", cb.name, cb.state, state)
+	cb.state = state
+	cb.trials = 0
+	cb.successes = 0
+}
+
+func (cb *circuitBreaker) resetWindow() {
+	cb.windowStart = time.Now()
+	cb.requests = 0
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) Status() BreakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return BreakerStatus{
+		State:    cb.state,
+		Requests: cb.requests,
+		Failures: cb.failures,
+		OpenedAt: cb.openedAt,
+	}
+}
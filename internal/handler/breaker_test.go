@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	status := http.StatusBadGateway
+	cb := newCircuitBreaker("alert", config.CircuitBreaker{
+		FailureRate:      50,
+		MinRequests:      4,
+		OpenTimeout:      20 * time.Millisecond,
+		HalfOpenRequests: 1,
+	})
+	h := cb.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	call := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	// Below the minimum number of requests the breaker stays closed.
+	for i := 0; i < 3; i++ {
+		call()
+	}
+	if got := cb.Status().State; got != BreakerClosed {
+		t.Fatalf("state after 3 failures = %s", got)
+	}
+	call()
+	if got := cb.Status().State; got != BreakerOpen {
+		t.Fatalf("state after 4 failures = %s", got)
+	}
+
+	w := call()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("open breaker answered %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// A failed trial opens the breaker again.
+	time.Sleep(25 * time.Millisecond)
+	if w := call(); w.Code != http.StatusBadGateway {
+		t.Fatalf("trial answered %d", w.Code)
+	}
+	if got := cb.Status().State; got != BreakerOpen {
+		t.Fatalf("state after failed trial = %s", got)
+	}
+
+	// A successful one closes it.
+	time.Sleep(25 * time.Millisecond)
+	status = http.StatusOK
+	call()
+	if got := cb.Status(); got.State != BreakerClosed || got.Requests != 0 {
+		t.Fatalf("status after successful trial = %+v", got)
+	}
+}
+
+func TestCircuitBreakerHalfOpenLimitsTrials(t *testing.T) {
+	cb := newCircuitBreaker("alert", config.CircuitBreaker{MinRequests: 1, OpenTimeout: time.Millisecond, HalfOpenRequests: 1})
+	cb.record(false)
+	time.Sleep(2 * time.Millisecond)
+
+	if _, ok := cb.allow(); !ok {
+		t.Fatal("first trial refused")
+	}
+	if _, ok := cb.allow(); ok {
+		t.Fatal("second concurrent trial let through")
+	}
+}
+
+func TestCircuitBreakerBelowFailureRate(t *testing.T) {
+	cb := newCircuitBreaker("alert", config.CircuitBreaker{MinRequests: 2})
+	cb.record(true)
+	cb.record(true)
+	cb.record(false)
+	if got := cb.Status(); got.State != BreakerClosed || got.Failures != 1 || got.Requests != 3 {
+		t.Fatalf("status = %+v", got)
+	}
+}
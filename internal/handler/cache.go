@@ -0,0 +1,487 @@
+package handler
+
+import (
+	"bytes"
+	"container/list"
+	"expvar"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// CacheHeader tells the client whether the response came from the cache.
+const CacheHeader = "X-Gateway-Cache"
+
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+)
+
+var (
+	cacheHits   = expvar.NewMap("gateway_cache_hits")
+	cacheMisses = expvar.NewMap("gateway_cache_misses")
+)
+
+// cacheableStatus lists the responses that are stored, see RFC 9110 15.1.
+var cacheableStatus = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMovedPermanently,
+	http.StatusNotFound,
+	http.StatusGone,
+}
+
+type cacheEntry struct {
+	key     string
+	route   string
+	domain  string
+	path    string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	// vary is set on the index entry of a response with a Vary header, the
+	// variants are stored under the key extended by the varying values.
+	vary []string
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.path) + len(e.body))
+	for k, vs := range e.header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// responseCache is an LRU of responses bounded by their size in bytes. It is
+// shared by all resources and survives reloads.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+func newResponseCache(cfg config.CacheStore) *responseCache {
+	cfg = cfg.SetDefaultIfEmpty()
+	return &responseCache{
+		maxBytes: cfg.MaxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *responseCache) set(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.size() > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size()
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+// Purge drops every entry matching and returns how many were removed.
+func (c *responseCache) Purge(match func(*cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if match(el.Value.(*cacheEntry)) {
+			c.remove(el)
+			purged++
+		}
+		el = next
+	}
+	return purged
+}
+
+// cachePolicy caches the responses of one resource.
+type cachePolicy struct {
+	route string
+	cfg   config.Cache
+	cache *responseCache
+}
+
+func newCachePolicy(name string, cfg config.Cache, cache *responseCache) *cachePolicy {
+	return &cachePolicy{route: name, cfg: cfg.SetDefaultIfEmpty(), cache: cache}
+}
+
+// domain keeps tenants apart, authenticated responses are keyed by the
+// domain of the user.
+func (cp *cachePolicy) domain(r *http.Request) string {
+	if claims, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok {
+		return claims.Domain.ID
+	}
+	return ""
+}
+
+// authenticated tells whether the response to r may be personal.
+func authenticated(r *http.Request) bool {
+	if _, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok {
+		return true
+	}
+	return r.Header.Get("Authorization") != ""
+}
+
+func (cp *cachePolicy) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStream(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		domain := cp.domain(r)
+		// The proxy rewrites r.URL for the upstream, entries are kept under
+		// the path of the client.
+		path := r.URL.Path
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rec := newStatusRecorder(w)
+			h.ServeHTTP(rec, r)
+			if rec.Status() < http.StatusBadRequest {
+				cp.invalidate(domain, path)
+			}
+			return
+		}
+
+		directives := cacheControl(r.Header)
+		if _, ok := directives["no-store"]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		_, noCache := directives["no-cache"]
+		revalidate := noCache || directives["max-age"] == "0"
+
+		primary := cp.route + "|" + domain + "|" + r.URL.RequestURI()
+		entry := cp.lookup(primary, r)
+		if entry != nil && !revalidate && time.Now().Before(entry.expires) {
+			cacheHits.Add(cp.route, 1)
+			cp.serve(w, r, entry, CacheHit)
+			return
+		}
+		cacheMisses.Add(cp.route, 1)
+
+		// Ask the upstream whether the stale entry is still good, unless the
+		// client brought its own validators.
+		forward := r
+		conditional := entry != nil && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == ""
+		if conditional {
+			forward = r.Clone(r.Context())
+			if etag := entry.header.Get("Etag"); etag != "" {
+				forward.Header.Set("If-None-Match", etag)
+			} else if modified := entry.header.Get("Last-Modified"); modified != "" {
+				forward.Header.Set("If-Modified-Since", modified)
+			} else {
+				conditional = false
+			}
+		}
+
+		rec := &cacheRecorder{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			limit:          cp.cfg.MaxEntryBytes,
+			intercept:      conditional,
+		}
+		rec.header.Set(CacheHeader, CacheMiss)
+		h.ServeHTTP(rec, forward)
+
+		if rec.notModified {
+			refreshed := *entry
+			refreshed.header = entry.header.Clone()
+			for k, v := range rec.header {
+				if k != CacheHeader {
+					refreshed.header[k] = v
+				}
+			}
+			if lifetime, ok := cp.lifetime(refreshed.header); ok {
+				refreshed.stored, refreshed.expires = time.Now(), time.Now().Add(lifetime)
+				cp.cache.set(&refreshed)
+			}
+			cp.serve(w, r, &refreshed, CacheRevalidated)
+			return
+		}
+		if r.Method == http.MethodGet {
+			cp.store(r, primary, domain, path, rec)
+		}
+	})
+}
+
+// lookup resolves the variant of the entry stored for primary matching r.
+func (cp *cachePolicy) lookup(primary string, r *http.Request) *cacheEntry {
+	entry := cp.cache.get(primary)
+	if entry == nil || entry.vary == nil {
+		return entry
+	}
+	return cp.cache.get(primary + varyKey(r, entry.vary))
+}
+
+func (cp *cachePolicy) store(r *http.Request, primary, domain, path string, rec *cacheRecorder) {
+	if rec.overflow || rec.snapshot == nil || !slices.Contains(cacheableStatus, rec.status) {
+		return
+	}
+	header := rec.snapshot
+	directives := cacheControl(header)
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := directives[d]; ok {
+			return
+		}
+	}
+	if header.Get("Set-Cookie") != "" {
+		return
+	}
+	// Responses to authenticated requests are only shared between users
+	// when the upstream says so, see RFC 9111 3.5.
+	if authenticated(r) && !sharedAuthenticated(directives) {
+		return
+	}
+	lifetime, ok := cp.lifetime(header)
+	if !ok {
+		return
+	}
+
+	key := primary
+	vary := headerTokens(header, "Vary")
+	if slices.Contains(vary, "*") {
+		return
+	}
+	now := time.Now()
+	if len(vary) > 0 {
+		cp.cache.set(&cacheEntry{key: primary, route: cp.route, domain: domain, path: path, vary: vary, expires: now.Add(lifetime)})
+		key += varyKey(r, vary)
+	}
+	header.Del(CacheHeader)
+	cp.cache.set(&cacheEntry{
+		key:     key,
+		route:   cp.route,
+		domain:  domain,
+		path:    path,
+		status:  rec.status,
+		header:  header,
+		body:    rec.body.Bytes(),
+		stored:  now,
+		expires: now.Add(lifetime),
+	})
+}
+
+// lifetime works out how long a response stays fresh. Responses without
+// lifetime are only kept when they can be revalidated.
+func (cp *cachePolicy) lifetime(header http.Header) (time.Duration, bool) {
+	validator := header.Get("Etag") != "" || header.Get("Last-Modified") != ""
+	directives := cacheControl(header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0, validator
+	}
+	if cp.cfg.TTL > 0 {
+		return cp.cfg.TTL, true
+	}
+
+	var lifetime time.Duration
+	if v, ok := directives["s-maxage"]; ok {
+		lifetime = seconds(v)
+	} else if v, ok := directives["max-age"]; ok {
+		lifetime = seconds(v)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = expires.Sub(date)
+	} else {
+		return 0, validator
+	}
+	lifetime -= seconds(header.Get("Age"))
+	if lifetime <= 0 {
+		return 0, validator
+	}
+	return lifetime, true
+}
+
+func (cp *cachePolicy) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, state string) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = slices.Clone(v)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	h.Set(CacheHeader, state)
+	if etag := e.header.Get("Etag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// invalidate drops the cached responses of a path after it was changed
+// through the gateway.
+func (cp *cachePolicy) invalidate(domain, path string) {
+	cp.cache.Purge(func(e *cacheEntry) bool {
+		return e.route == cp.route && e.domain == domain && e.path == path
+	})
+}
+
+// cacheRecorder passes the response on while keeping a copy of it. When the
+// gateway revalidated on its own, a 304 is held back from the client.
+type cacheRecorder struct {
+	http.ResponseWriter
+	header      http.Header
+	snapshot    http.Header
+	status      int
+	body        bytes.Buffer
+	limit       int64
+	overflow    bool
+	intercept   bool
+	notModified bool
+}
+
+// Header returns the pending headers until they are written, trailers are
+// set on the real ones afterwards.
+func (cr *cacheRecorder) Header() http.Header {
+	if cr.status != 0 && !cr.notModified {
+		return cr.ResponseWriter.Header()
+	}
+	return cr.header
+}
+
+func (cr *cacheRecorder) WriteHeader(code int) {
+	if cr.status != 0 {
+		return
+	}
+	cr.status = code
+	if cr.intercept && code == http.StatusNotModified {
+		cr.notModified = true
+		return
+	}
+	cr.snapshot = cr.header.Clone()
+	h := cr.ResponseWriter.Header()
+	for k, v := range cr.header {
+		h[k] = v
+	}
+	cr.ResponseWriter.WriteHeader(code)
+}
+
+func (cr *cacheRecorder) Write(b []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if cr.notModified {
+		return len(b), nil
+	}
+	if !cr.overflow {
+		if int64(cr.body.Len()+len(b)) > cr.limit {
+			cr.overflow = true
+			cr.body = bytes.Buffer{}
+		} else {
+			cr.body.Write(b)
+		}
+	}
+	return cr.ResponseWriter.Write(b)
+}
+
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// sharedAuthenticated tells whether directives allow a shared cache to store
+// the response to an authenticated request.
+func sharedAuthenticated(directives map[string]string) bool {
+	for _, d := range []string{"public", "s-maxage", "must-revalidate"} {
+		if _, ok := directives[d]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func headerTokens(h http.Header, name string) []string {
+	tokens := []string{}
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, http.CanonicalHeaderKey(t))
+			}
+		}
+	}
+	return tokens
+}
+
+func varyKey(r *http.Request, vary []string) string {
+	var b strings.Builder
+	for _, name := range vary {
+		b.WriteString("|" + name + "=" + strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func seconds(v string) time.Duration {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/domain"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// cachedUpstream answers with the caller and a counter, header sets the
+// response headers.
+func cachedUpstream(calls *atomic.Int64, header http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		user := ""
+		if claims, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok {
+			user = claims.Username
+		}
+		fmt.Fprintf(w, "%s %d %s", user, n, r.Header.Get("Accept-Language"))
+	})
+}
+
+func testCache(t *testing.T, header http.Header) (http.Handler, *atomic.Int64) {
+	t.Helper()
+	calls := &atomic.Int64{}
+	cp := newCachePolicy("books", config.Cache{Enabled: true}, newResponseCache(config.CacheStore{}))
+	return cp.Wrap(cachedUpstream(calls, header)), calls
+}
+
+func as(r *http.Request, username, domainID string) *http.Request {
+	claims := authentication.NewClaims().SetUsername(username).SetDomain(&domain.Domain{ID: domainID})
+	return r.WithContext(context.WithValue(r.Context(), identity.AuthenticatedUser, claims))
+}
+
+func fetch(h http.Handler, r *http.Request) (string, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Header().Get(CacheHeader), w.Body.String()
+}
+
+func TestCacheHit(t *testing.T) {
+	h, calls := testCache(t, http.Header{"Cache-Control": {"max-age=60"}})
+
+	if state, _ := fetch(h, httptest.NewRequest("GET", "/books/1", nil)); state != CacheMiss {
+		t.Fatalf("first request %s", state)
+	}
+	state, body := fetch(h, httptest.NewRequest("GET", "/books/1", nil))
+	if state != CacheHit || body != " 1 " {
+		t.Fatalf("second request %s %q", state, body)
+	}
+	if state, _ := fetch(h, httptest.NewRequest("GET", "/books/1?page=2", nil)); state != CacheMiss {
+		t.Fatalf("other query %s", state)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("upstream called %d times", n)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for name, header := range map[string]http.Header{
+		"no-store":    {"Cache-Control": {"no-store, max-age=60"}},
+		"private":     {"Cache-Control": {"private, max-age=60"}},
+		"set-cookie":  {"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}},
+		"vary star":   {"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		"no lifetime": {},
+	} {
+		h, calls := testCache(t, header)
+		fetch(h, httptest.NewRequest("GET", "/books/1", nil))
+		if state, _ := fetch(h, httptest.NewRequest("GET", "/books/1", nil)); state != CacheMiss || calls.Load() != 2 {
+			t.Errorf("%s: served %s after %d calls", name, state, calls.Load())
+		}
+	}
+}
+
+func TestCacheAuthenticated(t *testing.T) {
+	h, calls := testCache(t, http.Header{"Cache-Control": {"max-age=60"}})
+
+	// A personal response isn't stored at all, so no other user gets it.
+	fetch(h, as(httptest.NewRequest("GET", "/me", nil), "alice", "acme"))
+	state, body := fetch(h, as(httptest.NewRequest("GET", "/me", nil), "bob", "acme"))
+	if state != CacheMiss || body != "bob 2 " {
+		t.Fatalf("bob got %s %q", state, body)
+	}
+
+	r := httptest.NewRequest("GET", "/me", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	fetch(h, r)
+	if state, _ := fetch(h, r); state != CacheMiss || calls.Load() != 4 {
+		t.Fatalf("request with credentials served %s", state)
+	}
+
+	for _, cc := range []string{"public, max-age=60", "s-maxage=60", "max-age=60, must-revalidate"} {
+		h, calls := testCache(t, http.Header{"Cache-Control": {cc}})
+		fetch(h, as(httptest.NewRequest("GET", "/catalog", nil), "alice", "acme"))
+		state, body := fetch(h, as(httptest.NewRequest("GET", "/catalog", nil), "bob", "acme"))
+		if state != CacheHit || body != "alice 1 " {
+			t.Errorf("%s: bob got %s %q", cc, state, body)
+		}
+		// Shared responses still stay within their domain.
+		if state, _ := fetch(h, as(httptest.NewRequest("GET", "/catalog", nil), "carol", "globex")); state != CacheMiss || calls.Load() != 2 {
+			t.Errorf("%s: other domain got %s", cc, state)
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	h, calls := testCache(t, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}})
+	request := func(language string) *http.Request {
+		r := httptest.NewRequest("GET", "/books/1", nil)
+		r.Header.Set("Accept-Language", language)
+		return r
+	}
+
+	fetch(h, request("en"))
+	fetch(h, request("fr"))
+	if state, body := fetch(h, request("en")); state != CacheHit || body != " 1 en" {
+		t.Fatalf("en got %s %q", state, body)
+	}
+	if state, body := fetch(h, request("fr")); state != CacheHit || body != " 2 fr" {
+		t.Fatalf("fr got %s %q", state, body)
+	}
+	if state, _ := fetch(h, request("de")); state != CacheMiss || calls.Load() != 3 {
+		t.Fatalf("de got %s", state)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	calls := &atomic.Int64{}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Etag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("book"))
+	})
+	cp := newCachePolicy("books", config.Cache{Enabled: true}, newResponseCache(config.CacheStore{}))
+	h := cp.Wrap(upstream)
+
+	fetch(h, httptest.NewRequest("GET", "/books/1", nil))
+	state, body := fetch(h, httptest.NewRequest("GET", "/books/1", nil))
+	if state != CacheRevalidated || body != "book" || calls.Load() != 2 {
+		t.Fatalf("revalidation served %s %q after %d calls", state, body, calls.Load())
+	}
+
+	// The client's own validator is answered from the entry.
+	r := httptest.NewRequest("GET", "/books/1", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("conditional request answered %d %q", w.Code, w.Body)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	h, calls := testCache(t, http.Header{"Cache-Control": {"public, max-age=60"}})
+
+	fetch(h, httptest.NewRequest("GET", "/books/1", nil))
+	fetch(h, httptest.NewRequest("GET", "/books/2", nil))
+	fetch(h, as(httptest.NewRequest("GET", "/books/1", nil), "alice", "acme"))
+	fetch(h, as(httptest.NewRequest("PUT", "/books/1", nil), "alice", "acme"))
+
+	if state, _ := fetch(h, as(httptest.NewRequest("GET", "/books/1", nil), "bob", "acme")); state != CacheMiss {
+		t.Fatalf("changed path served %s", state)
+	}
+	if state, _ := fetch(h, httptest.NewRequest("GET", "/books/1", nil)); state != CacheHit {
+		t.Fatalf("other domain served %s", state)
+	}
+	if state, _ := fetch(h, httptest.NewRequest("GET", "/books/2", nil)); state != CacheHit {
+		t.Fatalf("other path served %s", state)
+	}
+	if n := calls.Load(); n != 5 {
+		t.Fatalf("upstream called %d times", n)
+	}
+}
+
+func TestCacheRewrittenPath(t *testing.T) {
+	calls := &atomic.Int64{}
+	upstream := httptest.NewServer(cachedUpstream(calls, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}))
+	t.Cleanup(upstream.Close)
+	g := testGateway(t)
+	books := resourceTo("books", "/api/books/*", upstream.URL)
+	books.Rewrite = config.Rewrite{StripPrefix: "/api"}
+	books.Cache = config.Cache{Enabled: true}
+	if err := g.Reload(config.Configuration{Resources: []config.Resource{books}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch(g.router, httptest.NewRequest("GET", "/api/books/1", nil))
+	// A stale entry is revalidated with a clone of the request, it must
+	// land under the same path.
+	r := httptest.NewRequest("GET", "/api/books/1", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	fetch(g.router, r)
+	fetch(g.router, httptest.NewRequest("POST", "/api/books/1", nil))
+	if state, _ := fetch(g.router, httptest.NewRequest("GET", "/api/books/1", nil)); state != CacheMiss {
+		t.Fatalf("changed path served %s", state)
+	}
+
+	w := httptest.NewRecorder()
+	g.purgeCache(w, httptest.NewRequest("DELETE", "/admin/cache?prefix=/api/books/", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != `{"purged":1}` {
+		t.Fatalf("purge by client prefix answered %s", body)
+	}
+	if state, _ := fetch(g.router, httptest.NewRequest("GET", "/api/books/1", nil)); state != CacheMiss {
+		t.Fatalf("purged path served %s", state)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(config.CacheStore{MaxBytes: 100})
+	for i := 0; i < 3; i++ {
+		c.set(&cacheEntry{key: fmt.Sprint("k", i), body: make([]byte, 40)})
+	}
+	if c.get("k0") != nil || c.get("k1") == nil || c.get("k2") == nil {
+		t.Fatal("least recently used entry kept")
+	}
+	c.set(&cacheEntry{key: "huge", body: make([]byte, 200)})
+	if c.get("huge") != nil || c.size > c.maxBytes {
+		t.Fatalf("oversized entry stored, size %d", c.size)
+	}
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// VariantHeader tells the upstream which group of the traffic split the
+// request was assigned to.
+const VariantHeader = "X-Gateway-Variant"
+
+const (
+	StickyCookie = "cookie"
+	StickyUser   = "user"
+)
+
+type contextKey string
+
+const variantKey contextKey = "variant"
+
+type upstreamGroup struct {
+	name      string
+	weight    int
+	upstreams []*upstream
+	balancer  balancer
+}
+
+func newUpstreamGroup(cfg config.UpstreamGroup) (*upstreamGroup, error) {
+	b, err := newBalancer(cfg.Balancer)
+	if err != nil {
+		return nil, err
+	}
+	group := &upstreamGroup{name: cfg.Name, weight: cfg.Weight, balancer: b}
+	for _, dest := range cfg.Destinations {
+		u, err := newUpstream(dest)
+		if err != nil {
+			return nil, err
+		}
+		group.upstreams = append(group.upstreams, u)
+	}
+	return group, nil
+}
+
+// splitter assigns requests to an upstream group by weight, optionally
+// keeping a client on the group it got first.
+type splitter struct {
+	resource string
+	groups   []*upstreamGroup
+	total    int
+	sticky   config.Sticky
+}
+
+func newSplitter(resource config.Resource, groups []*upstreamGroup) (*splitter, error) {
+	s := &splitter{resource: resource.Name, groups: groups, sticky: resource.Sticky}
+	names := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		if names[g.name] {
+			return nil, fmt.Errorf("resource %s: group %s is declared more than once", resource.Name, g.name)
+		}
+		names[g.name] = true
+		s.total += g.weight
+	}
+	if s.total <= 0 && len(groups) > 1 {
+		return nil, fmt.Errorf("resource %s: groups need a positive weight", resource.Name)
+	}
+	switch s.sticky.By {
+	case "", StickyUser:
+	case StickyCookie:
+		if s.sticky.Cookie == "" {
+			s.sticky.Cookie = "gateway_variant_" + resource.Name
+		}
+	default:
+		return nil, fmt.Errorf("resource %s: unknown sticky mode %q", resource.Name, s.sticky.By)
+	}
+	return s, nil
+}
+
+func (s *splitter) byName(name string) *upstreamGroup {
+	for _, g := range s.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// pick maps n in [0, total) onto the cumulative group weights, groups
+// without weight are never picked.
+func (s *splitter) pick(n int) *upstreamGroup {
+	for _, g := range s.groups {
+		n -= g.weight
+		if n < 0 {
+			return g
+		}
+	}
+	return s.groups[len(s.groups)-1]
+}
+
+// Assign picks the group for r and, for cookie stickiness, pins the client
+// to it through a response cookie.
+func (s *splitter) Assign(w http.ResponseWriter, r *http.Request) *upstreamGroup {
+	if len(s.groups) == 1 {
+		return s.groups[0]
+	}
+
+	switch s.sticky.By {
+	case StickyCookie:
+		// Setting the weight of a group to 0 rolls it back, its clients
+		// move on.
+		if c, err := r.Cookie(s.sticky.Cookie); err == nil {
+			if g := s.byName(c.Value); g != nil && g.weight > 0 {
+				return g
+			}
+		}
+		g := s.pick(rand.Intn(s.total))
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.sticky.Cookie,
+			Value:    g.name,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return g
+	case StickyUser:
+		if claims, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok && claims.Username != "" {
+			h := fnv.New32a()
+			h.Write([]byte(s.resource + ":" + claims.Username))
+			// Users are spread over the current weights, a group rolled
+			// back to 0 loses its users like it loses its cookies.
+			return s.pick(int(h.Sum32() % uint32(s.total)))
+		}
+	}
+	return s.pick(rand.Intn(s.total))
+}
+
+func withVariant(ctx context.Context, g *upstreamGroup) context.Context {
+	return context.WithValue(ctx, variantKey, g)
+}
+
+func variantFrom(ctx context.Context) *upstreamGroup {
+	g, _ := ctx.Value(variantKey).(*upstreamGroup)
+	return g
+}
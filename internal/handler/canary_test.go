@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+func canaryResource(sticky config.Sticky) config.Resource {
+	return config.Resource{
+		Name:   "shop",
+		Sticky: sticky,
+		Groups: []config.UpstreamGroup{
+			{Name: "stable", Weight: 90, Destinations: []config.Destination{{URL: "http://stable:80", Weight: 1}}},
+			{Name: "canary", Weight: 10, Destinations: []config.Destination{{URL: "http://canary:80", Weight: 1}}},
+		},
+	}
+}
+
+func testSplitter(t *testing.T, sticky config.Sticky) *splitter {
+	t.Helper()
+	resource := canaryResource(sticky)
+	groups := []*upstreamGroup{}
+	for _, cfg := range resource.UpstreamGroups() {
+		g, err := newUpstreamGroup(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups = append(groups, g)
+	}
+	s, err := newSplitter(resource, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSplitterWeights(t *testing.T) {
+	s := testSplitter(t, config.Sticky{})
+	canary := 0
+	for i := 0; i < 5000; i++ {
+		if s.Assign(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)).name == "canary" {
+			canary++
+		}
+	}
+	if share := float64(canary) / 5000; share < 0.07 || share > 0.13 {
+		t.Fatalf("canary share = %.3f, want about 0.10", share)
+	}
+}
+
+func TestSplitterStickyUser(t *testing.T) {
+	s := testSplitter(t, config.Sticky{By: StickyUser})
+	canary := 0
+	for i := 0; i < 500; i++ {
+		claims := authentication.NewClaims().SetUsername(fmt.Sprint("user-", i))
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), identity.AuthenticatedUser, claims))
+
+		first := s.Assign(httptest.NewRecorder(), r)
+		for j := 0; j < 5; j++ {
+			if again := s.Assign(httptest.NewRecorder(), r); again != first {
+				t.Fatalf("user-%d moved from %s to %s", i, first.name, again.name)
+			}
+		}
+		if first.name == "canary" {
+			canary++
+		}
+	}
+	if canary == 0 || canary > 100 {
+		t.Fatalf("%d of 500 users on the canary", canary)
+	}
+}
+
+func TestSplitterStickyCookie(t *testing.T) {
+	s := testSplitter(t, config.Sticky{By: StickyCookie})
+
+	w := httptest.NewRecorder()
+	first := s.Assign(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "gateway_variant_shop" || cookies[0].Value != first.name {
+		t.Fatalf("cookies = %v", cookies)
+	}
+
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		if got := s.Assign(w, r); got != first {
+			t.Fatalf("cookie for %s assigned %s", first.name, got.name)
+		}
+		if w.Header().Get("Set-Cookie") != "" {
+			t.Fatal("cookie set again")
+		}
+	}
+
+	// Cookies naming a group that went away are replaced.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "gateway_variant_shop", Value: "retired"})
+	w = httptest.NewRecorder()
+	s.Assign(w, r)
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatal("stale cookie kept")
+	}
+}
+
+func TestSplitterRollback(t *testing.T) {
+	for _, sticky := range []config.Sticky{{By: StickyCookie}, {By: StickyUser}} {
+		resource := canaryResource(sticky)
+		resource.Groups[1].Weight = 0
+		groups := []*upstreamGroup{}
+		for _, cfg := range resource.UpstreamGroups() {
+			g, err := newUpstreamGroup(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups = append(groups, g)
+		}
+		s, err := newSplitter(resource, groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			claims := authentication.NewClaims().SetUsername(fmt.Sprint("user-", i))
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), identity.AuthenticatedUser, claims))
+			r.AddCookie(&http.Cookie{Name: "gateway_variant_shop", Value: "canary"})
+			w := httptest.NewRecorder()
+			if g := s.Assign(w, r); g.name != "stable" {
+				t.Fatalf("%s: user-%d kept on the rolled back canary", sticky.By, i)
+			}
+			if sticky.By == StickyCookie && !strings.Contains(w.Header().Get("Set-Cookie"), "=stable") {
+				t.Fatalf("cookie not replaced: %s", w.Header().Get("Set-Cookie"))
+			}
+		}
+	}
+}
+
+func TestNewSplitterErrors(t *testing.T) {
+	resource := canaryResource(config.Sticky{By: "ip"})
+	if _, err := newSplitter(resource, nil); err == nil {
+		t.Error("unknown sticky mode accepted")
+	}
+
+	groups := []*upstreamGroup{{name: "a"}, {name: "b"}}
+	if _, err := newSplitter(config.Resource{Name: "shop"}, groups); err == nil {
+		t.Error("groups without weight accepted")
+	}
+
+	groups = []*upstreamGroup{{name: "a", weight: 1}, {name: "a", weight: 1}}
+	if _, err := newSplitter(config.Resource{Name: "shop"}, groups); err == nil {
+		t.Error("duplicate group names accepted")
+	}
+}
@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"golang.org/x/net/http2"
+)
+
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTP2 = "http2"
+	ProtocolGRPC  = "grpc"
+	// ProtocolGRPCJSON serves REST+JSON clients from a gRPC upstream.
+	ProtocolGRPCJSON = "grpc-json"
+)
+
+type grpcCode int
+
+// gRPC status codes, see google.golang.org/grpc/codes.
+const (
+	grpcOK grpcCode = iota
+	grpcCanceled
+	grpcUnknown
+	grpcInvalidArgument
+	grpcDeadlineExceeded
+	grpcNotFound
+	grpcAlreadyExists
+	grpcPermissionDenied
+	grpcResourceExhausted
+	grpcFailedPrecondition
+	grpcAborted
+	grpcOutOfRange
+	grpcUnimplemented
+	grpcInternal
+	grpcUnavailable
+	grpcDataLoss
+	grpcUnauthenticated
+)
+
+var grpcCodeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED",
+	"NOT_FOUND", "ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+func (c grpcCode) String() string {
+	if c >= 0 && int(c) < len(grpcCodeNames) {
+		return grpcCodeNames[c]
+	}
+	return "CODE(" + strconv.Itoa(int(c)) + ")"
+}
+
+// grpcCodeFromHTTP follows the mapping of the gRPC spec for errors raised by
+// the gateway itself.
+func grpcCodeFromHTTP(status int) grpcCode {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusRequestEntityTooLarge:
+		return grpcResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// httpStatusFromGRPC maps the status of a transcoded call back onto HTTP.
+func httpStatusFromGRPC(code grpcCode) int {
+	switch code {
+	case grpcOK:
+		return http.StatusOK
+	case grpcCanceled:
+		return 499
+	case grpcInvalidArgument, grpcFailedPrecondition, grpcOutOfRange:
+		return http.StatusBadRequest
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case grpcNotFound:
+		return http.StatusNotFound
+	case grpcAlreadyExists, grpcAborted:
+		return http.StatusConflict
+	case grpcPermissionDenied:
+		return http.StatusForbidden
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcUnimplemented:
+		return http.StatusNotImplemented
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus returns the grpc-status sent by the upstream, either in the
+// trailers or, for trailers-only responses, in the headers.
+func grpcStatus(h http.Header) (grpcCode, string, bool) {
+	for _, prefix := range []string{"", http.TrailerPrefix} {
+		if v := h.Get(prefix + "Grpc-Status"); v != "" {
+			code, err := strconv.Atoi(v)
+			if err != nil {
+				return grpcUnknown, v, true
+			}
+			return grpcCode(code), h.Get(prefix + "Grpc-Message"), true
+		}
+	}
+	return grpcOK, "", false
+}
+
+// writeGRPCError answers with a trailers-only gRPC response, gRPC clients
+// ignore the HTTP status and body.
+func writeGRPCError(w http.ResponseWriter, code grpcCode, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeRequestError writes a gateway error in the format the client of r
+// understands.
+func writeRequestError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isGRPC(r) {
+		writeGRPCError(w, grpcCodeFromHTTP(status), message)
+		return
+	}
+	writeError(w, status, message)
+}
+
+// errResponseHeaderTimeout is reported like the deadline of the request, the
+// client gets a 504.
+var errResponseHeaderTimeout = fmt.Errorf("timeout awaiting response headers: %w", context.DeadlineExceeded)
+
+// h2Transport speaks HTTP/2 to every upstream, over TLS for https and with
+// prior knowledge (h2c) for http destinations. Each upstream gets a single
+// multiplexed connection, the idle and per host connection limits of the
+// transport don't apply. The response header timeout does, except for gRPC
+// calls: they carry their deadline in grpc-timeout and a streaming call may
+// not send headers before its first message.
+type h2Transport struct {
+	tls *http2.Transport
+	h2c *http2.Transport
+	// responseHeaderTimeout is enforced by RoundTrip, http2.Transport has no
+	// such setting.
+	responseHeaderTimeout time.Duration
+}
+
+func newH2Transport(cfg config.Transport, tlsConfig *tls.Config) *h2Transport {
+	cfg = cfg.SetDefaultIfEmpty()
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second}
+	return &h2Transport{
+		tls: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, tlsCfg *tls.Config) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, cfg.DialTimeout+cfg.TLSHandshakeTimeout)
+				defer cancel()
+				return (&tls.Dialer{NetDialer: dialer, Config: tlsCfg}).DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: cfg.IdleConnTimeout,
+			ReadIdleTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: cfg.IdleConnTimeout,
+			ReadIdleTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		},
+		responseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+}
+
+func (t *h2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.tls
+	if req.URL.Scheme == "http" {
+		rt = t.h2c
+	}
+	if t.responseHeaderTimeout <= 0 || isGRPC(req) {
+		return rt.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.responseHeaderTimeout, cancel)
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The request context lives as long as the body is read.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *h2Transport) CloseIdleConnections() {
+	t.tls.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestWriteRequestError(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		status      int
+		code        string
+	}{
+		{contentType: "application/grpc", status: http.StatusServiceUnavailable, code: "14"},
+		{contentType: "application/grpc+proto", status: http.StatusUnauthorized, code: "16"},
+		{contentType: "application/grpc", status: http.StatusGatewayTimeout, code: "4"},
+		{contentType: "application/grpc", status: http.StatusTeapot, code: "2"},
+		{contentType: "application/json", status: http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest("POST", "/books.Library/Get", nil)
+		r.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		writeRequestError(w, r, tc.status, "upstream unavailable")
+
+		if tc.code == "" {
+			if w.Code != tc.status || w.Header().Get("Grpc-Status") != "" {
+				t.Errorf("%s: %d %v", tc.contentType, w.Code, w.Header())
+			}
+			continue
+		}
+		// gRPC clients read the status from the headers of a trailers-only
+		// response, never from the HTTP status.
+		if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Type") != "application/grpc" {
+			t.Errorf("%d: answered %d %q", tc.status, w.Code, w.Body)
+		}
+		if code, message := w.Header().Get("Grpc-Status"), w.Header().Get("Grpc-Message"); code != tc.code || message != "upstream unavailable" {
+			t.Errorf("%d: grpc-status %s %q, want %s", tc.status, code, message, tc.code)
+		}
+	}
+}
+
+func TestHTTPStatusFromGRPC(t *testing.T) {
+	for code, want := range map[grpcCode]int{
+		grpcOK:                 http.StatusOK,
+		grpcCanceled:           499,
+		grpcUnknown:            http.StatusInternalServerError,
+		grpcInvalidArgument:    http.StatusBadRequest,
+		grpcDeadlineExceeded:   http.StatusGatewayTimeout,
+		grpcNotFound:           http.StatusNotFound,
+		grpcAlreadyExists:      http.StatusConflict,
+		grpcPermissionDenied:   http.StatusForbidden,
+		grpcResourceExhausted:  http.StatusTooManyRequests,
+		grpcFailedPrecondition: http.StatusBadRequest,
+		grpcAborted:            http.StatusConflict,
+		grpcOutOfRange:         http.StatusBadRequest,
+		grpcUnimplemented:      http.StatusNotImplemented,
+		grpcInternal:           http.StatusInternalServerError,
+		grpcUnavailable:        http.StatusServiceUnavailable,
+		grpcDataLoss:           http.StatusInternalServerError,
+		grpcUnauthenticated:    http.StatusUnauthorized,
+		grpcCode(42):           http.StatusInternalServerError,
+	} {
+		if got := httpStatusFromGRPC(code); got != want {
+			t.Errorf("%s: got %d, want %d", code, got, want)
+		}
+	}
+	if got := grpcCode(42).String(); got != "CODE(42)" {
+		t.Errorf("unknown code named %s", got)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		header  http.Header
+		code    grpcCode
+		message string
+		found   bool
+	}{
+		{name: "trailers", header: http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"no such book"}}, code: grpcNotFound, message: "no such book", found: true},
+		{name: "trailers only", header: http.Header{http.TrailerPrefix + "Grpc-Status": {"0"}}, code: grpcOK, found: true},
+		{name: "invalid", header: http.Header{"Grpc-Status": {"broken"}}, code: grpcUnknown, message: "broken", found: true},
+		{name: "missing", header: http.Header{}},
+	} {
+		code, message, found := grpcStatus(tc.header)
+		if code != tc.code || message != tc.message || found != tc.found {
+			t.Errorf("%s: got %s %q %v", tc.name, code, message, found)
+		}
+	}
+}
+
+// h2cServer serves h over HTTP/2 without TLS.
+func h2cServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// h2cClient talks HTTP/2 with prior knowledge, the way gRPC clients do.
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func grpcCall(t *testing.T, url string) *http.Response {
+	t.Helper()
+	r, _ := http.NewRequest("POST", url+"/books.Library/Get", bytes.NewReader([]byte("\x00\x00\x00\x00\x01x")))
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	resp, err := h2cClient().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// grpcGateway proxies resource behind an h2c listener, like a gateway with
+// server.h2c enabled.
+func grpcGateway(t *testing.T, resource config.Resource) *httptest.Server {
+	t.Helper()
+	rv, err := NewReverseProxy(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h2cServer(t, rv.ServeHTTP)
+}
+
+func TestGRPCProxy(t *testing.T) {
+	upstream := h2cServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("upstream got %s %s", r.Proto, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "no such book")
+	})
+	resource := resourceTo("books", "/books.Library/*", upstream.URL)
+	resource.Protocol = ProtocolGRPC
+	gateway := grpcGateway(t, resource)
+
+	resp := grpcCall(t, gateway.URL)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(body) != "\x00\x00\x00\x00\x01x" {
+		t.Fatalf("answered %s %q", resp.Proto, body)
+	}
+	if code, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message"); code != "5" || message != "no such book" {
+		t.Fatalf("trailers %v", resp.Trailer)
+	}
+}
+
+func TestGRPCProxyUpstreamDown(t *testing.T) {
+	upstream := h2cServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	upstream.Close()
+	resource := resourceTo("books", "/books.Library/*", upstream.URL)
+	resource.Protocol = ProtocolGRPC
+
+	resp := grpcCall(t, grpcGateway(t, resource).URL)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != "14" {
+		t.Fatalf("answered %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestH2TransportResponseHeaderTimeout(t *testing.T) {
+	upstream := h2cServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		io.WriteString(w, "late")
+	})
+	transport := newH2Transport(config.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}, nil)
+
+	r := httptest.NewRequest("GET", upstream.URL, nil)
+	r.RequestURI = ""
+	if _, err := transport.RoundTrip(r); err != errResponseHeaderTimeout {
+		t.Fatalf("slow upstream returned %v", err)
+	}
+
+	// gRPC calls wait for the first message.
+	r = httptest.NewRequest("POST", upstream.URL, nil)
+	r.RequestURI = ""
+	r.Header.Set("Content-Type", "application/grpc")
+	resp, err := transport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "late" {
+		t.Fatalf("grpc call read %q, %v", body, err)
+	}
+
+	// The body of a timely response outlives the timeout.
+	transport = newH2Transport(config.Transport{ResponseHeaderTimeout: 300 * time.Millisecond}, nil)
+	r = httptest.NewRequest("GET", upstream.URL, nil)
+	r.RequestURI = ""
+	resp, err = transport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "late" {
+		t.Fatalf("read %q, %v", body, err)
+	}
+}
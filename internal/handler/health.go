@@ -1,7 +1,89 @@
 package handler
 
-import "net/http"
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
 
-func health(w http.ResponseWriter, _ *http.Request) {
-	w.Write([]byte("API Gateway is running"))
+type ResourceStatus struct {
+	Upstreams []UpstreamStatus `json:"upstreams"`
+	Breaker   *BreakerStatus   `json:"breaker,omitempty"`
+	Mirror    *MirrorStatus    `json:"mirror,omitempty"`
+	Streams   int              `json:"open_streams"`
+}
+
+type HealthStatus struct {
+	Status    string                    `json:"status"`
+	Message   string                    `json:"message"`
+	Resources map[string]ResourceStatus `json:"resources,omitempty"`
+}
+
+type Health struct {
+	mu       sync.RWMutex
+	proxies  map[string]*reverseProxy
+	draining atomic.Bool
+}
+
+func NewHealth() *Health {
+	return &Health{proxies: make(map[string]*reverseProxy)}
+}
+
+// Drain makes the health check fail so load balancers stop sending traffic
+// before the gateway shuts down.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// Replace swaps the checked proxies for the given ones.
+func (h *Health) Replace(proxies map[string]*reverseProxy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.proxies = proxies
+}
+
+func (h *Health) Status() HealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := HealthStatus{
+		Status:    "ok",
+		Message:   "API Gateway is running",
+		Resources: make(map[string]ResourceStatus, len(h.proxies)),
+	}
+	for name, proxy := range h.proxies {
+		upstreams := proxy.Status()
+		available := false
+		for _, u := range upstreams {
+			available = available || u.Healthy
+		}
+		resource := ResourceStatus{Upstreams: upstreams, Streams: streams.Count(name)}
+		if proxy.breaker != nil {
+			breaker := proxy.breaker.Status()
+			resource.Breaker = &breaker
+			available = available && breaker.State != BreakerOpen
+		}
+		if proxy.mirror != nil {
+			mirror := proxy.mirror.Status()
+			resource.Mirror = &mirror
+		}
+		if !available {
+			status.Status = "degraded"
+		}
+		status.Resources[name] = resource
+	}
+	if h.draining.Load() {
+		status.Status = "draining"
+		status.Message = "API Gateway is shutting down"
+	}
+	return status
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	status := h.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if h.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
 }
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+type upstreamHealth struct {
+	mu        sync.Mutex
+	failures  int
+	successes int
+	lastError string
+	checkedAt time.Time
+}
+
+type UpstreamStatus struct {
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Active    int64     `json:"active"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+func (u *upstream) Status() UpstreamStatus {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	return UpstreamStatus{
+		URL:       u.url.String(),
+		Healthy:   u.healthy.Load(),
+		Active:    u.active.Load(),
+		Failures:  u.health.failures,
+		LastError: u.health.lastError,
+		CheckedAt: u.health.checkedAt,
+	}
+}
+
+// fail records a failed probe or request and ejects the upstream once the
+// number of consecutive failures reaches threshold.
+func (u *upstream) fail(err string, threshold int) {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	u.health.successes = 0
+	u.health.failures++
+	u.health.lastError = err
+	u.health.checkedAt = time.Now()
+	if threshold > 0 && u.health.failures >= threshold && u.healthy.Load() {
+		u.healthy.Store(false)
+		log.Printf("upstream %s ejected: %s", u.url, err)
+	}
+}
+
+// succeed records a successful probe or request and brings an ejected
+// upstream back once threshold consecutive successes were seen.
+func (u *upstream) succeed(threshold int) {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	u.health.failures = 0
+	u.health.successes++
+	u.health.checkedAt = time.Now()
+	if !u.healthy.Load() && u.health.successes >= threshold {
+		u.healthy.Store(true)
+		u.health.lastError = ""
+		log.Printf("upstream %s reintroduced", u.url)
+	}
+}
+
+func healthyUpstreams(upstreams []*upstream) []*upstream {
+	healthy := make([]*upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.healthy.Load() {
+			healthy = append(healthy, u)
+		}
+	}
+	return healthy
+}
+
+type healthChecker struct {
+	cfg       config.HealthCheck
+	upstreams []*upstream
+	client    *http.Client
+	tls       *tls.Config
+}
+
+// newHealthChecker probes through the transport and TLS settings of the
+// resource, so upstreams behind a private CA, mTLS or h2c are reached the
+// same way proxied requests reach them.
+func newHealthChecker(cfg config.HealthCheck, upstreams []*upstream, transport http.RoundTripper, tlsConfig *tls.Config) *healthChecker {
+	cfg = cfg.SetDefaultIfEmpty()
+	return &healthChecker{
+		cfg:       cfg,
+		upstreams: upstreams,
+		tls:       tlsConfig,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Run probes every upstream on the configured interval until ctx is done.
+func (hc *healthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(hc.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		hc.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range hc.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			if err := hc.probe(ctx, u); err != nil {
+				u.fail(err.Error(), hc.cfg.UnhealthyThreshold)
+				return
+			}
+			u.succeed(hc.cfg.HealthyThreshold)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// probe issues a GET against the health path, or only opens a connection
+// when no path is configured. Connections to https upstreams complete the
+// TLS handshake.
+func (hc *healthChecker) probe(ctx context.Context, u *upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.cfg.Timeout)
+	defer cancel()
+
+	if hc.cfg.Path == "" {
+		var dialer interface {
+			DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+		} = new(net.Dialer)
+		if u.url.Scheme == "https" {
+			dialer = &tls.Dialer{Config: hc.tls}
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", hostPort(u))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	target := *u.url
+	target.Path = singleJoiningSlash(u.url.Path, hc.cfg.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &statusError{resp.StatusCode}
+	}
+	return nil
+}
+
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return "upstream responded with " + http.StatusText(e.code)
+}
+
+func hostPort(u *upstream) string {
+	if u.url.Port() != "" {
+		return u.url.Host
+	}
+	if u.url.Scheme == "https" {
+		return net.JoinHostPort(u.url.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.url.Hostname(), "80")
+}
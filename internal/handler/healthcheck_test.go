@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func testUpstream(t *testing.T, rawURL string) *upstream {
+	t.Helper()
+	u, err := newUpstream(config.Destination{URL: rawURL, Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func trusting(srv *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+func TestHealthCheckProbeUsesResourceTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	u := testUpstream(t, srv.URL)
+	tlsConfig := trusting(srv)
+
+	for _, tc := range []struct {
+		name string
+		path string
+	}{
+		{"http", "/healthz"},
+		{"tcp", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.HealthCheck{Path: tc.path}
+			hc := newHealthChecker(cfg, []*upstream{u}, newTransport(config.Transport{}, tlsConfig), tlsConfig)
+			if err := hc.probe(context.Background(), u); err != nil {
+				t.Fatalf("probe with the resource CA: %v", err)
+			}
+
+			untrusted := newHealthChecker(cfg, []*upstream{u}, newTransport(config.Transport{}, &tls.Config{}), &tls.Config{})
+			if err := untrusted.probe(context.Background(), u); err == nil {
+				t.Fatal("probe without the resource CA succeeded")
+			}
+		})
+	}
+}
+
+func TestHealthCheckProbeH2C(t *testing.T) {
+	var proto string
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}), &http2.Server{}))
+	defer srv.Close()
+	u := testUpstream(t, srv.URL)
+
+	hc := newHealthChecker(config.HealthCheck{Path: "/"}, []*upstream{u}, newH2Transport(config.Transport{}, nil), nil)
+	if err := hc.probe(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Fatalf("probe used %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestHealthCheckProbeServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	u := testUpstream(t, srv.URL)
+
+	hc := newHealthChecker(config.HealthCheck{Path: "/"}, []*upstream{u}, newTransport(config.Transport{}, nil), nil)
+	if err := hc.probe(context.Background(), u); err == nil {
+		t.Fatal("503 passed the probe")
+	}
+}
+
+func TestUpstreamEjection(t *testing.T) {
+	u := testUpstream(t, "http://127.0.0.1:1")
+
+	u.fail("refused", 2)
+	if !u.healthy.Load() {
+		t.Fatal("ejected before the threshold")
+	}
+	u.fail("refused", 2)
+	if u.healthy.Load() {
+		t.Fatal("not ejected at the threshold")
+	}
+	if got := healthyUpstreams([]*upstream{u}); len(got) != 0 {
+		t.Fatalf("healthy upstreams = %d, want 0", len(got))
+	}
+
+	u.succeed(2)
+	if u.healthy.Load() {
+		t.Fatal("reintroduced before the threshold")
+	}
+	u.succeed(2)
+	if !u.healthy.Load() {
+		t.Fatal("not reintroduced at the threshold")
+	}
+	if status := u.Status(); status.LastError != "" || status.Failures != 0 {
+		t.Fatalf("status after recovery = %+v", status)
+	}
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/key"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// IdentityKeysPath publishes the key upstreams verify identity tokens with.
+const IdentityKeysPath = "/.well-known/gateway-keys"
+
+// identityIssuer replaces whatever the client sent in the identity header
+// with a token minted for the authenticated user.
+type identityIssuer struct {
+	cfg config.Identity
+	key *key.Key
+}
+
+func newIdentityIssuer(ctx context.Context, api authentication.AuthenticationAPI, cfg config.Identity) (*identityIssuer, error) {
+	cfg = cfg.SetDefaultIfEmpty()
+	k, err := api.Key().FetchKey(ctx, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &identityIssuer{cfg: cfg, key: k}, nil
+}
+
+// keyID goes into the token footer so services can tell rotated keys apart.
+func (ii *identityIssuer) keyID() string {
+	return ii.cfg.Key + ":" + strconv.FormatInt(ii.key.ID, 10)
+}
+
+// Mint signs the identity of claims for the upstreams of audience, the
+// resource name, so one upstream can't replay it to another.
+func (ii *identityIssuer) Mint(claims *authentication.Claims, audience string) (string, error) {
+	now := time.Now()
+	subject := claims.Subject
+	if subject == "" {
+		subject = claims.Username
+	}
+	header := authentication.NewTokenHeader().
+		SetSubject(subject).
+		SetAudience(audience).
+		SetIssuer(ii.cfg.Issuer).
+		SetIssuedAt(now).
+		SetNotBefore(now).
+		SetExpiresAt(now.Add(ii.cfg.TTL))
+	return authentication.Claims{
+		Subject:  subject,
+		Username: claims.Username,
+		Email:    claims.Email,
+		Domain:   claims.Domain,
+		Roles:    claims.Roles,
+	}.GenerateAsymmetric(ii.key.PrivateKey, ii.keyID(), header)
+}
+
+func (ii *identityIssuer) Wrap(resource string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(ii.cfg.Header)
+		if claims, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok {
+			// The gateway token of the client is no business of the upstream.
+			if !ii.cfg.KeepAuthorization {
+				r.Header.Del("Authorization")
+			}
+			token, err := ii.Mint(claims, resource)
+			if err != nil {
+				log.Printf("minting identity token for %s failed: %v", claims.Username, err)
+				writeRequestError(w, r, http.StatusInternalServerError, "identity unavailable")
+				return
+			}
+			r.Header.Set(ii.cfg.Header, token)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type IdentityKey struct {
+	ID        string `json:"kid"`
+	Version   string `json:"version"`
+	Purpose   string `json:"purpose"`
+	PublicKey string `json:"public_key"`
+}
+
+type IdentityKeys struct {
+	Issuer string        `json:"issuer"`
+	Header string        `json:"header"`
+	Keys   []IdentityKey `json:"keys"`
+}
+
+// ServeHTTP publishes the public key, it's fine to cache for a while.
+func (ii *identityIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, IdentityKeys{
+		Issuer: ii.cfg.Issuer,
+		Header: ii.cfg.Header,
+		Keys: []IdentityKey{{
+			ID:        ii.keyID(),
+			Version:   "v2",
+			Purpose:   "public",
+			PublicKey: ii.key.PublicKey,
+		}},
+	})
+}
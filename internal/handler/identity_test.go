@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/o1egl/paseto"
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/domain"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+func testIdentity(t *testing.T, cfg config.Identity) *identityIssuer {
+	t.Helper()
+	return &identityIssuer{cfg: cfg.SetDefaultIfEmpty(), key: testKey(t)}
+}
+
+// forwarded returns the headers the upstream of resource got for r.
+func forwarded(ii *identityIssuer, resource string, r *http.Request) http.Header {
+	var header http.Header
+	ii.Wrap(resource, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	return header
+}
+
+func authenticatedAs(r *http.Request, claims *authentication.Claims) *http.Request {
+	r.Header.Set("Authorization", "Bearer gateway-token")
+	return r.WithContext(context.WithValue(r.Context(), identity.AuthenticatedUser, claims))
+}
+
+// publishedKey fetches the key the way an upstream does.
+func publishedKey(t *testing.T, ii *identityIssuer) IdentityKey {
+	t.Helper()
+	w := httptest.NewRecorder()
+	ii.ServeHTTP(w, httptest.NewRequest("GET", IdentityKeysPath, nil))
+	var keys IdentityKeys
+	if err := json.NewDecoder(w.Body).Decode(&keys); err != nil || len(keys.Keys) != 1 {
+		t.Fatalf("keys %s, %v", w.Body, err)
+	}
+	if keys.Header != "X-Gateway-Identity" || keys.Issuer != "gateway" {
+		t.Fatalf("keys %+v", keys)
+	}
+	return keys.Keys[0]
+}
+
+func TestIdentityToken(t *testing.T) {
+	ii := testIdentity(t, config.Identity{TTL: time.Minute})
+	claims := authentication.NewClaims().
+		SetUsername("alice").
+		SetDomain(&domain.Domain{ID: "acme-id", Name: "acme"})
+	claims.Roles = []string{"admin"}
+
+	header := forwarded(ii, "books", authenticatedAs(httptest.NewRequest("GET", "/books", nil), claims))
+	token := header.Get("X-Gateway-Identity")
+	if token == "" || header.Get("Authorization") != "" {
+		t.Fatalf("forwarded %v", header)
+	}
+
+	published := publishedKey(t, ii)
+	got, footer, err := authentication.ParseAsymmetricToken(token, published.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if footer != published.ID || got.Username != "alice" || got.Domain.ID != "acme-id" || len(got.Roles) != 1 {
+		t.Fatalf("footer %q, claims %+v", footer, got)
+	}
+
+	var raw paseto.JSONToken
+	if err := paseto.NewV2().Verify(token, mustPublicKey(t, published.PublicKey), &raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Jti == "" || raw.Issuer != "gateway" || raw.Subject != "alice" {
+		t.Fatalf("token %+v", raw)
+	}
+	if lifetime := time.Until(raw.Expiration); lifetime <= 0 || lifetime > time.Minute {
+		t.Fatalf("token expires in %v", lifetime)
+	}
+	if err := raw.Validate(paseto.ForAudience("books")); err != nil {
+		t.Fatalf("token not meant for its resource: %v", err)
+	}
+	// Replaying the token to another upstream fails its audience check.
+	if err := raw.Validate(paseto.ForAudience("orders")); err == nil {
+		t.Fatal("token accepted by another resource")
+	}
+
+	second := forwarded(ii, "books", authenticatedAs(httptest.NewRequest("GET", "/books", nil), claims))
+	var again paseto.JSONToken
+	paseto.NewV2().Verify(second.Get("X-Gateway-Identity"), mustPublicKey(t, published.PublicKey), &again, nil)
+	if again.Jti == raw.Jti {
+		t.Fatal("jti reused")
+	}
+}
+
+func TestIdentityTokenExpired(t *testing.T) {
+	ii := testIdentity(t, config.Identity{})
+	ii.cfg.TTL = -time.Second
+	token, err := ii.Mint(authentication.NewClaims().SetUsername("alice"), "books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := authentication.ParseAsymmetricToken(token, publishedKey(t, ii).PublicKey); err == nil {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	ii := testIdentity(t, config.Identity{})
+
+	// Anonymous requests can't bring their own identity, and credentials
+	// for the upstream itself pass.
+	r := httptest.NewRequest("GET", "/books", nil)
+	r.Header.Set("X-Gateway-Identity", "forged")
+	r.Header.Set("Authorization", "Basic upstream")
+	if header := forwarded(ii, "books", r); header.Get("X-Gateway-Identity") != "" || header.Get("Authorization") != "Basic upstream" {
+		t.Fatalf("anonymous request forwarded %v", header)
+	}
+
+	ii = testIdentity(t, config.Identity{KeepAuthorization: true})
+	header := forwarded(ii, "books", authenticatedAs(httptest.NewRequest("GET", "/books", nil), authentication.NewClaims().SetUsername("alice")))
+	if header.Get("Authorization") != "Bearer gateway-token" || header.Get("X-Gateway-Identity") == "" {
+		t.Fatalf("kept authorization forwarded %v", header)
+	}
+}
+
+func mustPublicKey(t *testing.T, pem string) any {
+	t.Helper()
+	key, err := authentication.ParseED25519PublicKey(pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
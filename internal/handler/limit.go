@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// Limit rejections, keyed by resource and reason, e.g. "alert.body".
+var limitsRejected = expvar.NewMap("gateway_limits_rejected")
+
+// requestLimiter enforces the limits of a resource ahead of the guard so
+// oversized or unexpected requests never reach authentication.
+type requestLimiter struct {
+	name         string
+	maxBodyBytes int64
+	contentTypes []string
+	methods      []string
+}
+
+func newRequestLimiter(name string, cfg config.Limits) *requestLimiter {
+	rl := &requestLimiter{name: name, maxBodyBytes: cfg.MaxBodyBytes}
+	for _, ct := range cfg.ContentTypes {
+		rl.contentTypes = append(rl.contentTypes, strings.ToLower(strings.TrimSpace(ct)))
+	}
+	for _, m := range cfg.Methods {
+		rl.methods = append(rl.methods, strings.ToUpper(m))
+	}
+	if slices.Contains(rl.methods, http.MethodGet) && !slices.Contains(rl.methods, http.MethodHead) {
+		rl.methods = append(rl.methods, http.MethodHead)
+	}
+	return rl
+}
+
+func (rl *requestLimiter) reject(w http.ResponseWriter, r *http.Request, reason string, status int, message string) {
+	limitsRejected.Add(rl.name+"."+reason, 1)
+	writeRequestError(w, r, status, message)
+}
+
+func (rl *requestLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(rl.methods) > 0 && !slices.Contains(rl.methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(rl.methods, ", "))
+			rl.reject(w, r, "method", http.StatusMethodNotAllowed, "method "+r.Method+" is not allowed")
+			return
+		}
+
+		hasBody := r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody
+		if len(rl.contentTypes) > 0 && hasBody && !rl.allowedType(r.Header.Get("Content-Type")) {
+			rl.reject(w, r, "content_type", http.StatusUnsupportedMediaType, "content type "+r.Header.Get("Content-Type")+" is not supported")
+			return
+		}
+
+		if rl.maxBodyBytes > 0 && hasBody {
+			if r.ContentLength > rl.maxBodyBytes {
+				rl.reject(w, r, "body", http.StatusRequestEntityTooLarge, tooLarge(rl.maxBodyBytes))
+				return
+			}
+			// Chunked bodies are cut off once they pass the limit.
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, rl.maxBodyBytes), name: rl.name}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (rl *requestLimiter) allowedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range rl.contentTypes {
+		if allowed == mediaType || allowed == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func tooLarge(limit int64) string {
+	return fmt.Sprintf("request body exceeds %d bytes", limit)
+}
+
+// limitedBody counts a rejection the first time the limit is hit while the
+// body is read.
+type limitedBody struct {
+	io.ReadCloser
+	name    string
+	counted bool
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	n, err := lb.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if err != nil && !lb.counted && errors.As(err, &maxErr) {
+		lb.counted = true
+		limitsRejected.Add(lb.name+".body", 1)
+	}
+	return n, err
+}
+
+// bodyTooLarge tells whether a request failed because its body passed the
+// limit of the resource.
+func bodyTooLarge(err error) (string, bool) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return tooLarge(maxErr.Limit), true
+	}
+	return "", false
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// echo answers with the body it could read, or 413 when the limit cut it off.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if message, ok := bodyTooLarge(err); ok {
+		writeRequestError(w, r, http.StatusRequestEntityTooLarge, message)
+		return
+	}
+	w.Write(body)
+})
+
+func TestRequestLimiter(t *testing.T) {
+	h := newRequestLimiter("alert", config.Limits{
+		MaxBodyBytes: 8,
+		ContentTypes: []string{"application/json", "text/*"},
+		Methods:      []string{"get", "POST"},
+	}).Wrap(echo)
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		chunked     bool
+		status      int
+	}{
+		{name: "allowed", method: "POST", contentType: "application/json", body: `{"a":1}`, status: http.StatusOK},
+		{name: "parameters", method: "POST", contentType: "application/json; charset=utf-8", body: `{}`, status: http.StatusOK},
+		{name: "wildcard", method: "POST", contentType: "text/plain", body: "hi", status: http.StatusOK},
+		{name: "head with get", method: "HEAD", status: http.StatusOK},
+		{name: "method", method: "DELETE", status: http.StatusMethodNotAllowed},
+		{name: "content type", method: "POST", contentType: "application/xml", body: "<a/>", status: http.StatusUnsupportedMediaType},
+		{name: "invalid content type", method: "POST", contentType: "json", body: "{}", status: http.StatusUnsupportedMediaType},
+		{name: "no body any type", method: "GET", status: http.StatusOK},
+		{name: "content length", method: "POST", contentType: "text/plain", body: "123456789", status: http.StatusRequestEntityTooLarge},
+		{name: "chunked", method: "POST", contentType: "text/plain", body: "123456789", chunked: true, status: http.StatusRequestEntityTooLarge},
+		{name: "chunked within", method: "POST", contentType: "text/plain", body: "12345678", chunked: true, status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			r := httptest.NewRequest(tc.method, "/alerts", body)
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			if tc.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("answered %d: %s", w.Code, w.Body)
+			}
+			if tc.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, POST, HEAD" {
+				t.Fatalf("Allow = %q", w.Header().Get("Allow"))
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.body {
+				t.Fatalf("upstream read %q", w.Body)
+			}
+		})
+	}
+}
+
+func TestRequestLimiterGRPC(t *testing.T) {
+	h := newRequestLimiter("rpc", config.Limits{MaxBodyBytes: 4}).Wrap(echo)
+	r := httptest.NewRequest("POST", "/pkg.Service/Call", strings.NewReader("123456789"))
+	r.Header.Set("Content-Type", "application/grpc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Grpc-Status") == "" {
+		t.Fatalf("gRPC request rejected with %d %v", w.Code, w.Header())
+	}
+}
@@ -9,8 +9,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/swavan.io/gateway/internal/config"
 	"github.com/swavan.io/gateway/pkg/authentication"
 	"github.com/swavan.io/gateway/pkg/authentication/key"
+	"github.com/swavan.io/gateway/pkg/authentication/user"
 	"github.com/swavan.io/gateway/pkg/identity"
 )
 
@@ -20,8 +22,19 @@ type Logger struct {
 
 func (l *Logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	l.handler.ServeHTTP(w, r)
-	log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(start))
+	// The proxies rewrite the URL in place.
+	path := r.URL.Path
+	rec := newStatusRecorder(w)
+	l.handler.ServeHTTP(rec, r)
+	if rec.Status() == http.StatusSwitchingProtocols {
+		log.Printf("%s %s upgraded to %s, closed after %v", r.Method, path, r.Header.Get("Upgrade"), time.Since(start))
+		return
+	}
+	if code, message, ok := grpcStatus(rec.Header()); ok && isGRPC(r) {
+		log.Printf("%s %s %d grpc %s %q %v", r.Method, path, rec.Status(), code, message, time.Since(start))
+		return
+	}
+	log.Printf("%s %s %d %v", r.Method, path, rec.Status(), time.Since(start))
 }
 
 func NewLogger(handlerToWrap http.Handler) *Logger {
@@ -31,6 +44,18 @@ func NewLogger(handlerToWrap http.Handler) *Logger {
 type Auth struct {
 	api authentication.AuthenticationAPI
 	key *key.Key
+	// refreshKey signs refresh tokens, they can't pass as access tokens.
+	refreshKey *key.Key
+	// oidcKey signs the cookie carrying an OIDC login between its redirects.
+	oidcKey *key.Key
+	tokens  config.Tokens
+	// revocations is nil until the revocations are loaded.
+	revocations *revocations
+	// sessionsSeen throttles how often Guard updates a session.
+	sessionsSeen sessionsSeen
+	// clientUser maps verified client certificates onto users, see
+	// config.TLS.
+	clientUser string
 }
 
 func NewAuthMiddleware(ctx context.Context, api authentication.AuthenticationAPI) (*Auth, error) {
@@ -40,25 +65,46 @@ func NewAuthMiddleware(ctx context.Context, api authentication.AuthenticationAPI
 	if err != nil {
 		return nil, err
 	}
-	return &Auth{api, key}, nil
+	refreshKey, err := api.
+		Key().
+		FetchKey(ctx, os.Getenv("APP_NAME")+"-refresh")
+	if err != nil {
+		return nil, err
+	}
+	oidcKey, err := api.
+		Key().
+		FetchKey(ctx, os.Getenv("APP_NAME")+"-oidc")
+	if err != nil {
+		return nil, err
+	}
+	return &Auth{
+		api:        api,
+		key:        key,
+		refreshKey: refreshKey,
+		oidcKey:    oidcKey,
+		tokens:     config.Tokens{}.SetDefaultIfEmpty(),
+	}, nil
 }
 
 func (a *Auth) Guard(h http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		accessToken := r.Header.Get("Authorization")
 		if accessToken != "" {
-			accessToken = strings.TrimPrefix(accessToken, "Bearer ")
-		} else {
-			cookie, err := r.Cookie(string(identity.AccessToken))
-			if err != nil {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
+			// gRPC clients send the authorization metadata lowercased.
+			accessToken = strings.TrimPrefix(strings.TrimPrefix(accessToken, "Bearer "), "bearer ")
+		} else if token := streamToken(r); token != "" {
+			accessToken = token
+		} else if cookie, err := r.Cookie(string(identity.AccessToken)); err == nil {
 			accessToken = cookie.Value
 		}
 
 		if accessToken == "" {
-			w.WriteHeader(http.StatusForbidden)
+			// A verified client certificate stands in for a missing token.
+			if claims := a.certificateClaims(r); claims != nil {
+				a.authenticated(h, w, r, claims)
+				return
+			}
+			deny(w, r, http.StatusForbidden, grpcUnauthenticated)
 			return
 		}
 
@@ -67,20 +113,89 @@ func (a *Auth) Guard(h http.HandlerFunc) http.HandlerFunc {
 			a.key.PublicKey,
 		)
 		if err != nil {
-			w.WriteHeader(http.StatusForbidden)
+			deny(w, r, http.StatusForbidden, grpcUnauthenticated)
+			return
+		}
+		if a.revocations != nil && a.revocations.Revoked(claims) {
+			deny(w, r, http.StatusForbidden, grpcUnauthenticated)
 			return
 		}
+		a.seen(r.Context(), claims)
 
-		w.Header().Add("X-AUTH-USER", claims.Username)
+		a.authenticated(h, w, r, claims)
+	})
+}
 
-		h.ServeHTTP(
-			w,
-			r.WithContext(
-				context.WithValue(
-					r.Context(),
-					identity.AuthenticatedUser, claims)))
+func (a *Auth) authenticated(h http.HandlerFunc, w http.ResponseWriter, r *http.Request, claims *authentication.Claims) {
+	w.Header().Add("X-AUTH-USER", claims.Username)
 
-	})
+	h.ServeHTTP(
+		w,
+		r.WithContext(
+			context.WithValue(
+				r.Context(),
+				identity.AuthenticatedUser, claims)))
+}
+
+// certificateClaims looks up the user of a verified client certificate by
+// its common name or email address.
+func (a *Auth) certificateClaims(r *http.Request) *authentication.Claims {
+	if a.clientUser == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	username := cert.Subject.CommonName
+	if a.clientUser == "email" {
+		if len(cert.EmailAddresses) == 0 {
+			return nil
+		}
+		username = cert.EmailAddresses[0]
+	}
+
+	usr, err := a.api.User().FindByUsername(r.Context(), username)
+	if err != nil || usr.Username == "" {
+		log.Printf("client certificate %q doesn't belong to a user: %v", username, err)
+		return nil
+	}
+	claims, err := a.userClaims(r.Context(), usr)
+	if err != nil {
+		log.Printf("client certificate %q: %v", username, err)
+		return nil
+	}
+	return claims
+}
+
+// userClaims builds the claims of a stored user with the first of its
+// domains and the roles it has there.
+func (a *Auth) userClaims(ctx context.Context, usr *user.User) (*authentication.Claims, error) {
+	claims := authentication.NewClaims().
+		SetSubject(usr.ID).
+		SetUsername(usr.Username).
+		SetPreferredUsername(usr.PreferredUsername).
+		SetName(usr.Name).
+		SetGivenName(usr.GivenName).
+		SetFamilyName(usr.FamilyName).
+		SetEmail(usr.Email).
+		SetEmailVerified(usr.EmailVerified)
+
+	domains, err := a.api.User().GetDomains(ctx, usr.Username)
+	if err != nil {
+		return nil, err
+	}
+	domains = slices.DeleteFunc(domains, func(d string) bool { return d == "" })
+	if len(domains) == 0 {
+		return claims, nil
+	}
+	dom, err := a.api.Domain().Find(ctx, domains[0])
+	if err != nil {
+		return nil, err
+	}
+	claims.SetDomain(dom)
+	// Policies name roles as role:<name>.
+	for _, role := range a.api.Access().Enforcer().GetRolesForUserInDomain(usr.Username, domains[0]) {
+		claims.Roles = append(claims.Roles, strings.TrimPrefix(role, "role:"))
+	}
+	return claims, nil
 }
 
 func (a *Auth) Access(h http.HandlerFunc) http.HandlerFunc {
@@ -103,13 +218,39 @@ func (a *Auth) Access(h http.HandlerFunc) http.HandlerFunc {
 			action,
 		)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			deny(w, r, http.StatusInternalServerError, grpcInternal)
 			return
 		}
 		if !s {
-			w.WriteHeader(http.StatusUnauthorized)
+			deny(w, r, http.StatusUnauthorized, grpcPermissionDenied)
 			return
 		}
 		h.ServeHTTP(w, r)
 	})
 }
+
+// deny rejects r with a bare status, gRPC clients get the matching gRPC
+// status instead.
+func deny(w http.ResponseWriter, r *http.Request, status int, code grpcCode) {
+	if isGRPC(r) {
+		writeGRPCError(w, code, http.StatusText(status))
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// streamToken takes the access token from the query of WebSocket and
+// Server-Sent Events requests, browsers can't set headers on those. The
+// token is removed so it isn't forwarded upstream.
+func streamToken(r *http.Request) string {
+	if !isStream(r) {
+		return ""
+	}
+	query := r.URL.Query()
+	token := query.Get(string(identity.AccessToken))
+	if token != "" {
+		query.Del(string(identity.AccessToken))
+		r.URL.RawQuery = query.Encode()
+	}
+	return token
+}
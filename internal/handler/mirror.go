@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// MirrorHeader marks requests sent to the shadow upstream.
+const MirrorHeader = "X-Gateway-Mirror"
+
+// credentialHeaders are stripped from shadow requests, see
+// config.Mirror.KeepCredentials.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+type MirrorStatus struct {
+	Destination     string  `json:"destination"`
+	Mirrored        int64   `json:"mirrored"`
+	Skipped         int64   `json:"skipped"`
+	Errors          int64   `json:"errors"`
+	StatusMismatch  int64   `json:"status_mismatch"`
+	PrimaryLatency  float64 `json:"primary_latency_ms"`
+	ShadowLatency   float64 `json:"shadow_latency_ms"`
+	LatencyIncrease float64 `json:"latency_increase_ms"`
+}
+
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+	err     error
+}
+
+type mirror struct {
+	name     string
+	target   *url.URL
+	cfg      config.Mirror
+	client   *http.Client
+	inFlight chan struct{}
+
+	mirrored       atomic.Int64
+	skipped        atomic.Int64
+	errors         atomic.Int64
+	mismatches     atomic.Int64
+	compared       atomic.Int64
+	primaryLatency atomic.Int64
+	shadowLatency  atomic.Int64
+}
+
+// newMirror sends the shadow requests through transport, the one of the
+// resource, so they get its TLS and connection settings.
+func newMirror(name string, cfg config.Mirror, transport http.RoundTripper) (*mirror, error) {
+	target, err := url.Parse(cfg.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("resource %s: invalid mirror destination %q", name, cfg.Destination)
+	}
+	cfg = cfg.SetDefaultIfEmpty()
+	return &mirror{
+		name:   name,
+		target: target,
+		cfg:    cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, cfg.MaxInFlight),
+	}, nil
+}
+
+func (m *mirror) sampled(r *http.Request) bool {
+	if isStream(r) {
+		return false
+	}
+	return m.cfg.Percentage >= 100 || rand.Float64()*100 < m.cfg.Percentage
+}
+
+// Wrap sends a copy of sampled requests to the shadow upstream while h
+// serves the client, then compares both outcomes in the background.
+func (m *mirror) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.sampled(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := m.buffer(r)
+		if !ok {
+			m.skipped.Add(1)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			m.skipped.Add(1)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		shadow := make(chan mirrorResult, 1)
+		go func(req *http.Request) {
+			defer func() { <-m.inFlight }()
+			shadow <- m.send(req, body)
+		}(m.shadowRequest(r))
+
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		h.ServeHTTP(rec, r)
+		primary := mirrorResult{status: rec.Status(), latency: time.Since(start)}
+
+		go m.compare(r.Method, r.URL.Path, primary, shadow)
+	})
+}
+
+// buffer reads the body so it can be sent twice, bodies above the limit are
+// put back untouched and the request isn't mirrored.
+func (m *mirror) buffer(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.cfg.MaxBodyBytes+1))
+	if err != nil || int64(len(body)) > m.cfg.MaxBodyBytes {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func (m *mirror) shadowRequest(r *http.Request) *http.Request {
+	// The shadow request must outlive the client request.
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.RequestURI = ""
+	req.URL.Scheme = m.target.Scheme
+	req.URL.Host = m.target.Host
+	if m.target.Path != "" {
+		req.URL.Path = singleJoiningSlash(m.target.Path, r.URL.Path)
+		req.URL.RawPath = ""
+	}
+	req.Host = m.target.Host
+	req.Header.Set(MirrorHeader, "true")
+	if !m.cfg.KeepCredentials {
+		for _, name := range credentialHeaders {
+			req.Header.Del(name)
+		}
+	}
+	return req
+}
+
+func (m *mirror) send(req *http.Request, body []byte) mirrorResult {
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	} else {
+		req.Body = nil
+	}
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return mirrorResult{latency: time.Since(start), err: err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return mirrorResult{status: resp.StatusCode, latency: time.Since(start)}
+}
+
+func (m *mirror) compare(method, path string, primary mirrorResult, shadow <-chan mirrorResult) {
+	result := <-shadow
+	m.mirrored.Add(1)
+	if result.err != nil {
+		m.errors.Add(1)
+		log.Printf("mirror %s: %s %s failed: %v", m.name, method, path, result.err)
+		return
+	}
+	m.compared.Add(1)
+	m.primaryLatency.Add(int64(primary.latency))
+	m.shadowLatency.Add(int64(result.latency))
+	if result.status != primary.status {
+		m.mismatches.Add(1)
+		log.Printf("mirror %s: %s %s primary=%d (%v) shadow=%d (%v)",
+			m.name, method, path, primary.status, primary.latency, result.status, result.latency)
+	}
+}
+
+func (m *mirror) Status() MirrorStatus {
+	status := MirrorStatus{
+		Destination:    m.target.String(),
+		Mirrored:       m.mirrored.Load(),
+		Skipped:        m.skipped.Load(),
+		Errors:         m.errors.Load(),
+		StatusMismatch: m.mismatches.Load(),
+	}
+	if n := m.compared.Load(); n > 0 {
+		ms := float64(time.Millisecond) * float64(n)
+		status.PrimaryLatency = float64(m.primaryLatency.Load()) / ms
+		status.ShadowLatency = float64(m.shadowLatency.Load()) / ms
+		status.LatencyIncrease = status.ShadowLatency - status.PrimaryLatency
+	}
+	return status
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// shadowed is a request as the shadow upstream received it.
+type shadowed struct {
+	header http.Header
+	body   string
+}
+
+func shadowUpstream(t *testing.T, release <-chan struct{}) (*httptest.Server, <-chan shadowed) {
+	t.Helper()
+	received := make(chan shadowed, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if release != nil {
+			<-release
+		}
+		received <- shadowed{header: r.Header.Clone(), body: string(body)}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func receive(t *testing.T, received <-chan shadowed) shadowed {
+	t.Helper()
+	select {
+	case s := <-received:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow upstream not called")
+		return shadowed{}
+	}
+}
+
+func TestMirrorReplaysBody(t *testing.T) {
+	shadow, received := shadowUpstream(t, nil)
+	for _, keep := range []bool{false, true} {
+		m, err := newMirror("books", config.Mirror{Destination: shadow.URL, KeepCredentials: keep}, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/books", strings.NewReader(`{"title":"Dune"}`))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.AddCookie(&http.Cookie{Name: "session", Value: "secret"})
+		w := httptest.NewRecorder()
+		m.Wrap(echo).ServeHTTP(w, r)
+
+		if w.Body.String() != `{"title":"Dune"}` {
+			t.Fatalf("primary got %q", w.Body)
+		}
+		got := receive(t, received)
+		if got.body != `{"title":"Dune"}` || got.header.Get(MirrorHeader) != "true" {
+			t.Fatalf("shadow got %q %v", got.body, got.header)
+		}
+		if credentials := got.header.Get("Authorization") != "" || got.header.Get("Cookie") != ""; credentials != keep {
+			t.Fatalf("keep credentials %v, shadow got %v", keep, got.header)
+		}
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	shadow, received := shadowUpstream(t, nil)
+	m, err := newMirror("books", config.Mirror{Destination: shadow.URL, MaxBodyBytes: 4}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	m.Wrap(echo).ServeHTTP(w, httptest.NewRequest("POST", "/books", strings.NewReader("too large")))
+
+	if w.Body.String() != "too large" {
+		t.Fatalf("primary got %q", w.Body)
+	}
+	select {
+	case <-received:
+		t.Fatal("large body mirrored")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if status := m.Status(); status.Skipped != 1 {
+		t.Fatalf("status %+v", status)
+	}
+}
+
+func TestMirrorDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	shadow, received := shadowUpstream(t, release)
+	m, err := newMirror("books", config.Mirror{Destination: shadow.URL, MaxInFlight: 1}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m.Wrap(echo)
+
+	// The shadow hangs, the client is answered anyway.
+	answered := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/books/1", nil))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/books/2", nil))
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Fatal("primary waited for the shadow")
+	}
+
+	// The second request found the only slot taken.
+	close(release)
+	receive(t, received)
+	if status := m.Status(); status.Skipped != 1 {
+		t.Fatalf("status %+v", status)
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	m, err := newMirror("books", config.Mirror{Destination: "http://shadow", Percentage: 25}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		if m.sampled(httptest.NewRequest("GET", "/books", nil)) {
+			sampled++
+		}
+	}
+	if share := float64(sampled) / 4000; share < 0.22 || share > 0.28 {
+		t.Fatalf("sampled share = %.3f, want about 0.25", share)
+	}
+
+	// Streams are never mirrored.
+	r := httptest.NewRequest("GET", "/books", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	if m.sampled(r) {
+		t.Fatal("stream sampled")
+	}
+}
+
+func TestMirrorUpstreamTLS(t *testing.T) {
+	var mirrored atomic.Int64
+	shadow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored.Add(1)
+	}))
+	t.Cleanup(shadow.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: shadow.Certificate().Raw})
+	if err := os.WriteFile(ca, pemBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := resourceTo("books", "/books/*", backend(t, "primary").URL)
+	resource.Mirror = config.Mirror{Destination: shadow.URL}
+	resource.Transport.TLS = config.UpstreamTLS{CA: ca}
+	rv, err := NewReverseProxy(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get(t, rv, "/books/1"); code != http.StatusOK || body != "primary" {
+		t.Fatalf("primary answered %d %q", code, body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rv.mirror.Status().Mirrored == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := rv.mirror.Status(); status.Mirrored != 1 || status.Errors != 0 || mirrored.Load() != 1 {
+		t.Fatalf("mirror to a private CA upstream: %+v", status)
+	}
+}
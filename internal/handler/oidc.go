@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
+	"github.com/swavan.io/gateway/pkg/authentication/user"
+	"github.com/swavan.io/gateway/pkg/identity"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcFlowCookie = "oidc_flow"
+	// oidcFlowTTL bounds the time a user has at the provider.
+	oidcFlowTTL = 10 * time.Minute
+)
+
+var (
+	errInvalidFlow = errors.New("invalid or expired login")
+	// errUnverifiedEmail keeps providers from creating users for addresses
+	// nobody proved to own.
+	errUnverifiedEmail = errors.New("the identity provider didn't verify the email address")
+	// errAccountExists is returned instead of signing somebody into an
+	// existing account the identity isn't linked to.
+	errAccountExists   = errors.New("an account with this name exists, sign in and link the identity provider to it")
+	errLinkedElsewhere = errors.New("the identity is linked to another account")
+)
+
+// oidcFlow is what the callback needs of the login that sent the user to
+// the provider. It travels in a signed cookie, so any instance can finish
+// the login.
+type oidcFlow struct {
+	Provider  string `json:"provider"`
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"expires_at"`
+	// Link names the signed in user the identity gets linked to, it is
+	// empty for logins.
+	Link string `json:"link,omitempty"`
+}
+
+func (a *Auth) signFlow(flow *oidcFlow) (string, error) {
+	payload, err := json.Marshal(flow)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + a.flowSignature(encoded), nil
+}
+
+func (a *Auth) readFlow(r *http.Request, provider string) (*oidcFlow, error) {
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		return nil, errInvalidFlow
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.flowSignature(encoded))) {
+		return nil, errInvalidFlow
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidFlow
+	}
+	flow := new(oidcFlow)
+	if err := json.Unmarshal(payload, flow); err != nil {
+		return nil, errInvalidFlow
+	}
+	if flow.Provider != provider || time.Now().Unix() > flow.ExpiresAt {
+		return nil, errInvalidFlow
+	}
+	return flow, nil
+}
+
+func (a *Auth) flowSignature(encoded string) string {
+	mac := hmac.New(sha256.New, []byte(a.oidcKey.PrivateKey))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func flowPath(provider string) string {
+	return "/auth/oidc/" + provider + "/"
+}
+
+// OIDCLogin sends the user to the provider of the path with an
+// authorization code request protected by PKCE.
+func (a *Auth) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	a.startFlow(w, r, "")
+}
+
+// OIDCLink sends the signed in user to the provider of the path, the
+// identity they sign in with there is linked to their account.
+func (a *Auth) OIDCLink(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims)
+	a.startFlow(w, r, claims.Username)
+}
+
+func (a *Auth) startFlow(w http.ResponseWriter, r *http.Request, link string) {
+	provider := r.PathValue("id")
+	client, ok := a.api.OIDC()[provider]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+	flow := &oidcFlow{
+		Provider:  provider,
+		State:     oauth2.GenerateVerifier(),
+		Nonce:     oauth2.GenerateVerifier(),
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(oidcFlowTTL).Unix(),
+		Link:      link,
+	}
+	value, err := a.signFlow(flow)
+	if err != nil {
+		log.Printf("starting login with %s failed: %v", provider, err)
+		writeError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+	cookie := a.cookie(oidcFlowCookie, value, flowPath(provider), oidcFlowTTL)
+	// Strict cookies don't come along on the redirect back from the
+	// provider.
+	if cookie.SameSite == http.SameSiteStrictMode {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, client.AuthConfig.AuthCodeURL(
+		flow.State,
+		oidc.Nonce(flow.Nonce),
+		oauth2.S256ChallengeOption(flow.Verifier),
+	), http.StatusFound)
+}
+
+// OIDCCallback finishes a login started by OIDCLogin, or a link started by
+// OIDCLink. Users are found by the issuer and subject of the ID token. The
+// ones the gateway doesn't know yet are created from a verified email
+// address, existing accounts are only signed into once linked.
+func (a *Auth) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider := r.PathValue("id")
+	client, ok := a.api.OIDC()[provider]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+	flow, err := a.readFlow(r, provider)
+	// The flow is good for one callback.
+	http.SetCookie(w, a.cookie(oidcFlowCookie, "", flowPath(provider), -time.Second))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		writeError(w, http.StatusBadRequest, errInvalidFlow.Error())
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		writeError(w, http.StatusUnauthorized, "login denied by provider: "+reason)
+		return
+	}
+
+	token, err := client.AuthConfig.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		log.Printf("exchanging code with %s failed: %v", provider, err)
+		writeError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		log.Printf("login with %s failed: no id_token in response", provider)
+		writeError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	idToken, err := client.Verifier.Verify(r.Context(), rawIDToken)
+	if err == nil && subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(flow.Nonce)) != 1 {
+		err = errors.New("nonce mismatch")
+	}
+	var idClaims authentication.IDTokenClaims
+	if err == nil {
+		err = idToken.Claims(&idClaims)
+	}
+	if err != nil {
+		log.Printf("verifying id token of %s failed: %v", provider, err)
+		writeError(w, http.StatusUnauthorized, "login failed")
+		return
+	}
+	if flow.Link != "" {
+		a.link(w, r, flow.Link, idToken)
+		return
+	}
+	identified := authentication.FromIDClaims(idClaims)
+	if identified.Username == "" {
+		writeError(w, http.StatusUnauthorized, "id token names no user")
+		return
+	}
+
+	usr, err := a.provision(r, idToken, identified)
+	switch {
+	case errors.Is(err, errUnverifiedEmail):
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	case errors.Is(err, errAccountExists):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("provisioning %s from %s failed: %v", identified.Username, provider, err)
+		writeError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+	claims, err := a.userClaims(r.Context(), usr)
+	if err != nil {
+		log.Printf("login of %s failed: %v", usr.Username, err)
+		writeError(w, http.StatusInternalServerError, "login failed")
+		return
+	}
+	a.login(w, r, claims, session.MethodOIDC)
+}
+
+// provision finds the user linked to the ID token, creating it on the first
+// login. Accounts which exist already are never taken over.
+func (a *Auth) provision(r *http.Request, idToken *oidc.IDToken, identified *authentication.Claims) (*user.User, error) {
+	usr, err := a.api.User().FindBySubject(r.Context(), idToken.Issuer, idToken.Subject)
+	if err != nil || usr.Username != "" {
+		return usr, err
+	}
+	if identified.Email == "" || !identified.EmailVerified {
+		return nil, errUnverifiedEmail
+	}
+	existing, err := a.api.User().FindByUsername(r.Context(), identified.Username)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Username != "" {
+		return nil, errAccountExists
+	}
+
+	created := user.NewUser().
+		SetUsername(identified.Username).
+		SetPreferredUsername(identified.PreferredUsername).
+		SetName(identified.Name).
+		SetGivenName(identified.GivenName).
+		SetFamilyName(identified.FamilyName).
+		SetEmail(identified.Email).
+		SetEmailVerified(identified.EmailVerified)
+	if err := a.api.User().Save(r.Context(), created); err != nil {
+		return nil, err
+	}
+	if err := a.api.User().Link(r.Context(), identified.Username, idToken.Issuer, idToken.Subject); err != nil {
+		return nil, err
+	}
+	log.Printf("user %s provisioned from %s", identified.Username, idToken.Issuer)
+	return a.api.User().FindByUsername(r.Context(), identified.Username)
+}
+
+// link ties the identity of idToken to the account of username.
+func (a *Auth) link(w http.ResponseWriter, r *http.Request, username string, idToken *oidc.IDToken) {
+	linked, err := a.api.User().FindBySubject(r.Context(), idToken.Issuer, idToken.Subject)
+	if err == nil && linked.Username != "" && linked.Username != username {
+		writeError(w, http.StatusConflict, errLinkedElsewhere.Error())
+		return
+	}
+	var usr *user.User
+	if err == nil {
+		usr, err = a.api.User().FindByUsername(r.Context(), username)
+	}
+	if err == nil && usr.Username == "" {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err == nil {
+		err = a.api.User().Link(r.Context(), username, idToken.Issuer, idToken.Subject)
+	}
+	if err != nil {
+		log.Printf("linking %s to %s failed: %v", username, idToken.Issuer, err)
+		writeError(w, http.StatusInternalServerError, "linking failed")
+		return
+	}
+	log.Printf("user %s linked to %s", username, idToken.Issuer)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,383 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	authoidc "github.com/swavan.io/gateway/pkg/authentication/oidc"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
+	"golang.org/x/oauth2"
+)
+
+// fakeProvider hands out authorization codes bound to the PKCE challenge and
+// nonce of the request and signs the ID tokens exchanged for them.
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]grant
+}
+
+type grant struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{t: t, key: key, codes: map[string]grant{}}
+	p.server = httptest.NewServer(http.HandlerFunc(p.token))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeProvider) client() *authoidc.OauthClient {
+	return &authoidc.OauthClient{
+		ID: "test",
+		AuthConfig: oauth2.Config{
+			ClientID:     "gateway",
+			ClientSecret: "secret",
+			Endpoint:     oauth2.Endpoint{AuthURL: p.server.URL + "/authorize", TokenURL: p.server.URL + "/token"},
+			RedirectURL:  "https://gateway.test/auth/oidc/test/callback",
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		Verifier: oidc.NewVerifier(p.server.URL, &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&p.key.PublicKey}}, &oidc.Config{ClientID: "gateway"}),
+	}
+}
+
+// authorize signs in at the provider, following the redirect of the
+// gateway. claims go into the ID token next to the registered ones.
+func (p *fakeProvider) authorize(location string, claims map[string]any) (state, code string) {
+	p.t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		p.t.Fatalf("authorization request without PKCE: %s", location)
+	}
+	token := map[string]any{
+		"iss":   p.server.URL,
+		"aud":   "gateway",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		token[k] = v
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code = base64.RawURLEncoding.EncodeToString([]byte(query.Get("state")))
+	p.codes[code] = grant{challenge: query.Get("code_challenge"), claims: token}
+	return query.Get("state"), code
+}
+
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": "provider-token",
+		"token_type":   "Bearer",
+		"id_token":     p.sign(g.claims),
+	})
+}
+
+func (p *fakeProvider) sign(claims map[string]any) string {
+	p.t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func oidcMux(a *Auth) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /auth/oidc/{id}/login", a.OIDCLogin)
+	mux.HandleFunc("GET /auth/oidc/{id}/callback", a.OIDCCallback)
+	mux.HandleFunc("GET /auth/oidc/{id}/link", a.Guard(a.OIDCLink))
+	return mux
+}
+
+func testOIDC(t *testing.T) (*Auth, *memoryAPI, *fakeProvider) {
+	t.Helper()
+	a, api := testAuth(t)
+	provider := newFakeProvider(t)
+	api.clients = authoidc.OauthClients{"test": provider.client()}
+	return a, api, provider
+}
+
+// startOIDC follows /login, or /link with access, to the provider.
+func startOIDC(t *testing.T, a *Auth, access string) (location string, flow *http.Cookie) {
+	t.Helper()
+	target := "/auth/oidc/test/login"
+	if access != "" {
+		target = "/auth/oidc/test/link"
+	}
+	r := httptest.NewRequest("GET", target, nil)
+	if access != "" {
+		r.Header.Set("Authorization", "Bearer "+access)
+	}
+	w := httptest.NewRecorder()
+	oidcMux(a).ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("%s answered %d: %s", target, w.Code, w.Body)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcFlowCookie {
+			flow = c
+		}
+	}
+	if flow == nil {
+		t.Fatal("no flow cookie")
+	}
+	return w.Header().Get("Location"), flow
+}
+
+func callback(a *Auth, flow *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/auth/oidc/test/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if flow != nil {
+		r.AddCookie(flow)
+	}
+	w := httptest.NewRecorder()
+	oidcMux(a).ServeHTTP(w, r)
+	return w
+}
+
+// oidcLogin signs in at the provider with claims and returns the answer of
+// the callback.
+func oidcLogin(t *testing.T, a *Auth, provider *fakeProvider, claims map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	location, flow := startOIDC(t, a, "")
+	state, code := provider.authorize(location, claims)
+	return callback(a, flow, state, code)
+}
+
+func identityOf(subject, username, email string, verified bool) map[string]any {
+	return map[string]any{"sub": subject, "preferred_username": username, "email": email, "email_verified": verified}
+}
+
+func TestOIDCLoginRedirect(t *testing.T) {
+	a, _, _ := testOIDC(t)
+	a.tokens.Cookie.SameSite = "strict"
+	location, flow := startOIDC(t, a, "")
+
+	u, _ := url.Parse(location)
+	query := u.Query()
+	if query.Get("client_id") != "gateway" || query.Get("state") == "" || query.Get("nonce") == "" || !strings.Contains(query.Get("scope"), "openid") {
+		t.Fatalf("redirected to %s", location)
+	}
+	if flow.Path != "/auth/oidc/test/" || !flow.HttpOnly || flow.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("flow cookie %+v", flow)
+	}
+	// Nothing the provider needs to be kept secret travels in the URL.
+	if strings.Contains(location, "verifier") {
+		t.Fatalf("verifier sent to the provider: %s", location)
+	}
+
+	w := httptest.NewRecorder()
+	oidcMux(a).ServeHTTP(w, httptest.NewRequest("GET", "/auth/oidc/unknown/login", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown provider answered %d", w.Code)
+	}
+}
+
+func TestOIDCProvisionsVerifiedUser(t *testing.T) {
+	a, api, provider := testOIDC(t)
+
+	w := oidcLogin(t, a, provider, identityOf("sub-1", "dana", "dana@example.com", true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first login answered %d: %s", w.Code, w.Body)
+	}
+	var tokens TokenResponse
+	json.NewDecoder(w.Body).Decode(&tokens)
+	claims, _, err := authentication.ParseAsymmetricToken(tokens.AccessToken, a.key.PublicKey)
+	if err != nil || claims.Username != "dana@example.com" {
+		t.Fatalf("claims %+v, %v", claims, err)
+	}
+	usr, _ := api.users.FindByUsername(context.Background(), "dana@example.com")
+	if usr.Issuer != provider.server.URL || usr.Subject != "sub-1" || usr.Email != "dana@example.com" {
+		t.Fatalf("provisioned %+v", usr)
+	}
+	sess, _ := api.sessions.Find(context.Background(), claims.Session)
+	if sess == nil || sess.Method != session.MethodOIDC {
+		t.Fatalf("session %+v", sess)
+	}
+
+	// The subject decides, not the address the provider goes by now.
+	w = oidcLogin(t, a, provider, identityOf("sub-1", "dana", "dana@example.org", true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("second login answered %d: %s", w.Code, w.Body)
+	}
+	json.NewDecoder(w.Body).Decode(&tokens)
+	claims, _, _ = authentication.ParseAsymmetricToken(tokens.AccessToken, a.key.PublicKey)
+	if claims.Username != "dana@example.com" {
+		t.Fatalf("signed in as %s", claims.Username)
+	}
+	if renamed, _ := api.users.FindByUsername(context.Background(), "dana@example.org"); renamed.Username != "" {
+		t.Fatal("second user created")
+	}
+}
+
+func TestOIDCRejectsUnverifiedEmail(t *testing.T) {
+	a, api, provider := testOIDC(t)
+
+	for _, claims := range []map[string]any{
+		identityOf("sub-1", "", "eve@example.com", false),
+		identityOf("sub-1", "eve", "", false),
+	} {
+		if w := oidcLogin(t, a, provider, claims); w.Code != http.StatusForbidden {
+			t.Fatalf("unverified identity answered %d: %s", w.Code, w.Body)
+		}
+	}
+	if len(api.users.users) != 0 {
+		t.Fatalf("users created: %v", api.users.users)
+	}
+}
+
+func TestOIDCDoesNotTakeOverAccounts(t *testing.T) {
+	a, api, provider := testOIDC(t)
+	testUser(t, api, "admin@example.com", "correct horse")
+	stored := api.users.password("admin@example.com")
+
+	for _, claims := range []map[string]any{
+		identityOf("sub-1", "admin", "admin@example.com", true),
+		{"sub": "sub-2", "username": "admin@example.com", "email": "admin@example.com", "email_verified": true},
+	} {
+		if w := oidcLogin(t, a, provider, claims); w.Code != http.StatusConflict {
+			t.Fatalf("login as existing account answered %d: %s", w.Code, w.Body)
+		}
+	}
+	usr, _ := api.users.FindByUsername(context.Background(), "admin@example.com")
+	if usr.Subject != "" || api.users.password("admin@example.com") != stored {
+		t.Fatalf("account changed: %+v", usr)
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	a, api, provider := testOIDC(t)
+	testUser(t, api, "alice", "correct horse")
+	_, tokens := login(t, a, "alice", "correct horse")
+
+	location, flow := startOIDC(t, a, tokens.AccessToken)
+	state, code := provider.authorize(location, identityOf("sub-1", "alice.work", "alice@work.example", false))
+	if w := callback(a, flow, state, code); w.Code != http.StatusNoContent {
+		t.Fatalf("link answered %d: %s", w.Code, w.Body)
+	}
+
+	// The linked identity signs into the account, verified email or not.
+	w := oidcLogin(t, a, provider, identityOf("sub-1", "alice.work", "alice@work.example", false))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login answered %d: %s", w.Code, w.Body)
+	}
+	json.NewDecoder(w.Body).Decode(&tokens)
+	claims, _, _ := authentication.ParseAsymmetricToken(tokens.AccessToken, a.key.PublicKey)
+	if claims.Username != "alice" {
+		t.Fatalf("signed in as %s", claims.Username)
+	}
+
+	// An identity can't be linked to a second account.
+	testUser(t, api, "bob", "battery staple")
+	_, bob := login(t, a, "bob", "battery staple")
+	location, flow = startOIDC(t, a, bob.AccessToken)
+	state, code = provider.authorize(location, identityOf("sub-1", "alice.work", "alice@work.example", true))
+	if w := callback(a, flow, state, code); w.Code != http.StatusConflict {
+		t.Fatalf("linking a linked identity answered %d", w.Code)
+	}
+
+	// Linking needs a signed in user.
+	r := httptest.NewRequest("GET", "/auth/oidc/test/link", nil)
+	w = httptest.NewRecorder()
+	oidcMux(a).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("anonymous link answered %d", w.Code)
+	}
+}
+
+func TestOIDCCallbackRejected(t *testing.T) {
+	a, api, provider := testOIDC(t)
+	claims := identityOf("sub-1", "dana", "dana@example.com", true)
+
+	location, flow := startOIDC(t, a, "")
+	state, code := provider.authorize(location, claims)
+	if w := callback(a, flow, "forged", code); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong state answered %d", w.Code)
+	}
+	if w := callback(a, nil, state, code); w.Code != http.StatusBadRequest {
+		t.Errorf("missing flow answered %d", w.Code)
+	}
+	tampered := *flow
+	tampered.Value = "x" + flow.Value
+	if w := callback(a, &tampered, state, code); w.Code != http.StatusBadRequest {
+		t.Errorf("tampered flow answered %d", w.Code)
+	}
+	if w := callback(a, flow, state, "unknown"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown code answered %d", w.Code)
+	}
+
+	// The code of one login can't finish another, the verifiers differ.
+	first, firstFlow := startOIDC(t, a, "")
+	second, _ := startOIDC(t, a, "")
+	firstState, _ := provider.authorize(first, claims)
+	_, secondCode := provider.authorize(second, claims)
+	if w := callback(a, firstFlow, firstState, secondCode); w.Code != http.StatusUnauthorized {
+		t.Errorf("code of another login answered %d", w.Code)
+	}
+
+	// ID tokens minted for another login carry another nonce.
+	location, flow = startOIDC(t, a, "")
+	replayed := identityOf("sub-1", "dana", "dana@example.com", true)
+	replayed["nonce"] = "replayed"
+	state, code = provider.authorize(location, replayed)
+	if w := callback(a, flow, state, code); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong nonce answered %d", w.Code)
+	}
+
+	// Flows expire.
+	expired, _ := a.signFlow(&oidcFlow{Provider: "test", State: "s", ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	if w := callback(a, &http.Cookie{Name: oidcFlowCookie, Value: expired}, "s", "c"); w.Code != http.StatusBadRequest {
+		t.Errorf("expired flow answered %d", w.Code)
+	}
+
+	if len(api.users.users) != 0 {
+		t.Fatalf("users created: %v", api.users.users)
+	}
+}
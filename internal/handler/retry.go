@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// IdempotencyKeyHeader marks a non idempotent request as safe to replay.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+type sendFunc func(req *http.Request, tried []*upstream) (*http.Response, *upstream, error)
+
+type retryPolicy struct {
+	cfg config.Retry
+}
+
+func newRetryPolicy(cfg config.Retry) *retryPolicy {
+	if cfg.Attempts <= 1 {
+		return nil
+	}
+	return &retryPolicy{cfg: cfg.SetDefaultIfEmpty()}
+}
+
+// eligible reports whether the request may be sent more than once.
+func (p *retryPolicy) eligible(req *http.Request) bool {
+	return slices.Contains(p.cfg.Methods, req.Method) ||
+		req.Header.Get(IdempotencyKeyHeader) != ""
+}
+
+// buffer reads the request body into memory so it can be replayed. Bodies
+// larger than the configured limit are left untouched and not retried.
+func (p *retryPolicy) buffer(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, p.cfg.MaxBodyBytes+1))
+	if err != nil || int64(len(body)) > p.cfg.MaxBodyBytes {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return false
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true
+}
+
+func (p *retryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return p.cfg.ConnectionErrors
+	}
+	return slices.Contains(p.cfg.StatusCodes, resp.StatusCode)
+}
+
+// backoff returns the exponential backoff with full jitter for the attempt.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.cfg.Backoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > p.cfg.MaxBackoff {
+		ceiling = p.cfg.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (p *retryPolicy) Do(req *http.Request, send sendFunc) (*http.Response, error) {
+	if !p.eligible(req) || !p.buffer(req) {
+		resp, _, err := send(req, nil)
+		return resp, err
+	}
+
+	ctx := req.Context()
+	original := req.Clone(ctx)
+	tried := []*upstream{}
+	for attempt := 1; ; attempt++ {
+		outreq := original.Clone(ctx)
+		if original.GetBody != nil {
+			outreq.Body, _ = original.GetBody()
+		}
+		resp, u, err := send(outreq, tried)
+		if attempt >= p.cfg.Attempts || ctx.Err() != nil || !p.retryable(resp, err) {
+			return resp, err
+		}
+		if u != nil {
+			tried = append(tried, u)
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
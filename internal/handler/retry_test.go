@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// replies answers with the given statuses in turn, a zero status is a
+// connection error.
+func replies(t *testing.T, statuses ...int) (sendFunc, *[]string) {
+	t.Helper()
+	bodies := []string{}
+	upstreams := weightedUpstreams(t, 1, 1, 1, 1)
+	send := func(req *http.Request, tried []*upstream) (*http.Response, *upstream, error) {
+		n := len(bodies)
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		if len(tried) != n {
+			t.Errorf("attempt %d excluded %d upstreams", n+1, len(tried))
+		}
+		if statuses[n] == 0 {
+			return nil, upstreams[n], errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: statuses[n], Body: http.NoBody}, upstreams[n], nil
+	}
+	return send, &bodies
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	if p := newRetryPolicy(config.Retry{Attempts: 1}); p != nil {
+		t.Fatal("single attempt built a policy")
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	p := newRetryPolicy(config.Retry{Attempts: 3, Backoff: time.Millisecond})
+	send, bodies := replies(t, 503, 0, 200)
+
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("payload"))
+	resp, err := p.Do(req, send)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Do = %v, %v", resp, err)
+	}
+	if got := strings.Join(*bodies, ","); got != "payload,payload,payload" {
+		t.Fatalf("bodies = %s", got)
+	}
+}
+
+func TestRetryStopsAtAttempts(t *testing.T) {
+	p := newRetryPolicy(config.Retry{Attempts: 2, Backoff: time.Millisecond})
+	send, bodies := replies(t, 502, 502, 200)
+
+	resp, _ := p.Do(httptest.NewRequest(http.MethodGet, "/", nil), send)
+	if resp.StatusCode != http.StatusBadGateway || len(*bodies) != 2 {
+		t.Fatalf("status %d after %d attempts", resp.StatusCode, len(*bodies))
+	}
+}
+
+func TestRetryEligibility(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		key      string
+		attempts int
+	}{
+		{"idempotent method", http.MethodGet, "", 2},
+		{"post", http.MethodPost, "", 1},
+		{"post with idempotency key", http.MethodPost, "k1", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newRetryPolicy(config.Retry{Attempts: 2, Backoff: time.Millisecond})
+			send, bodies := replies(t, 503, 200)
+			req := httptest.NewRequest(tc.method, "/", nil)
+			if tc.key != "" {
+				req.Header.Set(IdempotencyKeyHeader, tc.key)
+			}
+			p.Do(req, send)
+			if len(*bodies) != tc.attempts {
+				t.Fatalf("attempts = %d, want %d", len(*bodies), tc.attempts)
+			}
+		})
+	}
+}
+
+func TestRetrySkipsLargeBodies(t *testing.T) {
+	p := newRetryPolicy(config.Retry{Attempts: 3, Backoff: time.Millisecond, MaxBodyBytes: 4})
+	send, bodies := replies(t, 503, 200)
+
+	p.Do(httptest.NewRequest(http.MethodPut, "/", strings.NewReader("too long")), send)
+	if len(*bodies) != 1 || (*bodies)[0] != "too long" {
+		t.Fatalf("bodies = %q", *bodies)
+	}
+}
+
+func TestRetryOnlyConfiguredFailures(t *testing.T) {
+	p := newRetryPolicy(config.Retry{Attempts: 3, Backoff: time.Millisecond, StatusCodes: []int{503}})
+	send, bodies := replies(t, 0, 200)
+
+	if _, err := p.Do(httptest.NewRequest(http.MethodGet, "/", nil), send); err == nil || len(*bodies) != 1 {
+		t.Fatalf("connection error retried without connection_errors, %d attempts", len(*bodies))
+	}
+}
+
+func TestRetryBackoffJitter(t *testing.T) {
+	p := newRetryPolicy(config.Retry{Attempts: 10, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	for _, tc := range []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{60, 50 * time.Millisecond},
+	} {
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(tc.attempt); got < 0 || got > tc.ceiling {
+				t.Fatalf("backoff(%d) = %s, want within [0, %s]", tc.attempt, got, tc.ceiling)
+			}
+		}
+	}
+}
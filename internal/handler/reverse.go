@@ -1,37 +1,321 @@
 package handler
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
 )
 
+// UpstreamHeader tells the client which upstream served the request.
+const UpstreamHeader = "X-Gateway-Upstream"
+
+var errNoUpstream = errors.New("no upstream available")
+
 type reverseProxy struct {
-	proxy    *httputil.ReverseProxy
-	url      *url.URL
-	endpoint string
+	name      string
+	proxy     *httputil.ReverseProxy
+	handler   http.Handler
+	breaker   *circuitBreaker
+	mirror    *mirror
+	streams   *streamLimiter
+	certs     *certificates
+	retry     *retryPolicy
+	transport http.RoundTripper
+	tls       *tls.Config
+	upstreams []*upstream
+	groups    []*upstreamGroup
+	splitter  *splitter
+	health    config.HealthCheck
+	timeout   time.Duration
+	rewriter  *rewriter
 }
 
-func NewReverseProxy(url *url.URL, endpoint string) *reverseProxy {
-	fmt.Println("reading reverse proxy")
-	rv := reverseProxy{
-		proxy:    httputil.NewSingleHostReverseProxy(url),
-		url:      url,
-		endpoint: endpoint,
+func NewReverseProxy(resource config.Resource) (*reverseProxy, error) {
+	groups := []*upstreamGroup{}
+	upstreams := []*upstream{}
+	for _, cfg := range resource.UpstreamGroups() {
+		if len(cfg.Destinations) == 0 {
+			return nil, errors.New("resource " + resource.Name + " has no destination")
+		}
+		g, err := newUpstreamGroup(cfg)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+		upstreams = append(upstreams, g.upstreams...)
+	}
+
+	split, err := newSplitter(resource, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := newRewriter(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, certs, err := newUpstreamTLS(resource.Transport.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: %w", resource.Name, err)
+	}
+	if resource.Transport.TLS.InsecureSkipVerify {
+		log.Printf("proxy %s: upstream certificates are not verified", resource.Name)
+	}
+
+	var transport http.RoundTripper
+	switch resource.Protocol {
+	case "", ProtocolHTTP:
+		transport = newTransport(resource.Transport, tlsConfig)
+	case ProtocolHTTP2, ProtocolGRPC, ProtocolGRPCJSON:
+		transport = newH2Transport(resource.Transport, tlsConfig)
+	default:
+		return nil, fmt.Errorf("resource %s: unknown protocol %q", resource.Name, resource.Protocol)
+	}
+
+	rv := &reverseProxy{
+		name:      resource.Name,
+		transport: transport,
+		tls:       tlsConfig,
+		certs:     certs,
+		timeout:   resource.Transport.RequestTimeout,
+		upstreams: upstreams,
+		groups:    groups,
+		splitter:  split,
+		retry:     newRetryPolicy(resource.Retry),
+		health:    resource.HealthCheck,
+		rewriter:  rw,
+	}
+	rv.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport:    rv,
+		ErrorHandler: rv.handleError,
+	}
+	if resource.Protocol == ProtocolGRPC {
+		// Streaming calls need every message flushed right away.
+		rv.proxy.FlushInterval = -1
+	}
+
+	rv.handler = rv.proxy
+	if resource.Protocol == ProtocolGRPCJSON {
+		rv.handler, err = newTranscoder(resource, rv, rv.handleError)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resource.CircuitBreaker.Enabled {
+		rv.breaker = newCircuitBreaker(resource.Name, resource.CircuitBreaker)
+		rv.handler = rv.breaker.Wrap(rv.handler)
+	}
+	if resource.Mirror.Destination != "" {
+		rv.mirror, err = newMirror(resource.Name, resource.Mirror, transport)
+		if err != nil {
+			return nil, err
+		}
+		rv.handler = rv.mirror.Wrap(rv.handler)
 	}
-	return &rv
+	if !resource.Transform.IsEmpty() {
+		t, err := newTransformer(resource)
+		if err != nil {
+			return nil, err
+		}
+		rv.handler = t.Wrap(rv.handler)
+	}
+	rv.streams = newStreamLimiter(resource.Name, resource.Stream)
+	rv.handler = rv.streams.Wrap(rv.handler)
+	return rv, nil
 }
 
 func (rv *reverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	req.URL.Host = rv.url.Host
-	req.URL.Scheme = rv.url.Scheme
-	req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
-	req.Host = rv.url.Host
+	req.Header.Set("X-Forwarded-Host", req.Host)
+	rv.rewriter.Rewrite(req.URL)
+
+	ctx := req.Context()
+	variant := rv.splitter.Assign(w, req)
+	ctx = withVariant(ctx, variant)
+	req.Header.Set(VariantHeader, variant.name)
+	if len(rv.groups) > 1 {
+		log.Printf("proxy %s: %s %s assigned to variant %s", rv.name, req.Method, req.URL.Path, variant.name)
+	}
+
+	// Streams are bound by their idle timeout instead.
+	if rv.timeout > 0 && !isStream(req) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rv.timeout)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+
+	rv.handler.ServeHTTP(w, req)
+}
+
+func (rv *reverseProxy) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	log.Printf("proxy %s: %s %s: %v", rv.name, req.Method, req.URL.Path, err)
+	if message, ok := bodyTooLarge(err); ok {
+		writeRequestError(w, req, http.StatusRequestEntityTooLarge, message)
+		return
+	}
+	switch {
+	case errors.Is(err, errNoUpstream):
+		writeRequestError(w, req, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		writeRequestError(w, req, http.StatusGatewayTimeout, "upstream timed out")
+	default:
+		writeRequestError(w, req, http.StatusBadGateway, "upstream unavailable")
+	}
+}
+
+// Start runs the active health checks of the upstreams and watches the
+// upstream certificates until ctx is done.
+func (rv *reverseProxy) Start(ctx context.Context) {
+	if rv.certs != nil {
+		go rv.certs.Watch(ctx)
+	}
+	if !rv.health.Enabled() {
+		return
+	}
+	go newHealthChecker(rv.health, rv.upstreams, rv.transport, rv.tls).Run(ctx)
+}
+
+// Close releases the idle upstream connections once the proxy was replaced.
+func (rv *reverseProxy) Close() {
+	if t, ok := rv.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+func (rv *reverseProxy) Status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(rv.upstreams))
+	for _, u := range rv.upstreams {
+		status = append(status, u.Status())
+	}
+	return status
+}
+
+// RoundTrip forwards the outgoing request, retrying it when the resource has
+// a retry policy.
+func (rv *reverseProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rv.retry == nil {
+		resp, _, err := rv.send(req, nil)
+		return resp, err
+	}
+	return rv.retry.Do(req, rv.send)
+}
+
+// send picks an upstream, preferring ones that weren't tried yet, and
+// forwards the request to it.
+func (rv *reverseProxy) send(req *http.Request, tried []*upstream) (*http.Response, *upstream, error) {
+	group := variantFrom(req.Context())
+	if group == nil {
+		group = rv.groups[0]
+	}
+	candidates := healthyUpstreams(group.upstreams)
+	if fresh := slices.DeleteFunc(slices.Clone(candidates), func(u *upstream) bool {
+		return slices.Contains(tried, u)
+	}); len(fresh) > 0 {
+		candidates = fresh
+	}
+	u := group.balancer.Next(req, candidates)
+	if u == nil {
+		return nil, nil, errNoUpstream
+	}
+
+	req.URL.Scheme = u.url.Scheme
+	req.URL.Host = u.url.Host
+	if u.url.Path != "" {
+		escaped := singleJoiningSlash(u.url.EscapedPath(), req.URL.EscapedPath())
+		if path, err := url.PathUnescape(escaped); err == nil {
+			req.URL.Path, req.URL.RawPath = path, escaped
+		}
+	}
+	if u.url.RawQuery != "" && req.URL.RawQuery != "" {
+		req.URL.RawQuery = u.url.RawQuery + "&" + req.URL.RawQuery
+	} else if u.url.RawQuery != "" {
+		req.URL.RawQuery = u.url.RawQuery
+	}
+	req.Host = u.url.Host
 
-	path := req.URL.Path
-	req.URL.Path = strings.TrimLeft(path, rv.endpoint)
+	u.active.Add(1)
+	resp, err := rv.transport.RoundTrip(req)
+	if err != nil {
+		u.active.Add(-1)
+		rv.observe(u, err.Error())
+		return nil, u, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		rv.observe(u, resp.Status)
+	} else {
+		rv.observe(u, "")
+	}
+	resp.Header.Set(UpstreamHeader, u.Name())
+	resp.Body = newTrackedBody(resp.Body, func() { u.active.Add(-1) })
+	return resp, u, nil
+}
+
+// observe feeds the outcome of proxied traffic into the passive health check.
+func (rv *reverseProxy) observe(u *upstream, failure string) {
+	if rv.health.PassiveFailures <= 0 {
+		return
+	}
+	if failure != "" {
+		u.fail(failure, rv.health.PassiveFailures)
+		return
+	}
+	u.succeed(1)
+}
+
+// trackedBody runs done once the response body has been fully handed over.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
 
-	rv.proxy.ServeHTTP(w, req)
+// trackedStream keeps the body writable so protocol upgrades still work.
+type trackedStream struct {
+	*trackedBody
+	io.Writer
+}
+
+func newTrackedBody(body io.ReadCloser, done func()) io.ReadCloser {
+	tb := &trackedBody{ReadCloser: body, done: done}
+	if w, ok := body.(io.ReadWriteCloser); ok {
+		return &trackedStream{tb, w}
+	}
+	return tb
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
 }
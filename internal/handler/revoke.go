@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/revocation"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// revocations caches the revocation store so Guard doesn't have to ask the
+// database on every request. Revocations made here apply right away, the
+// ones of other instances once the cache is refreshed.
+type revocations struct {
+	store revocation.RevocationAPI
+	// expiring are pruned along with the revocations, see Prune.
+	expiring []expiringStore
+
+	mu       sync.RWMutex
+	tokens   map[string]time.Time
+	sessions map[string]time.Time
+	users    map[string]time.Time
+}
+
+func newRevocations(store revocation.RevocationAPI) *revocations {
+	return &revocations{
+		store:    store,
+		tokens:   make(map[string]time.Time),
+		sessions: make(map[string]time.Time),
+		users:    make(map[string]time.Time),
+	}
+}
+
+// Revoked tells whether claims belong to a revoked token or session, or were
+// issued before all tokens of the user were revoked.
+func (rv *revocations) Revoked(claims *authentication.Claims) bool {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+	if _, ok := rv.tokens[claims.ID]; ok && claims.ID != "" {
+		return true
+	}
+	if _, ok := rv.sessions[claims.Session]; ok && claims.Session != "" {
+		return true
+	}
+	// Issue times are whole seconds, a token issued within the second of
+	// the revocation is revoked too.
+	revokedAt, ok := rv.users[claims.Username]
+	return ok && !claims.IssuedAt.After(revokedAt)
+}
+
+func (rv *revocations) Revoke(ctx context.Context, r *revocation.Revocation) error {
+	if err := rv.store.Save(ctx, r); err != nil {
+		return err
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.add(r)
+	return nil
+}
+
+func (rv *revocations) add(r *revocation.Revocation) {
+	switch r.Kind {
+	case revocation.KindToken:
+		rv.tokens[r.ID] = r.ExpiresAt
+	case revocation.KindSession:
+		rv.sessions[r.ID] = r.ExpiresAt
+	case revocation.KindUser:
+		if r.RevokedAt.After(rv.users[r.ID]) {
+			rv.users[r.ID] = r.RevokedAt
+		}
+	}
+}
+
+// expirer is a store keeping rows past their expiry until told to drop them.
+type expirer interface {
+	DeleteExpired(ctx context.Context) error
+}
+
+// expiringStore names a store for the log when pruning it fails.
+type expiringStore struct {
+	name  string
+	store expirer
+}
+
+// Prune has Run delete the expired rows of store too.
+func (rv *revocations) Prune(name string, store expirer) {
+	rv.expiring = append(rv.expiring, expiringStore{name: name, store: store})
+}
+
+// Load replaces the cache with the revocations still in effect.
+func (rv *revocations) Load(ctx context.Context) error {
+	active, err := rv.store.Active(ctx)
+	if err != nil {
+		return err
+	}
+	fresh := newRevocations(rv.store)
+	for i := range active {
+		fresh.add(&active[i])
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.tokens, rv.sessions, rv.users = fresh.tokens, fresh.sessions, fresh.users
+	return nil
+}
+
+// Run refreshes the cache until ctx is done and drops expired revocations
+// from the store, along with what expired in the stores to prune.
+func (rv *revocations) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rv.store.DeleteExpired(ctx); err != nil {
+				log.Printf("deleting expired revocations failed: %v", err)
+			}
+			for _, e := range rv.expiring {
+				if err := e.store.DeleteExpired(ctx); err != nil {
+					log.Printf("deleting expired %s failed: %v", e.name, err)
+				}
+			}
+			if err := rv.Load(ctx); err != nil {
+				log.Printf("loading revocations failed: %v", err)
+			}
+		}
+	}
+}
+
+// Logout revokes the access token of the request and ends its session.
+// Tokens without session fall back on the refresh token, when it comes
+// along.
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims)
+	if claims.ID != "" {
+		expiresAt := claims.ExpiresAt
+		if expiresAt.IsZero() {
+			expiresAt = time.Now().Add(a.tokens.AccessTTL)
+		}
+		if err := a.revocations.Revoke(r.Context(), revocation.NewTokenRevocation(claims.ID, claims.Username, expiresAt)); err != nil {
+			log.Printf("logout of %s failed: %v", claims.Username, err)
+			writeError(w, http.StatusInternalServerError, "logout failed")
+			return
+		}
+	}
+
+	if claims.Session != "" {
+		if err := a.terminate(r.Context(), claims.Session, claims.Username); err != nil {
+			log.Printf("ending session of %s failed: %v", claims.Username, err)
+		}
+	} else if token := refreshToken(r); token != "" {
+		presented, _, err := authentication.ParseAsymmetricToken(token, a.refreshKey.PublicKey)
+		if err == nil && presented.Username == claims.Username {
+			if err := a.revokeFamily(r.Context(), presented.ID); err != nil {
+				log.Printf("revoking refresh tokens of %s failed: %v", claims.Username, err)
+			}
+		}
+	}
+
+	if a.tokens.Cookie.Enabled {
+		http.SetCookie(w, a.cookie(identity.AccessToken, "", a.tokens.Cookie.Path, -time.Second))
+		http.SetCookie(w, a.cookie(identity.RefreshToken, "", "/auth/", -time.Second))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Auth) revokeFamily(ctx context.Context, id string) error {
+	stored, err := a.api.Refresh().Find(ctx, id)
+	if err != nil {
+		return err
+	}
+	return a.api.Refresh().RevokeFamily(ctx, stored.Family)
+}
+
+// RevokeToken revokes the access token with the jti of the path.
+func (a *Auth) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	jti := r.PathValue("jti")
+	// Access tokens don't outlive their TTL, neither has the revocation.
+	err := a.revocations.Revoke(r.Context(), revocation.NewTokenRevocation(jti, "", time.Now().Add(a.tokens.AccessTTL)))
+	if err != nil {
+		log.Printf("revoking token %s failed: %v", jti, err)
+		writeError(w, http.StatusInternalServerError, "revoking token failed")
+		return
+	}
+	log.Printf("token %s revoked by %s", jti, modifier(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeUser ends every session of the user of the path, the refresh tokens
+// are revoked for good and the access tokens until they expire.
+func (a *Auth) RevokeUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := a.revocations.Revoke(r.Context(), revocation.NewUserRevocation(username, a.tokens.AccessTTL))
+	if err == nil {
+		err = a.api.Refresh().RevokeUser(r.Context(), username)
+	}
+	if err == nil {
+		err = a.api.Session().EndUser(r.Context(), username)
+	}
+	if err != nil {
+		log.Printf("revoking sessions of %s failed: %v", username, err)
+		writeError(w, http.StatusInternalServerError, "revoking sessions failed")
+		return
+	}
+	log.Printf("sessions of %s revoked by %s", username, modifier(r))
+	w.WriteHeader(http.StatusNoContent)
+}
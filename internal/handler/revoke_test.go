@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/refresh"
+	"github.com/swavan.io/gateway/pkg/authentication/revocation"
+)
+
+func TestRevocationsRunPrunes(t *testing.T) {
+	a, api := testAuth(t)
+	a.revocations.Prune("refresh tokens", api.refresh)
+	ctx := context.Background()
+	api.refresh.Save(ctx, refresh.NewRefreshToken().SetID("old").SetExpiresAt(time.Now().Add(-time.Minute)))
+	api.refresh.Save(ctx, refresh.NewRefreshToken().SetID("new").SetExpiresAt(time.Now().Add(time.Hour)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		a.revocations.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := api.refresh.Find(ctx, "old"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired refresh token kept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if _, err := api.refresh.Find(context.Background(), "new"); err != nil {
+		t.Fatal("refresh token pruned before it expired")
+	}
+}
+
+func TestRevocationsRevoked(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryRevocations{}
+	rv := newRevocations(store)
+	now := time.Now().Truncate(time.Second)
+
+	rv.Revoke(ctx, revocation.NewTokenRevocation("jti-1", "alice", now.Add(time.Minute)))
+	rv.Revoke(ctx, revocation.NewSessionRevocation("session-1", "alice", time.Minute))
+	rv.Revoke(ctx, &revocation.Revocation{ID: "bob", Kind: revocation.KindUser, Username: "bob", RevokedAt: now, ExpiresAt: now.Add(time.Minute)})
+
+	for _, tc := range []struct {
+		name    string
+		claims  *authentication.Claims
+		revoked bool
+	}{
+		{"token", authentication.NewClaims().SetID("jti-1"), true},
+		{"other token", authentication.NewClaims().SetID("jti-2"), false},
+		{"session", authentication.NewClaims().SetID("jti-3").SetSession("session-1"), true},
+		{"other session", authentication.NewClaims().SetSession("session-2"), false},
+		{"user before", authentication.NewClaims().SetUsername("bob").SetIssuedAt(now.Add(-time.Minute)), true},
+		{"user same second", authentication.NewClaims().SetUsername("bob").SetIssuedAt(now), true},
+		{"user after", authentication.NewClaims().SetUsername("bob").SetIssuedAt(now.Add(time.Second)), false},
+		{"empty", authentication.NewClaims(), false},
+	} {
+		if got := rv.Revoked(tc.claims); got != tc.revoked {
+			t.Errorf("%s: revoked = %v", tc.name, got)
+		}
+	}
+
+	// Another instance only knows what is in the store.
+	other := newRevocations(store)
+	if err := other.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !other.Revoked(authentication.NewClaims().SetID("jti-1")) || !other.Revoked(authentication.NewClaims().SetSession("session-1")) {
+		t.Fatal("loaded revocations missing")
+	}
+
+	// Expired revocations drop out on the next load.
+	store.Save(ctx, revocation.NewTokenRevocation("jti-old", "", now.Add(-time.Minute)))
+	if err := other.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if other.Revoked(authentication.NewClaims().SetID("jti-old")) {
+		t.Fatal("expired revocation loaded")
+	}
+}
+
+// authenticatedCall runs h, routed by pattern, behind Guard with the access
+// token.
+func authenticatedCall(a *Auth, h http.HandlerFunc, pattern, target, access string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle(pattern, a.Guard(h))
+	method, _, _ := strings.Cut(pattern, " ")
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+access)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestLogout(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	_, tokens := login(t, a, "alice", "correct horse")
+	_, other := login(t, a, "alice", "correct horse")
+
+	if w := authenticatedCall(a, a.Logout, "POST /auth/logout", "/auth/logout", tokens.AccessToken); w.Code != http.StatusNoContent {
+		t.Fatalf("logout answered %d: %s", w.Code, w.Body)
+	}
+	if guarded(a, tokens.AccessToken) {
+		t.Fatal("access token accepted after logout")
+	}
+	if w, _ := refreshWith(t, a, tokens.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout answered %d", w.Code)
+	}
+	if !guarded(a, other.AccessToken) {
+		t.Fatal("other session logged out")
+	}
+}
+
+func TestRevokeTokenAndUser(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	testUser(t, api, "bob", "battery staple")
+	_, alice := login(t, a, "alice", "correct horse")
+	_, bob := login(t, a, "bob", "battery staple")
+
+	claims, _, _ := authentication.ParseAsymmetricToken(bob.AccessToken, a.key.PublicKey)
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /admin/tokens/{jti}", a.RevokeToken)
+	mux.HandleFunc("DELETE /admin/users/{username}/sessions", a.RevokeUser)
+
+	if w := call(mux, "DELETE", "/admin/tokens/"+claims.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking token answered %d", w.Code)
+	}
+	if guarded(a, bob.AccessToken) {
+		t.Fatal("revoked token accepted")
+	}
+	if w, _ := refreshWith(t, a, bob.RefreshToken); w.Code != http.StatusOK {
+		t.Fatalf("refresh after token revocation answered %d", w.Code)
+	}
+
+	if w := call(mux, "DELETE", "/admin/users/alice/sessions", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking user answered %d", w.Code)
+	}
+	if guarded(a, alice.AccessToken) {
+		t.Fatal("access token of revoked user accepted")
+	}
+	if w, _ := refreshWith(t, a, alice.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh of revoked user answered %d", w.Code)
+	}
+	if sessions, _ := api.sessions.FindByUser(context.Background(), "alice"); len(sessions) != 0 {
+		t.Fatalf("sessions of revoked user kept: %v", sessions)
+	}
+}
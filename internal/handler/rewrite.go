@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// rewriter maps the incoming path onto the upstream path. The steps run in
+// the order strip prefix, template, regex and add prefix, all of them on the
+// escaped path so encoded characters such as %2F survive the rewrite.
+type rewriter struct {
+	stripPrefix string
+	addPrefix   string
+	regex       *regexp.Regexp
+	replacement string
+	from        []string
+	to          string
+}
+
+func newRewriter(resource config.Resource) (*rewriter, error) {
+	cfg := resource.Rewrite
+	// gRPC method paths have to reach the upstream unchanged.
+	if cfg.IsEmpty() && resource.Protocol != ProtocolGRPC {
+		// Keep the historical behaviour of proxying everything below the
+		// endpoint without the endpoint itself.
+		cfg.StripPrefix = staticPrefix(resource.Endpoint)
+	}
+
+	rw := &rewriter{
+		stripPrefix: strings.TrimSuffix(cfg.StripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(cfg.AddPrefix, "/"),
+		replacement: cfg.Replacement,
+		to:          cfg.To,
+	}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex for %s: %w", resource.Name, err)
+		}
+		rw.regex = re
+	}
+	if cfg.From != "" {
+		if cfg.To == "" {
+			return nil, fmt.Errorf("rewrite of %s has `from` without `to`", resource.Name)
+		}
+		rw.from = splitPath(cfg.From)
+	}
+	return rw, nil
+}
+
+// staticPrefix returns the part of an endpoint pattern before any wildcard.
+func staticPrefix(endpoint string) string {
+	if i := strings.IndexAny(endpoint, "*{"); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	return strings.TrimSuffix(endpoint, "/")
+}
+
+func (rw *rewriter) Rewrite(u *url.URL) {
+	escaped := rw.rewritePath(u.EscapedPath())
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path = path
+	u.RawPath = escaped
+}
+
+func (rw *rewriter) rewritePath(path string) string {
+	if rw.stripPrefix != "" {
+		path = trimPathPrefix(path, rw.stripPrefix)
+	}
+	if rw.from != nil {
+		if params, ok := matchTemplate(rw.from, path); ok {
+			trailing := strings.HasSuffix(path, "/")
+			path = expandTemplate(rw.to, params)
+			if trailing && !strings.HasSuffix(path, "/") {
+				path += "/"
+			}
+		}
+	}
+	if rw.regex != nil {
+		path = rw.regex.ReplaceAllString(path, rw.replacement)
+	}
+	if rw.addPrefix != "" {
+		path = rw.addPrefix + path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// trimPathPrefix removes prefix when it matches whole path segments, so
+// "/alert" is stripped from "/alert/list" but not from "/alerts".
+func trimPathPrefix(path, prefix string) string {
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(rest, "/") {
+		return path
+	}
+	return rest
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// matchTemplate matches path against segments such as ["users", "{id}"],
+// a trailing "{name...}" segment captures the remaining path.
+func matchTemplate(template []string, path string) (map[string]string, bool) {
+	segments := splitPath(path)
+	params := make(map[string]string, len(template))
+	for i, t := range template {
+		if name, ok := strings.CutSuffix(strings.TrimPrefix(t, "{"), "...}"); ok && strings.HasPrefix(t, "{") {
+			if i > len(segments) {
+				return nil, false
+			}
+			rest := strings.Join(segments[i:], "/")
+			if strings.HasSuffix(path, "/") && rest != "" {
+				rest += "/"
+			}
+			params[name] = rest
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[t[1:len(t)-1]] = segments[i]
+			continue
+		}
+		if t != segments[i] {
+			return nil, false
+		}
+	}
+	if len(segments) != len(template) {
+		return nil, false
+	}
+	return params, true
+}
+
+func expandTemplate(template string, params map[string]string) string {
+	for name, value := range params {
+		template = strings.ReplaceAll(template, "{"+name+"...}", value)
+		template = strings.ReplaceAll(template, "{"+name+"}", value)
+	}
+	return template
+}
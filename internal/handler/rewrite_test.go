@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+func TestRewrite(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		protocol string
+		rewrite  config.Rewrite
+		in       string
+		path     string
+		rawPath  string
+	}{
+		{
+			name:     "default strips the endpoint",
+			endpoint: "/alert/*",
+			in:       "/alert/list",
+			path:     "/list",
+		},
+		{
+			name:     "default keeps grpc paths",
+			endpoint: "/alert.v1.Alerts/*",
+			protocol: ProtocolGRPC,
+			in:       "/alert.v1.Alerts/List",
+			path:     "/alert.v1.Alerts/List",
+		},
+		{
+			name:    "strip prefix",
+			rewrite: config.Rewrite{StripPrefix: "/api/v1"},
+			in:      "/api/v1/users/7",
+			path:    "/users/7",
+		},
+		{
+			name:    "strip prefix of the whole path",
+			rewrite: config.Rewrite{StripPrefix: "/api/"},
+			in:      "/api",
+			path:    "/",
+		},
+		{
+			name:    "strip prefix only on segment boundaries",
+			rewrite: config.Rewrite{StripPrefix: "/alert"},
+			in:      "/alerts/1",
+			path:    "/alerts/1",
+		},
+		{
+			name:    "add prefix",
+			rewrite: config.Rewrite{AddPrefix: "/internal/"},
+			in:      "/users",
+			path:    "/internal/users",
+		},
+		{
+			name:    "strip and add prefix",
+			rewrite: config.Rewrite{StripPrefix: "/v1", AddPrefix: "/v2"},
+			in:      "/v1/users",
+			path:    "/v2/users",
+		},
+		{
+			name:    "regex capture groups",
+			rewrite: config.Rewrite{Regex: `^/users/(\d+)/posts/(\d+)$`, Replacement: "/posts/$2/authors/$1"},
+			in:      "/users/7/posts/42",
+			path:    "/posts/42/authors/7",
+		},
+		{
+			name:    "regex without match",
+			rewrite: config.Rewrite{Regex: `^/users/(\d+)$`, Replacement: "/u/$1"},
+			in:      "/users/bob",
+			path:    "/users/bob",
+		},
+		{
+			name:    "template",
+			rewrite: config.Rewrite{From: "/users/{id}/orders/{order}", To: "/orders/{order}/users/{id}"},
+			in:      "/users/7/orders/42",
+			path:    "/orders/42/users/7",
+		},
+		{
+			name:    "template catch all",
+			rewrite: config.Rewrite{From: "/files/{path...}", To: "/storage/{path...}"},
+			in:      "/files/a/b/c.txt",
+			path:    "/storage/a/b/c.txt",
+		},
+		{
+			name:    "template without match",
+			rewrite: config.Rewrite{From: "/users/{id}", To: "/u/{id}"},
+			in:      "/users/7/orders",
+			path:    "/users/7/orders",
+		},
+		{
+			name:    "template keeps trailing slash",
+			rewrite: config.Rewrite{From: "/users/{id}", To: "/u/{id}"},
+			in:      "/users/7/",
+			path:    "/u/7/",
+		},
+		{
+			name:    "catch all keeps trailing slash",
+			rewrite: config.Rewrite{From: "/files/{path...}", To: "/storage/{path...}"},
+			in:      "/files/a/b/",
+			path:    "/storage/a/b/",
+		},
+		{
+			name:    "strip prefix keeps trailing slash",
+			rewrite: config.Rewrite{StripPrefix: "/api"},
+			in:      "/api/users/",
+			path:    "/users/",
+		},
+		{
+			name:    "encoded slash survives",
+			rewrite: config.Rewrite{StripPrefix: "/api"},
+			in:      "/api/files/a%2Fb",
+			path:    "/files/a/b",
+			rawPath: "/files/a%2Fb",
+		},
+		{
+			name:    "encoded slash stays one template segment",
+			rewrite: config.Rewrite{From: "/files/{name}", To: "/blobs/{name}"},
+			in:      "/files/a%2Fb",
+			path:    "/blobs/a/b",
+			rawPath: "/blobs/a%2Fb",
+		},
+		{
+			name:    "encoded space survives",
+			rewrite: config.Rewrite{AddPrefix: "/docs"},
+			in:      "/my%20file",
+			path:    "/docs/my file",
+			rawPath: "/docs/my%20file",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rw, err := newRewriter(config.Resource{Name: "test", Endpoint: tc.endpoint, Protocol: tc.protocol, Rewrite: tc.rewrite})
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rw.Rewrite(u)
+			if u.Path != tc.path {
+				t.Errorf("path = %q, want %q", u.Path, tc.path)
+			}
+			if tc.rawPath != "" && u.EscapedPath() != tc.rawPath {
+				t.Errorf("escaped path = %q, want %q", u.EscapedPath(), tc.rawPath)
+			}
+		})
+	}
+}
+
+func TestNewRewriterErrors(t *testing.T) {
+	for name, rewrite := range map[string]config.Rewrite{
+		"invalid regex":   {Regex: "("},
+		"from without to": {From: "/users/{id}"},
+	} {
+		if _, err := newRewriter(config.Resource{Name: "test", Rewrite: rewrite}); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
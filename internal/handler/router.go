@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+const (
+	prefixPath = iota
+	templatePath
+	exactPath
+)
+
+type routeEntry struct {
+	name     string
+	priority int
+	order    int
+	endpoint string
+	kind     int
+	prefix   string
+	template []string
+	match    config.Match
+	handler  http.Handler
+}
+
+func newRouteEntry(resource config.Resource, order int, h http.Handler) *routeEntry {
+	rt := &routeEntry{
+		name:     resource.Name,
+		priority: resource.Priority,
+		order:    order,
+		endpoint: resource.Endpoint,
+		match:    resource.Match,
+		handler:  h,
+	}
+	rt.match.Methods = slices.Clone(rt.match.Methods)
+	for i, m := range rt.match.Methods {
+		rt.match.Methods[i] = strings.ToUpper(m)
+	}
+	switch endpoint := resource.Endpoint; {
+	case strings.HasSuffix(endpoint, "/*") || strings.HasSuffix(endpoint, "/"):
+		rt.kind = prefixPath
+		rt.prefix = staticPrefix(endpoint)
+	case strings.Contains(endpoint, "{"):
+		rt.kind = templatePath
+		rt.prefix = staticPrefix(endpoint)
+		rt.template = splitPath(endpoint)
+	default:
+		rt.kind = exactPath
+		rt.prefix = endpoint
+	}
+	return rt
+}
+
+// predicates counts the match conditions besides the path, routes with more
+// conditions are more specific.
+func (rt *routeEntry) predicates() int {
+	n := len(rt.match.Methods) + len(rt.match.Headers) + len(rt.match.Query)
+	if len(rt.match.Hosts) > 0 {
+		n++
+	}
+	return n
+}
+
+// less orders routes by explicit priority, then by how specific they are and
+// finally by their declaration order.
+func (rt *routeEntry) less(other *routeEntry) bool {
+	switch {
+	case rt.priority != other.priority:
+		return rt.priority > other.priority
+	case rt.kind != other.kind:
+		return rt.kind > other.kind
+	case len(rt.prefix) != len(other.prefix):
+		return len(rt.prefix) > len(other.prefix)
+	case rt.predicates() != other.predicates():
+		return rt.predicates() > other.predicates()
+	}
+	return rt.order < other.order
+}
+
+func (rt *routeEntry) matchPath(path string) bool {
+	switch rt.kind {
+	case prefixPath:
+		return rt.prefix == "" || path == rt.prefix || strings.HasPrefix(path, rt.prefix+"/")
+	case templatePath:
+		_, ok := matchTemplate(rt.template, path)
+		return ok
+	}
+	return path == rt.prefix
+}
+
+func (rt *routeEntry) matchHost(r *http.Request) bool {
+	if len(rt.match.Hosts) == 0 {
+		return true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range rt.match.Hosts {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *routeEntry) matchHeaders(r *http.Request) bool {
+	for _, h := range rt.match.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(h.Name)]
+		if !ok || (h.Value != "" && !slices.Contains(values, h.Value)) {
+			return false
+		}
+	}
+	query := r.URL.Query()
+	for _, q := range rt.match.Query {
+		values, ok := query[q.Name]
+		if !ok || (q.Value != "" && !slices.Contains(values, q.Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *routeEntry) matchMethod(r *http.Request) bool {
+	return len(rt.match.Methods) == 0 || slices.Contains(rt.match.Methods, r.Method)
+}
+
+// routeTable holds the routes sorted by precedence. A table is built once
+// and never changed after it was handed to the router.
+type routeTable struct {
+	routes []*routeEntry
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{}
+}
+
+func (t *routeTable) Handle(resource config.Resource, h http.Handler) {
+	t.routes = append(t.routes, newRouteEntry(resource, len(t.routes), h))
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return t.routes[i].less(t.routes[j])
+	})
+}
+
+// Router dispatches requests to the resources by path, host, method, header
+// and query predicates.
+type Router struct {
+	table    atomic.Pointer[routeTable]
+	fallback http.Handler
+}
+
+// NewRouter returns a router that hands unmatched requests to fallback.
+func NewRouter(fallback http.Handler) *Router {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	router := &Router{fallback: fallback}
+	router.table.Store(newRouteTable())
+	return router
+}
+
+// Swap atomically replaces the routing table, requests in flight keep using
+// the table they were matched against.
+func (router *Router) Swap(table *routeTable) {
+	router.table.Store(table)
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, rt := range router.table.Load().routes {
+		if !rt.matchPath(r.URL.Path) || !rt.matchHost(r) || !rt.matchHeaders(r) {
+			continue
+		}
+		if !rt.matchMethod(r) {
+			allowed = append(allowed, rt.match.Methods...)
+			continue
+		}
+		rt.handler.ServeHTTP(w, r)
+		return
+	}
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		w.Header().Set("Allow", strings.Join(slices.Compact(allowed), ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	router.fallback.ServeHTTP(w, r)
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Route", name)
+	})
+}
+
+func routeTableOf(resources ...config.Resource) *routeTable {
+	table := newRouteTable()
+	for _, resource := range resources {
+		table.Handle(resource, named(resource.Name))
+	}
+	return table
+}
+
+func TestRouterPrecedence(t *testing.T) {
+	router := NewRouter(named("fallback"))
+	router.Swap(routeTableOf(
+		config.Resource{Name: "catch-all", Endpoint: "/*"},
+		config.Resource{Name: "users", Endpoint: "/users/*"},
+		config.Resource{Name: "user", Endpoint: "/users/{id}"},
+		config.Resource{Name: "me", Endpoint: "/users/me"},
+		config.Resource{Name: "admin-host", Endpoint: "/users/*", Match: config.Match{Hosts: []string{"*.admin.example.com"}}},
+		config.Resource{Name: "beta", Endpoint: "/users/*", Match: config.Match{Headers: []config.KeyValue{{Name: "x-beta", Value: "1"}}}},
+		config.Resource{Name: "debug", Endpoint: "/users/*", Match: config.Match{Query: []config.KeyValue{{Name: "debug"}}}},
+		config.Resource{Name: "pinned", Endpoint: "/*", Priority: 10, Match: config.Match{Headers: []config.KeyValue{{Name: "X-Pin"}}}},
+		config.Resource{Name: "exact", Endpoint: "/health"},
+	))
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		host   string
+		header [2]string
+		want   string
+	}{
+		{name: "exact beats template", target: "/users/me", want: "me"},
+		{name: "template beats prefix", target: "/users/7", want: "user"},
+		{name: "longer prefix wins", target: "/users/7/orders", want: "users"},
+		{name: "prefix matches itself", target: "/users", want: "users"},
+		{name: "prefix needs segment boundary", target: "/usersx", want: "catch-all"},
+		{name: "host wildcard", target: "/users/7/orders", host: "eu.admin.example.com:8443", want: "admin-host"},
+		{name: "host wildcard skips apex", target: "/users/7/orders", host: "admin.example.com", want: "users"},
+		{name: "header value", target: "/users/7/orders", header: [2]string{"X-Beta", "1"}, want: "beta"},
+		{name: "header value mismatch", target: "/users/7/orders", header: [2]string{"X-Beta", "2"}, want: "users"},
+		{name: "query presence", target: "/users/7/orders?debug", want: "debug"},
+		{name: "priority first", target: "/users/me", header: [2]string{"X-Pin", "any"}, want: "pinned"},
+		{name: "exact only", target: "/health/live", want: "catch-all"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.target, nil)
+			if tc.host != "" {
+				r.Host = tc.host
+			}
+			if tc.header[0] != "" {
+				r.Header.Set(tc.header[0], tc.header[1])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if got := w.Header().Get("X-Route"); got != tc.want {
+				t.Fatalf("routed to %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouterDeclarationOrderBreaksTies(t *testing.T) {
+	router := NewRouter(nil)
+	router.Swap(routeTableOf(
+		config.Resource{Name: "first", Endpoint: "/a/*"},
+		config.Resource{Name: "second", Endpoint: "/a/*"},
+	))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/a/b", nil))
+	if got := w.Header().Get("X-Route"); got != "first" {
+		t.Fatalf("routed to %q", got)
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	router := NewRouter(nil)
+	router.Swap(routeTableOf(
+		config.Resource{Name: "read", Endpoint: "/items/*", Match: config.Match{Methods: []string{"get", "head"}}},
+		config.Resource{Name: "write", Endpoint: "/items/*", Match: config.Match{Methods: []string{"POST"}}},
+	))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/items/1", nil))
+	if got := w.Header().Get("X-Route"); got != "write" {
+		t.Fatalf("routed to %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/items/1", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, POST" {
+		t.Fatalf("answered %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unmatched request answered %d", w.Code)
+	}
+}
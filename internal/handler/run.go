@@ -2,46 +2,232 @@ package handler
 
 import (
 	"context"
+	"expvar"
+	"log"
 	"net/http"
-	"net/url"
+	"sync"
+	"time"
 
 	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/internal/route"
 	"github.com/swavan.io/gateway/pkg/authentication"
 )
 
-func Run(ctx context.Context, mux *http.ServeMux, auth authentication.AuthenticationAPI) error {
-	mux.HandleFunc("/health", health)
+// Gateway owns the routing table built from the configured resources and
+// the routes stored in the database, and rebuilds it on reload.
+type Gateway struct {
+	ctx    context.Context
+	auth   *Auth
+	routes route.RouteAPI
+	router *Router
+	health *Health
+	server *http.Server
+	cache  *responseCache
+	// identity is nil unless identity tokens are enabled.
+	identity *identityIssuer
 
+	mu      sync.Mutex
+	cfg     config.Configuration
+	proxies map[string]*reverseProxy
+	cancel  context.CancelFunc
+}
+
+func Run(ctx context.Context, mux *http.ServeMux, auth authentication.AuthenticationAPI, routes route.RouteAPI) (*Gateway, error) {
 	authMiddleware, err := NewAuthMiddleware(ctx, auth)
+	if err != nil {
+		return nil, err
+	}
+	authMiddleware.clientUser = config.Config.Server.TLS.ClientUser
+	authMiddleware.tokens = config.Config.Tokens.SetDefaultIfEmpty()
+	authMiddleware.revocations = newRevocations(auth.Revocation())
+	authMiddleware.revocations.Prune("refresh tokens", auth.Refresh())
+	authMiddleware.revocations.Prune("sessions", auth.Session())
+	if err := authMiddleware.revocations.Load(ctx); err != nil {
+		return nil, err
+	}
+	go authMiddleware.revocations.Run(ctx, authMiddleware.tokens.RevocationRefresh)
+
+	gateway := &Gateway{
+		ctx:    ctx,
+		auth:   authMiddleware,
+		routes: routes,
+		router: NewRouter(nil),
+		health: NewHealth(),
+		cache:  newResponseCache(config.Config.Cache),
+	}
+	if cfg := config.Config.Identity; cfg.Enabled {
+		if gateway.identity, err = newIdentityIssuer(ctx, auth, cfg); err != nil {
+			return nil, err
+		}
+		mux.Handle("GET "+IdentityKeysPath, gateway.identity)
+	}
+	mux.Handle("/health", gateway.health)
+	mux.Handle("/", gateway.router)
+
+	guard := func(h http.HandlerFunc) http.HandlerFunc {
+		return authMiddleware.Guard(authMiddleware.Access(h))
+	}
+	mux.HandleFunc("POST /auth/login", authMiddleware.Login)
+	mux.HandleFunc("POST /auth/refresh", authMiddleware.Refresh)
+	mux.HandleFunc("GET /auth/oidc/{id}/login", authMiddleware.OIDCLogin)
+	mux.HandleFunc("GET /auth/oidc/{id}/callback", authMiddleware.OIDCCallback)
+	mux.HandleFunc("GET /auth/oidc/{id}/link", authMiddleware.Guard(authMiddleware.OIDCLink))
+	mux.HandleFunc("POST /auth/logout", authMiddleware.Guard(authMiddleware.Logout))
+	mux.HandleFunc("GET /auth/sessions", authMiddleware.Guard(authMiddleware.Sessions))
+	mux.HandleFunc("DELETE /auth/sessions/{id}", authMiddleware.Guard(authMiddleware.EndSession))
+	mux.HandleFunc("DELETE /admin/tokens/{jti}", guard(authMiddleware.RevokeToken))
+	mux.HandleFunc("DELETE /admin/users/{username}/sessions", guard(authMiddleware.RevokeUser))
+	mux.HandleFunc("GET /admin/users/{username}/sessions", guard(authMiddleware.UserSessions))
+	mux.HandleFunc("DELETE /admin/users/{username}/sessions/{id}", guard(authMiddleware.EndUserSession))
+	mux.HandleFunc("GET /debug/vars", guard(expvar.Handler().ServeHTTP))
+	mux.HandleFunc("DELETE /admin/cache", guard(gateway.purgeCache))
+
+	if routes != nil {
+		mux.HandleFunc("GET /admin/routes", guard(gateway.listRoutes))
+		mux.HandleFunc("POST /admin/routes", guard(gateway.createRoute))
+		mux.HandleFunc("GET /admin/routes/{id}", guard(gateway.getRoute))
+		mux.HandleFunc("PUT /admin/routes/{id}", guard(gateway.updateRoute))
+		mux.HandleFunc("DELETE /admin/routes/{id}", guard(gateway.deleteRoute))
+
+		if refresh := routes.Config().Refresh; refresh > 0 {
+			go gateway.poll(refresh)
+		}
+	}
+
+	if err := gateway.Reload(config.Config); err != nil {
+		return nil, err
+	}
+
+	gateway.server, err = NewServer(ctx, config.Config.Server, NewLogger(mux))
+	if err != nil {
+		return nil, err
+	}
+	return gateway, nil
+}
+
+func (g *Gateway) Server() *http.Server {
+	return g.server
+}
+
+// Drain fails the health check ahead of a shutdown.
+func (g *Gateway) Drain() {
+	g.health.Drain()
+}
+
+// WaitStreams blocks until the open WebSocket and Server-Sent Events streams
+// ended or ctx is done, the server doesn't wait for hijacked connections.
+func (g *Gateway) WaitStreams(ctx context.Context) error {
+	return streams.Wait(ctx)
+}
+
+// CloseStreams ends the streams still open once the shutdown timed out.
+func (g *Gateway) CloseStreams() {
+	streams.CloseAll()
+}
+
+// ListenAndServe serves HTTPS when the server has certificates configured.
+func (g *Gateway) ListenAndServe() error {
+	if g.server.TLSConfig != nil {
+		return g.server.ListenAndServeTLS("", "")
+	}
+	return g.server.ListenAndServe()
+}
+
+// Reload validates cfg together with the stored routes, builds the reverse
+// proxies and middleware chains and swaps them in. The running table is kept
+// when anything in the new configuration is invalid. Server settings need a
+// restart.
+func (g *Gateway) Reload(cfg config.Configuration) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stored, err := g.storedResources(g.ctx)
 	if err != nil {
 		return err
 	}
-	for _, resource := range config.Config.Resources {
+	merged := cfg
+	merged.Resources = append(append([]config.Resource{}, cfg.Resources...), stored...)
+	if err := merged.Validate(); err != nil {
+		return err
+	}
+
+	table := newRouteTable()
+	proxies := make(map[string]*reverseProxy)
+	for _, resource := range merged.Resources {
 
 		if !resource.Active {
 			continue
 		}
 
-		url, err := url.Parse(resource.Destination)
+		proxy, err := NewReverseProxy(resource)
 		if err != nil {
 			return err
 		}
+		proxies[resource.Name] = proxy
+
+		var h http.Handler = proxy
+		if resource.Cache.Enabled {
+			h = newCachePolicy(resource.Name, resource.Cache, g.cache).Wrap(h)
+		}
+		if g.identity != nil {
+			h = g.identity.Wrap(resource.Name, h)
+		}
 
 		if resource.Authenticated {
-			mux.HandleFunc(
-				resource.Endpoint,
-				authMiddleware.Guard(NewReverseProxy(url, resource.Endpoint).ServeHTTP),
-			)
-			continue
+			h = g.auth.Guard(h.ServeHTTP)
+		}
+		if !resource.Limits.IsEmpty() {
+			h = newRequestLimiter(resource.Name, resource.Limits).Wrap(h)
 		}
 
-		mux.HandleFunc(
-			resource.Endpoint,
-			NewReverseProxy(url, resource.Endpoint).ServeHTTP,
+		table.Handle(
+			resource,
+			h,
 		)
 
 	}
 
-	NewLogger(mux)
+	ctx, cancel := context.WithCancel(g.ctx)
+	for _, proxy := range proxies {
+		proxy.Start(ctx)
+	}
+
+	old, stop := g.proxies, g.cancel
+	g.cfg, g.proxies, g.cancel = cfg, proxies, cancel
+	g.router.Swap(table)
+	g.health.Replace(proxies)
+
+	if stop != nil {
+		stop()
+	}
+	for _, proxy := range old {
+		proxy.Close()
+	}
+	log.Printf("routing table loaded with %d resources", len(proxies))
 	return nil
 }
+
+// Refresh rebuilds the routing table from the current configuration, used
+// once the stored routes changed.
+func (g *Gateway) Refresh() error {
+	g.mu.Lock()
+	cfg := g.cfg
+	g.mu.Unlock()
+	return g.Reload(cfg)
+}
+
+// poll picks up routes changed through other gateway instances.
+func (g *Gateway) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := g.Refresh(); err != nil {
+				log.Printf("refreshing stored routes failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+func backend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testGateway(t *testing.T) *Gateway {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &Gateway{
+		ctx:    ctx,
+		router: NewRouter(nil),
+		health: NewHealth(),
+		cache:  newResponseCache(config.CacheStore{}),
+	}
+}
+
+func resourceTo(name, endpoint, destination string) config.Resource {
+	return config.Resource{Name: name, Endpoint: endpoint, Destination: destination, Active: true}
+}
+
+func get(t *testing.T, h http.Handler, target string) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestGatewayReloadSwapsTable(t *testing.T) {
+	blue, green := backend(t, "blue"), backend(t, "green")
+	g := testGateway(t)
+
+	if err := g.Reload(config.Configuration{Resources: []config.Resource{resourceTo("app", "/app/*", blue.URL)}}); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get(t, g.router, "/app/x"); code != http.StatusOK || body != "blue" {
+		t.Fatalf("before reload: %d %q", code, body)
+	}
+
+	if err := g.Reload(config.Configuration{Resources: []config.Resource{resourceTo("app", "/app/*", green.URL)}}); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get(t, g.router, "/app/x"); code != http.StatusOK || body != "green" {
+		t.Fatalf("after reload: %d %q", code, body)
+	}
+
+	// Inactive resources leave the table.
+	inactive := resourceTo("app", "/app/*", green.URL)
+	inactive.Active = false
+	if err := g.Reload(config.Configuration{Resources: []config.Resource{inactive}}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(t, g.router, "/app/x"); code != http.StatusNotFound {
+		t.Fatalf("inactive resource answered %d", code)
+	}
+}
+
+func TestGatewayReloadKeepsTableOnError(t *testing.T) {
+	blue := backend(t, "blue")
+	g := testGateway(t)
+	if err := g.Reload(config.Configuration{Resources: []config.Resource{resourceTo("app", "/app/*", blue.URL)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, resources := range map[string][]config.Resource{
+		"duplicate name":    {resourceTo("app", "/app/*", blue.URL), resourceTo("app", "/other/*", blue.URL)},
+		"relative endpoint": {resourceTo("app", "app/*", blue.URL)},
+		"invalid upstream":  {resourceTo("app", "/app/*", "localhost:1")},
+	} {
+		if err := g.Reload(config.Configuration{Resources: resources}); err == nil {
+			t.Errorf("%s: reload succeeded", name)
+		}
+		if code, body := get(t, g.router, "/app/x"); code != http.StatusOK || body != "blue" {
+			t.Errorf("%s: table changed, %d %q", name, code, body)
+		}
+	}
+}
+
+func TestGatewayReloadUnderLoad(t *testing.T) {
+	blue, green := backend(t, "blue"), backend(t, "green")
+	g := testGateway(t)
+	configs := []config.Configuration{
+		{Resources: []config.Resource{resourceTo("app", "/app/*", blue.URL)}},
+		{Resources: []config.Resource{resourceTo("app", "/app/*", green.URL)}},
+	}
+	if err := g.Reload(configs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Int64
+		done   = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if code, _ := get(t, g.router, "/app/x"); code != http.StatusOK {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := g.Reload(configs[i%2]); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		t.Fatalf("%d requests failed while reloading", n)
+	}
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/revocation"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// SessionResponse marks the session the request was made with.
+type SessionResponse struct {
+	session.Session
+	Current bool `json:"current"`
+}
+
+// clientIP is the address the request came from, without port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// seenInterval is how often Guard records that a session is in use.
+const seenInterval = time.Minute
+
+// sessionsSeen throttles the updates of last_seen_at to one per session
+// and seenInterval, the zero value is ready to use.
+type sessionsSeen struct {
+	mu    sync.Mutex
+	last  map[string]time.Time
+	swept time.Time
+}
+
+// due tells whether session id has to be recorded as seen at now.
+func (ss *sessionsSeen) due(id string, now time.Time) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.last == nil {
+		ss.last = make(map[string]time.Time)
+	}
+	if last, ok := ss.last[id]; ok && now.Sub(last) < seenInterval {
+		return false
+	}
+	ss.last[id] = now
+	// Sessions no longer in use are forgotten.
+	if now.Sub(ss.swept) >= seenInterval {
+		for id, last := range ss.last {
+			if now.Sub(last) >= seenInterval {
+				delete(ss.last, id)
+			}
+		}
+		ss.swept = now
+	}
+	return true
+}
+
+// seen records that the session of claims is in use.
+func (a *Auth) seen(ctx context.Context, claims *authentication.Claims) {
+	if claims.Session == "" || !a.sessionsSeen.due(claims.Session, time.Now()) {
+		return
+	}
+	if err := a.api.Session().Seen(ctx, claims.Session); err != nil {
+		log.Printf("updating session of %s failed: %v", claims.Username, err)
+	}
+}
+
+// terminate ends the session id of username. Its refresh tokens are revoked
+// for good and its access tokens until they expire.
+func (a *Auth) terminate(ctx context.Context, id, username string) error {
+	if err := a.revocations.Revoke(ctx, revocation.NewSessionRevocation(id, username, a.tokens.AccessTTL)); err != nil {
+		return err
+	}
+	if err := a.api.Refresh().RevokeFamily(ctx, id); err != nil {
+		return err
+	}
+	return a.api.Session().End(ctx, id)
+}
+
+func (a *Auth) listSessions(w http.ResponseWriter, r *http.Request, username, current string) {
+	sessions, err := a.api.Session().FindByUser(r.Context(), username)
+	if err != nil {
+		log.Printf("listing sessions of %s failed: %v", username, err)
+		writeError(w, http.StatusInternalServerError, "listing sessions failed")
+		return
+	}
+	response := make([]SessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		response = append(response, SessionResponse{Session: s, Current: s.ID == current})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *Auth) endSession(w http.ResponseWriter, r *http.Request, username string) bool {
+	id := r.PathValue("id")
+	s, err := a.api.Session().Find(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && s.Username != username) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return false
+	}
+	if err == nil {
+		err = a.terminate(r.Context(), id, username)
+	}
+	if err != nil {
+		log.Printf("ending session %s of %s failed: %v", id, username, err)
+		writeError(w, http.StatusInternalServerError, "ending session failed")
+		return false
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// Sessions lists the active sessions of the caller.
+func (a *Auth) Sessions(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims)
+	a.listSessions(w, r, claims.Username, claims.Session)
+}
+
+// EndSession signs the caller out of one of their sessions.
+func (a *Auth) EndSession(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims)
+	a.endSession(w, r, claims.Username)
+}
+
+// UserSessions lists the active sessions of the user of the path.
+func (a *Auth) UserSessions(w http.ResponseWriter, r *http.Request) {
+	a.listSessions(w, r, r.PathValue("username"), "")
+}
+
+// EndUserSession signs the user of the path out of one session.
+func (a *Auth) EndUserSession(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if a.endSession(w, r, username) {
+		log.Printf("session %s of %s ended by %s", r.PathValue("id"), username, modifier(r))
+	}
+}
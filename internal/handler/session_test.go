@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
+)
+
+func sessionOf(t *testing.T, a *Auth, tokens TokenResponse) string {
+	t.Helper()
+	claims, _, err := authentication.ParseAsymmetricToken(tokens.AccessToken, a.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.Session
+}
+
+func TestSessions(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	testUser(t, api, "bob", "battery staple")
+	_, phone := login(t, a, "alice", "correct horse")
+	_, laptop := login(t, a, "alice", "correct horse")
+	_, bob := login(t, a, "bob", "battery staple")
+
+	w := authenticatedCall(a, a.Sessions, "GET /auth/sessions", "/auth/sessions", phone.AccessToken)
+	var sessions []SessionResponse
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("listing answered %d, %v", w.Code, err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == sessionOf(t, a, phone)) || s.Username != "alice" {
+			t.Fatalf("listed %+v", s)
+		}
+	}
+
+	// Sessions of somebody else can't be ended, nor told apart from missing.
+	if w := authenticatedCall(a, a.EndSession, "DELETE /auth/sessions/{id}", "/auth/sessions/"+sessionOf(t, a, bob), phone.AccessToken); w.Code != http.StatusNotFound {
+		t.Fatalf("ending session of bob answered %d", w.Code)
+	}
+	if w := authenticatedCall(a, a.EndSession, "DELETE /auth/sessions/{id}", "/auth/sessions/missing", phone.AccessToken); w.Code != http.StatusNotFound {
+		t.Fatalf("ending missing session answered %d", w.Code)
+	}
+	if !guarded(a, bob.AccessToken) {
+		t.Fatal("session of bob ended")
+	}
+
+	if w := authenticatedCall(a, a.EndSession, "DELETE /auth/sessions/{id}", "/auth/sessions/"+sessionOf(t, a, laptop), phone.AccessToken); w.Code != http.StatusNoContent {
+		t.Fatalf("ending session answered %d: %s", w.Code, w.Body)
+	}
+	if guarded(a, laptop.AccessToken) {
+		t.Fatal("access token of the ended session accepted")
+	}
+	if w, _ := refreshWith(t, a, laptop.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh of the ended session answered %d", w.Code)
+	}
+	if !guarded(a, phone.AccessToken) {
+		t.Fatal("current session ended")
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	_, tokens := login(t, a, "alice", "correct horse")
+	id := sessionOf(t, a, tokens)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/users/{username}/sessions", a.UserSessions)
+	mux.HandleFunc("DELETE /admin/users/{username}/sessions/{id}", a.EndUserSession)
+
+	w := call(mux, "GET", "/admin/users/alice/sessions", "")
+	var sessions []SessionResponse
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil || len(sessions) != 1 || sessions[0].Current {
+		t.Fatalf("listed %+v, %v", sessions, err)
+	}
+	if w := call(mux, "DELETE", "/admin/users/bob/sessions/"+id, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("ending session under another user answered %d", w.Code)
+	}
+	if w := call(mux, "DELETE", "/admin/users/alice/sessions/"+id, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("ending session answered %d", w.Code)
+	}
+	if guarded(a, tokens.AccessToken) {
+		t.Fatal("access token of the ended session accepted")
+	}
+}
+
+func TestGuardMarksSessionSeen(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	_, tokens := login(t, a, "alice", "correct horse")
+	id := sessionOf(t, a, tokens)
+
+	// Tracked sessions start out as seen at login.
+	api.sessions.mu.Lock()
+	api.sessions.sessions[id].LastSeenAt = time.Now().Add(-time.Hour)
+	api.sessions.mu.Unlock()
+
+	for i := 0; i < 5; i++ {
+		if !guarded(a, tokens.AccessToken) {
+			t.Fatal("access token rejected")
+		}
+	}
+	s, _ := api.sessions.Find(context.Background(), id)
+	if time.Since(s.LastSeenAt) > time.Minute || api.sessions.seen != 1 {
+		t.Fatalf("last seen %s after %d updates", s.LastSeenAt, api.sessions.seen)
+	}
+}
+
+func TestSessionsSeenDue(t *testing.T) {
+	var ss sessionsSeen
+	now := time.Now()
+	if !ss.due("a", now) || ss.due("a", now.Add(seenInterval/2)) {
+		t.Fatal("updates not throttled")
+	}
+	if !ss.due("b", now.Add(seenInterval/2)) {
+		t.Fatal("other session throttled")
+	}
+	if !ss.due("a", now.Add(seenInterval)) {
+		t.Fatal("update due after the interval skipped")
+	}
+	ss.due("c", now.Add(3*seenInterval))
+	if len(ss.last) != 1 {
+		t.Fatalf("%d sessions tracked", len(ss.last))
+	}
+}
+
+func TestRevocationsRunPrunesSessions(t *testing.T) {
+	a, api := testAuth(t)
+	a.revocations.Prune("sessions", api.sessions)
+	ctx := context.Background()
+	api.sessions.Save(ctx, session.NewSession().SetID("old").SetExpiresAt(time.Now().Add(-time.Minute)))
+	api.sessions.Save(ctx, session.NewSession().SetID("new").SetExpiresAt(time.Now().Add(time.Hour)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go a.revocations.Run(ctx, time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		api.sessions.mu.Lock()
+		_, old := api.sessions.sessions["old"]
+		_, fresh := api.sessions.sessions["new"]
+		api.sessions.mu.Unlock()
+		if !fresh {
+			t.Fatal("active session pruned")
+		}
+		if !old {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session kept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+var (
+	streamsTotal    = expvar.NewMap("gateway_streams_total")
+	streamsRejected = expvar.NewMap("gateway_streams_rejected")
+	streams         = newStreamRegistry()
+)
+
+func init() {
+	expvar.Publish("gateway_open_streams", expvar.Func(func() any {
+		return streams.Open()
+	}))
+}
+
+// isUpgrade reports whether r asks to switch protocols, e.g. to WebSocket.
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerContains(r.Header, "Connection", "upgrade")
+}
+
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// isStream reports whether r opens a long lived WebSocket or Server-Sent
+// Events connection.
+func isStream(r *http.Request) bool {
+	return isUpgrade(r) || isEventStream(r)
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamRegistry counts the open streams per resource and remembers how to
+// close them, net/http doesn't track hijacked connections on shutdown. It
+// outlives reloads so replaced proxies keep counting against the limit.
+type streamRegistry struct {
+	mu      sync.Mutex
+	next    int64
+	open    map[string]int
+	closers map[int64]func()
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		open:    make(map[string]int),
+		closers: make(map[int64]func()),
+	}
+}
+
+func (s *streamRegistry) acquire(name string, max int, closer func()) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max > 0 && s.open[name] >= max {
+		return nil, false
+	}
+	s.open[name]++
+	s.next++
+	id := s.next
+	s.closers[id] = closer
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.open[name]--; s.open[name] <= 0 {
+			delete(s.open, name)
+		}
+		delete(s.closers, id)
+	}, true
+}
+
+func (s *streamRegistry) Count(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open[name]
+}
+
+func (s *streamRegistry) Open() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	open := make(map[string]int, len(s.open))
+	for name, n := range s.open {
+		open[name] = n
+	}
+	return open
+}
+
+// Wait blocks until every stream ended or ctx is done.
+func (s *streamRegistry) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		open := len(s.closers)
+		s.mu.Unlock()
+		if open == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseAll ends every open stream.
+func (s *streamRegistry) CloseAll() {
+	s.mu.Lock()
+	closers := make([]func(), 0, len(s.closers))
+	for _, closer := range s.closers {
+		closers = append(closers, closer)
+	}
+	s.mu.Unlock()
+
+	for _, closer := range closers {
+		closer()
+	}
+	if len(closers) > 0 {
+		log.Printf("closed %d open streams", len(closers))
+	}
+}
+
+type streamLimiter struct {
+	name string
+	cfg  config.Stream
+}
+
+func newStreamLimiter(name string, cfg config.Stream) *streamLimiter {
+	return &streamLimiter{name: name, cfg: cfg}
+}
+
+// Wrap applies the connection limit and idle handling of the resource to
+// WebSocket and Server-Sent Events requests, other requests pass through.
+func (sl *streamLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isStream(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		sw := &streamWriter{ResponseWriter: w, cancel: cancel, idle: sl.cfg.IdleTimeout}
+
+		release, ok := streams.acquire(sl.name, sl.cfg.MaxConnections, sw.Close)
+		if !ok {
+			streamsRejected.Add(sl.name, 1)
+			log.Printf("stream %s: rejected %s %s, %d streams open", sl.name, r.Method, r.URL.Path, sl.cfg.MaxConnections)
+			writeError(w, http.StatusServiceUnavailable, "too many open streams")
+			return
+		}
+		defer release()
+		streamsTotal.Add(sl.name, 1)
+
+		// Streams outlive the read and write timeouts of the server, the idle
+		// timeout of the resource takes over.
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+
+		if !isUpgrade(r) {
+			defer sw.keepAlive(sl.cfg.Heartbeat)()
+		}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// streamWriter tracks the activity of a stream. Server-Sent Events are
+// cancelled once idle and kept warm with heartbeat comments, upgraded
+// connections get an idleConn.
+type streamWriter struct {
+	http.ResponseWriter
+	cancel context.CancelFunc
+	idle   time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	last    time.Time
+	started bool
+	// boundary is set while the last write ended an event, heartbeats must
+	// not be interleaved with a partially written one.
+	boundary bool
+	done     bool
+	conn     net.Conn
+}
+
+func (sw *streamWriter) WriteHeader(code int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.started, sw.boundary, sw.last = true, true, time.Now()
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	n, err := sw.ResponseWriter.Write(b)
+	sw.started, sw.last = true, time.Now()
+	sw.boundary = bytes.HasSuffix(b, []byte("\n\n")) || bytes.HasSuffix(b, []byte("\r\n\r\n"))
+	if sw.timer != nil {
+		sw.timer.Reset(sw.idle)
+	}
+	return n, err
+}
+
+func (sw *streamWriter) FlushError() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ic := &idleConn{Conn: conn, timeout: sw.idle}
+	sw.mu.Lock()
+	sw.conn = ic
+	sw.mu.Unlock()
+	return ic, brw, nil
+}
+
+// Close ends the stream, used on shutdown.
+func (sw *streamWriter) Close() {
+	sw.cancel()
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.conn != nil {
+		sw.conn.Close()
+	}
+}
+
+// keepAlive starts the idle timer and the heartbeats of an event stream, the
+// returned func stops both.
+func (sw *streamWriter) keepAlive(heartbeat time.Duration) func() {
+	if sw.idle > 0 {
+		sw.mu.Lock()
+		sw.timer = time.AfterFunc(sw.idle, sw.cancel)
+		sw.mu.Unlock()
+	}
+	stop := make(chan struct{})
+	if heartbeat > 0 {
+		go func() {
+			ticker := time.NewTicker(heartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					sw.heartbeat(heartbeat)
+				}
+			}
+		}()
+	}
+	return func() {
+		close(stop)
+		sw.mu.Lock()
+		defer sw.mu.Unlock()
+		sw.done = true
+		if sw.timer != nil {
+			sw.timer.Stop()
+		}
+	}
+}
+
+// heartbeat writes an SSE comment when the upstream has been quiet for a
+// while. It doesn't count as activity for the idle timeout.
+func (sw *streamWriter) heartbeat(interval time.Duration) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.done || !sw.started || !sw.boundary || time.Since(sw.last) < interval {
+		return
+	}
+	if !strings.HasPrefix(sw.Header().Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	if _, err := sw.ResponseWriter.Write([]byte(": heartbeat\n\n")); err != nil {
+		sw.cancel()
+		return
+	}
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// idleConn closes an upgraded connection once nothing was sent in either
+// direction for timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(b)
+}
+
+func (c *idleConn) extend() {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// streamServer serves h behind the stream limits of cfg.
+func streamServer(t *testing.T, name string, cfg config.Stream, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newStreamLimiter(name, cfg).Wrap(h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// subscribe opens an event stream, the response body is read by the caller.
+func subscribe(t *testing.T, ctx context.Context, url string) *http.Response {
+	t.Helper()
+	r, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// events answers with one event and holds the stream open until the client
+// leaves or the gateway ends it, ended is signalled then.
+func events(ended chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() { ended <- struct{}{} }()
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: hello\n\n")
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+	}
+}
+
+func ended(t *testing.T, ended <-chan struct{}, within time.Duration) {
+	t.Helper()
+	select {
+	case <-ended:
+	case <-time.After(within):
+		t.Fatal("stream still open")
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	done := make(chan struct{}, 2)
+	srv := streamServer(t, "limited", config.Stream{MaxConnections: 1}, func(w http.ResponseWriter, r *http.Request) {
+		if !isStream(r) {
+			io.WriteString(w, "plain")
+			return
+		}
+		events(done)(w, r)
+	})
+
+	ctx, leave := context.WithCancel(context.Background())
+	defer leave()
+	if resp := subscribe(t, ctx, srv.URL); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first stream answered %d", resp.StatusCode)
+	}
+	if n := streams.Count("limited"); n != 1 {
+		t.Fatalf("%d streams counted", n)
+	}
+
+	if resp := subscribe(t, context.Background(), srv.URL); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("stream over the limit answered %d", resp.StatusCode)
+	}
+	if code, body := get(t, srv.Config.Handler, "/"); code != http.StatusOK || body != "plain" {
+		t.Fatalf("plain request answered %d %q", code, body)
+	}
+
+	// The slot is given back once the client leaves.
+	leave()
+	ended(t, done, time.Second)
+	if err := streams.Wait(ctxTimeout(t, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, leave = context.WithCancel(context.Background())
+	if resp := subscribe(t, ctx, srv.URL); resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream after the first left answered %d", resp.StatusCode)
+	}
+	leave()
+	ended(t, done, time.Second)
+}
+
+func TestStreamIdleEventStream(t *testing.T) {
+	done := make(chan struct{}, 1)
+	srv := streamServer(t, "idle", config.Stream{IdleTimeout: 100 * time.Millisecond}, events(done))
+
+	begin := time.Now()
+	resp := subscribe(t, context.Background(), srv.URL)
+	body, _ := io.ReadAll(resp.Body)
+	ended(t, done, time.Second)
+	if string(body) != "data: hello\n\n" {
+		t.Fatalf("stream sent %q", body)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before the idle timeout", elapsed)
+	}
+}
+
+func TestStreamIdleActivity(t *testing.T) {
+	srv := streamServer(t, "active", config.Stream{IdleTimeout: 100 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			if r.Context().Err() != nil {
+				return
+			}
+			io.WriteString(w, "data: tick\n\n")
+			http.NewResponseController(w).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+
+	// Every event resets the timeout, the stream outlives it.
+	body, _ := io.ReadAll(subscribe(t, context.Background(), srv.URL).Body)
+	if n := strings.Count(string(body), "data: tick"); n != 5 {
+		t.Fatalf("got %d events before the stream ended", n)
+	}
+}
+
+func TestStreamIdleUpgrade(t *testing.T) {
+	srv := streamServer(t, "socket", config.Stream{IdleTimeout: 100 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, brw)
+	})
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: gateway\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade answered %v, %v", resp, err)
+	}
+
+	io.WriteString(conn, "ping")
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(br, echoed); err != nil || string(echoed) != "ping" {
+		t.Fatalf("echoed %q, %v", echoed, err)
+	}
+
+	// Silence in both directions ends the connection.
+	begin := time.Now()
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("idle connection read %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("idle connection closed after %v", elapsed)
+	}
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event string
+		beats bool
+	}{
+		{name: "quiet", event: "data: hello\n\n", beats: true},
+		// A heartbeat would corrupt the event in progress.
+		{name: "partial", event: "data: hel"},
+	} {
+		srv := streamServer(t, "heartbeat", config.Stream{Heartbeat: 20 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, tc.event)
+			http.NewResponseController(w).Flush()
+			<-r.Context().Done()
+		})
+
+		body, _ := io.ReadAll(subscribe(t, ctxTimeout(t, 200*time.Millisecond), srv.URL).Body)
+		if beats := strings.HasPrefix(string(body), tc.event+": heartbeat\n\n"); beats != tc.beats {
+			t.Errorf("%s: stream sent %q", tc.name, body)
+		}
+	}
+}
+
+func TestStreamsCloseAll(t *testing.T) {
+	done := make(chan struct{}, 1)
+	srv := streamServer(t, "shutdown", config.Stream{}, events(done))
+	subscribe(t, context.Background(), srv.URL)
+
+	if err := streams.Wait(ctxTimeout(t, 150*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait with an open stream returned %v", err)
+	}
+	streams.CloseAll()
+	ended(t, done, time.Second)
+	if err := streams.Wait(ctxTimeout(t, time.Second)); err != nil {
+		t.Fatalf("wait after closing returned %v", err)
+	}
+}
+
+func ctxTimeout(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
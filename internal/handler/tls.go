@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// certificates holds key pairs and a CA pool read from disk. They are
+// swapped on reload while connections keep being served.
+type certificates struct {
+	pairs []config.Certificate
+	ca    string
+
+	mu     sync.RWMutex
+	loaded []*tls.Certificate
+	names  map[string]*tls.Certificate
+	pool   *x509.CertPool
+}
+
+func loadCertificates(pairs []config.Certificate, ca string) (*certificates, error) {
+	c := &certificates{ca: config.Path(ca)}
+	for _, pair := range pairs {
+		c.pairs = append(c.pairs, config.Certificate{Cert: config.Path(pair.Cert), Key: config.Path(pair.Key)})
+	}
+	return c, c.reload()
+}
+
+// reload reads every file again, the current certificates are kept when
+// any of them is invalid.
+func (c *certificates) reload() error {
+	loaded := make([]*tls.Certificate, 0, len(c.pairs))
+	names := make(map[string]*tls.Certificate)
+	for _, pair := range c.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+		loaded = append(loaded, &cert)
+		for _, name := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok && name != "" {
+				names[name] = &cert
+			}
+		}
+	}
+
+	var pool *x509.CertPool
+	if c.ca != "" {
+		pem, err := os.ReadFile(c.ca)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", c.ca)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded, c.names, c.pool = loaded, names, pool
+	return nil
+}
+
+func (c *certificates) files() []string {
+	files := []string{}
+	for _, pair := range c.pairs {
+		files = append(files, pair.Cert, pair.Key)
+	}
+	if c.ca != "" {
+		files = append(files, c.ca)
+	}
+	return files
+}
+
+// GetCertificate picks the certificate for the SNI name of the client,
+// falling back to wildcard names and then to the first certificate.
+func (c *certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.loaded) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := c.names[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := c.names["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return c.loaded[0], nil
+}
+
+func (c *certificates) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.loaded) == 0 {
+		return &tls.Certificate{}, nil
+	}
+	return c.loaded[0], nil
+}
+
+func (c *certificates) Pool() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pool
+}
+
+// verifyServer checks the upstream certificate against the current CA pool,
+// the standard verification can't pick up a reloaded pool.
+func (c *certificates) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("upstream sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         c.Pool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// Watch reloads the certificates when one of their files changes until ctx
+// is done. The directories are watched since certificates are usually
+// replaced by renaming or, on Kubernetes, by swapping a symlink.
+func (c *certificates) Watch(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("watching certificates failed: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	files := c.files()
+	dirs := []string{}
+	for _, file := range files {
+		if dir := filepath.Dir(file); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("watching certificates in %s failed: %v", dir, err)
+			}
+		}
+	}
+
+	// Writers touch the files more than once, reload once they are done.
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if slices.Contains(files, filepath.Clean(event.Name)) || filepath.Base(event.Name) == "..data" {
+				debounce.Reset(500 * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watching certificates failed: %v", err)
+		case <-debounce.C:
+			if err := c.reload(); err != nil {
+				log.Printf("reloading certificates failed, keeping the current ones: %v", err)
+				continue
+			}
+			log.Printf("certificates reloaded from %s", strings.Join(files, ", "))
+		}
+	}
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require":         tls.RequireAnyClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"verify":          tls.RequireAndVerifyClientCert,
+}
+
+func newServerTLS(cfg config.TLS) (*tls.Config, *certificates, error) {
+	certs, err := loadCertificates(cfg.Certificates, cfg.ClientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientAuth, ok := clientAuthTypes[cfg.ClientAuth]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown client auth %q", cfg.ClientAuth)
+	}
+	if cfg.ClientCA != "" && cfg.ClientAuth == "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCA == "" {
+		return nil, nil, errors.New("verifying client certificates needs a client_ca")
+	}
+
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+	server := base.Clone()
+	// Hand out the current client CA pool for every handshake.
+	server.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := base.Clone()
+		cfg.ClientCAs = certs.Pool()
+		return cfg, nil
+	}
+	return server, certs, nil
+}
+
+// newUpstreamTLS builds the client side TLS settings of a resource. The
+// returned certificates are nil when nothing has to be read from disk.
+func newUpstreamTLS(cfg config.UpstreamTLS) (*tls.Config, *certificates, error) {
+	tc := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CA == "" && cfg.Cert == "" {
+		return tc, nil, nil
+	}
+
+	pairs := []config.Certificate{}
+	if cfg.Cert != "" {
+		pairs = append(pairs, config.Certificate{Cert: cfg.Cert, Key: cfg.Key})
+	}
+	certs, err := loadCertificates(pairs, cfg.CA)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Cert != "" {
+		tc.GetClientCertificate = certs.GetClientCertificate
+	}
+	if cfg.CA != "" && !cfg.InsecureSkipVerify {
+		// Verification moves to VerifyConnection so the CA pool can be reloaded.
+		tc.InsecureSkipVerify = true
+		tc.VerifyConnection = certs.verifyServer
+	}
+	return tc, certs, nil
+}
@@ -0,0 +1,382 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.sign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	return ca
+}
+
+// sign issues template, the CA signs itself while it has no certificate.
+func (ca *testCA) sign(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, key
+}
+
+func (ca *testCA) write(name string, block *pem.Block) string {
+	ca.t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// caFile writes the CA certificate to name.
+func (ca *testCA) caFile(name string) string {
+	return ca.write(name, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// issue writes a key pair for a server or client named commonName with the
+// extra DNS names.
+func (ca *testCA) issue(name, commonName string, dnsNames ...string) config.Certificate {
+	ca.t.Helper()
+	cert, key := ca.sign(&x509.Certificate{
+		Subject:        pkix.Name{CommonName: commonName},
+		DNSNames:       dnsNames,
+		EmailAddresses: []string{commonName + "@example.com"},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return config.Certificate{
+		Cert: ca.write(name+".pem", &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		Key:  ca.write(name+"-key.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	}
+}
+
+func (ca *testCA) keyPair(pair config.Certificate) tls.Certificate {
+	ca.t.Helper()
+	cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert
+}
+
+func commonName(cert *tls.Certificate) string {
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	return leaf.Subject.CommonName
+}
+
+func TestCertificatesSNI(t *testing.T) {
+	ca := newTestCA(t)
+	certs, err := loadCertificates([]config.Certificate{
+		ca.issue("default", "default.test"),
+		ca.issue("api", "api.example.com"),
+		ca.issue("wildcard", "wildcard", "*.example.com"),
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, want := range map[string]string{
+		"api.example.com":  "api.example.com",
+		"API.Example.com.": "api.example.com",
+		"www.example.com":  "wildcard",
+		"a.b.example.com":  "default.test",
+		"example.com":      "default.test",
+		"other.org":        "default.test",
+		"":                 "default.test",
+	} {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("%q: %v", serverName, err)
+		}
+		if got := commonName(cert); got != want {
+			t.Errorf("%q got %s, want %s", serverName, got, want)
+		}
+	}
+
+	empty, err := loadCertificates(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("handshake without certificates accepted")
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	ca := newTestCA(t)
+	pair := ca.issue("server", "first.test")
+	certs, err := loadCertificates([]config.Certificate{pair}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reissue into the same files.
+	second := ca.issue("server", "second.test")
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{})
+	if got := commonName(cert); got != "second.test" {
+		t.Fatalf("reloaded %s", got)
+	}
+
+	// A broken file keeps the current certificates.
+	if err := os.WriteFile(second.Key, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.reload(); err == nil {
+		t.Fatal("broken key loaded")
+	}
+	cert, _ = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "second.test"})
+	if got := commonName(cert); got != "second.test" {
+		t.Fatalf("kept %s", got)
+	}
+}
+
+// tlsServer serves ok over TLS with cfg.
+func tlsServer(t *testing.T, cfg *tls.Config) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// handshake requests url with a fresh connection.
+func handshake(url string, cfg *tls.Config) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestServerTLSClientAuth(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	clientCA := ca.caFile("client-ca.pem")
+	trusted := ca.keyPair(ca.issue("alice", "alice"))
+	untrusted := other.keyPair(other.issue("mallory", "mallory"))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tc := range []struct {
+		auth   string
+		client *tls.Certificate
+		ok     bool
+	}{
+		{auth: "verify", client: &trusted, ok: true},
+		{auth: "verify", client: &untrusted},
+		{auth: "verify"},
+		{auth: "verify_if_given", client: &trusted, ok: true},
+		{auth: "verify_if_given", client: &untrusted},
+		{auth: "verify_if_given", ok: true},
+		// A client CA alone verifies the certificates given.
+		{auth: "", client: &untrusted},
+	} {
+		cfg, _, err := newServerTLS(config.TLS{
+			Certificates: []config.Certificate{ca.issue("server", "localhost", "localhost")},
+			ClientCA:     clientCA,
+			ClientAuth:   tc.auth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := tlsServer(t, cfg)
+		client := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if tc.client != nil {
+			client.Certificates = []tls.Certificate{*tc.client}
+		}
+		name := "none"
+		if tc.client != nil {
+			name = commonName(tc.client)
+		}
+		if err := handshake(srv.URL, client); (err == nil) != tc.ok {
+			t.Errorf("%q with client certificate %s: %v", tc.auth, name, err)
+		}
+	}
+}
+
+func TestNewServerTLSErrors(t *testing.T) {
+	ca := newTestCA(t)
+	pair := ca.issue("server", "localhost")
+	for name, cfg := range map[string]config.TLS{
+		"unknown client auth": {Certificates: []config.Certificate{pair}, ClientAuth: "always"},
+		"verify without ca":   {Certificates: []config.Certificate{pair}, ClientAuth: "verify"},
+		"missing file":        {Certificates: []config.Certificate{{Cert: pair.Cert, Key: pair.Key + ".missing"}}},
+	} {
+		if _, _, err := newServerTLS(cfg); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	srv := tlsServer(t, &tls.Config{Certificates: []tls.Certificate{ca.keyPair(ca.issue("upstream", "upstream.test", "upstream.test"))}})
+	caFile := ca.caFile("upstream-ca.pem")
+
+	cfg, certs, err := newUpstreamTLS(config.UpstreamTLS{CA: caFile, ServerName: "upstream.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(srv.URL, cfg); err != nil {
+		t.Fatalf("trusted upstream: %v", err)
+	}
+
+	// The name is checked against the one configured.
+	wrongName, _, err := newUpstreamTLS(config.UpstreamTLS{CA: caFile, ServerName: "other.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(srv.URL, wrongName); err == nil {
+		t.Fatal("certificate for another name accepted")
+	}
+
+	// A reloaded CA applies to the next handshake.
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.cert.Raw}), 0o600)
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(srv.URL, cfg); err == nil {
+		t.Fatal("upstream of the replaced CA accepted")
+	}
+	ca.caFile("upstream-ca.pem")
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(srv.URL, cfg); err != nil {
+		t.Fatalf("upstream after the CA came back: %v", err)
+	}
+}
+
+func TestUpstreamTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	srv := tlsServer(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.keyPair(ca.issue("upstream", "upstream.test", "upstream.test"))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	pair := ca.issue("gateway", "gateway")
+
+	cfg, _, err := newUpstreamTLS(config.UpstreamTLS{CA: ca.caFile("ca.pem"), Cert: pair.Cert, Key: pair.Key, ServerName: "upstream.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(srv.URL, cfg); err != nil {
+		t.Fatalf("mutual TLS: %v", err)
+	}
+	withoutCert, _, _ := newUpstreamTLS(config.UpstreamTLS{CA: ca.caFile("ca.pem"), ServerName: "upstream.test"})
+	if err := handshake(srv.URL, withoutCert); err == nil {
+		t.Fatal("upstream accepted a client without certificate")
+	}
+}
+
+func TestGuardClientCertificate(t *testing.T) {
+	a, api := testAuth(t)
+	testUser(t, api, "alice", "correct horse")
+	testUser(t, api, "alice@example.com", "correct horse")
+	ca := newTestCA(t)
+	cert, _ := x509.ParseCertificate(ca.keyPair(ca.issue("alice", "alice")).Certificate[0])
+
+	request := func(verified bool) *http.Request {
+		r := httptest.NewRequest("GET", "/books", nil)
+		r.RemoteAddr = net.JoinHostPort("127.0.0.1", "1234")
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert, ca.cert}}
+		}
+		return r
+	}
+	user := func(r *http.Request) (int, string) {
+		w := httptest.NewRecorder()
+		username := ""
+		a.Guard(func(w http.ResponseWriter, r *http.Request) {
+			username = modifier(r)
+		})(w, r)
+		return w.Code, username
+	}
+
+	for _, tc := range []struct {
+		clientUser string
+		verified   bool
+		want       string
+	}{
+		{clientUser: "common_name", verified: true, want: "alice"},
+		{clientUser: "email", verified: true, want: "alice@example.com"},
+		{clientUser: "common_name"},
+		{clientUser: "", verified: true},
+	} {
+		a.clientUser = tc.clientUser
+		code, got := user(request(tc.verified))
+		if got != tc.want || (tc.want == "") != (code == http.StatusForbidden) {
+			t.Errorf("%q verified %v: %d as %q, want %q", tc.clientUser, tc.verified, code, got, tc.want)
+		}
+	}
+
+	// Certificates of unknown users don't authenticate.
+	a.clientUser = "common_name"
+	stranger, _ := x509.ParseCertificate(ca.keyPair(ca.issue("bob", "bob")).Certificate[0])
+	r := request(true)
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{stranger, ca.cert}}
+	if code, _ := user(r); code != http.StatusForbidden {
+		t.Fatalf("unknown user answered %d", code)
+	}
+}
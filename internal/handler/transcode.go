@@ -0,0 +1,527 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var errUnknownField = errors.New("unknown field")
+
+// httpBinding is one google.api.http rule of a gRPC method.
+type httpBinding struct {
+	verb         string
+	pattern      *regexp.Regexp
+	vars         []string
+	body         string
+	responseBody string
+	method       protoreflect.MethodDescriptor
+}
+
+// transcoder turns REST+JSON requests into unary gRPC calls and their
+// responses back into JSON.
+type transcoder struct {
+	name      string
+	bindings  []*httpBinding
+	types     *protoregistry.Types
+	transport http.RoundTripper
+	onError   func(http.ResponseWriter, *http.Request, error)
+}
+
+func newTranscoder(resource config.Resource, transport http.RoundTripper, onError func(http.ResponseWriter, *http.Request, error)) (*transcoder, error) {
+	if resource.Transcode.Descriptors == "" {
+		return nil, fmt.Errorf("resource %s: transcoding needs a descriptor set", resource.Name)
+	}
+	files, err := loadDescriptors(config.Path(resource.Transcode.Descriptors))
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: %w", resource.Name, err)
+	}
+
+	d, err := files.FindDescriptorByName("google.api.http")
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: descriptor set lacks google/api/annotations.proto, build it with --include_imports", resource.Name)
+	}
+	xd, ok := d.(protoreflect.ExtensionDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("resource %s: google.api.http is not an extension", resource.Name)
+	}
+	rules := dynamicpb.NewExtensionType(xd)
+
+	tc := &transcoder{
+		name:      resource.Name,
+		types:     new(protoregistry.Types),
+		transport: transport,
+		onError:   onError,
+	}
+	tc.types.RegisterExtension(rules)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		registerMessages(tc.types, fd.Messages())
+		return true
+	})
+
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len() && err == nil; i++ {
+			sd := services.Get(i)
+			if len(resource.Transcode.Services) > 0 && !slices.Contains(resource.Transcode.Services, string(sd.FullName())) {
+				continue
+			}
+			methods := sd.Methods()
+			for j := 0; j < methods.Len() && err == nil; j++ {
+				err = tc.bind(methods.Get(j), rules)
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: %w", resource.Name, err)
+	}
+	if len(tc.bindings) == 0 {
+		return nil, fmt.Errorf("resource %s: no method with a google.api.http rule", resource.Name)
+	}
+	return tc, nil
+}
+
+func loadDescriptors(path string) (*protoregistry.Files, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %w", path, err)
+	}
+	return protodesc.NewFiles(set)
+}
+
+func registerMessages(types *protoregistry.Types, messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		types.RegisterMessage(dynamicpb.NewMessageType(md))
+		registerMessages(types, md.Messages())
+	}
+}
+
+// bind adds the http rule of md and its additional bindings. The rule lives
+// in the unknown fields of the method options, the generated options type
+// doesn't know the extension.
+func (tc *transcoder) bind(md protoreflect.MethodDescriptor, rules protoreflect.ExtensionType) error {
+	raw, err := proto.Marshal(md.Options())
+	if err != nil {
+		return err
+	}
+	options := dynamicpb.NewMessage(rules.TypeDescriptor().ContainingMessage())
+	if err := (proto.UnmarshalOptions{Resolver: tc.types}).Unmarshal(raw, options); err != nil {
+		return err
+	}
+	if !options.Has(rules.TypeDescriptor()) {
+		return nil
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		log.Printf("transcode %s: skipping streaming method %s", tc.name, md.FullName())
+		return nil
+	}
+
+	rule := options.Get(rules.TypeDescriptor()).Message()
+	if err := tc.addBinding(md, rule); err != nil {
+		return err
+	}
+	additional := rule.Get(rule.Descriptor().Fields().ByName("additional_bindings")).List()
+	for i := 0; i < additional.Len(); i++ {
+		if err := tc.addBinding(md, additional.Get(i).Message()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tc *transcoder) addBinding(md protoreflect.MethodDescriptor, rule protoreflect.Message) error {
+	fields := rule.Descriptor().Fields()
+	field := func(m protoreflect.Message, name string) string {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name))).String()
+	}
+
+	var verb, template string
+	for _, v := range []string{"get", "put", "post", "delete", "patch"} {
+		if fd := fields.ByName(protoreflect.Name(v)); rule.Has(fd) {
+			verb, template = strings.ToUpper(v), rule.Get(fd).String()
+		}
+	}
+	if fd := fields.ByName("custom"); rule.Has(fd) {
+		custom := rule.Get(fd).Message()
+		verb, template = field(custom, "kind"), field(custom, "path")
+	}
+	if template == "" {
+		return fmt.Errorf("method %s has an http rule without path", md.FullName())
+	}
+
+	pattern, vars, err := compileTemplate(template)
+	if err != nil {
+		return fmt.Errorf("method %s: %w", md.FullName(), err)
+	}
+	b := &httpBinding{
+		verb:         verb,
+		pattern:      pattern,
+		vars:         vars,
+		body:         field(rule, "body"),
+		responseBody: field(rule, "response_body"),
+		method:       md,
+	}
+	if b.body != "" && b.body != "*" && md.Input().Fields().ByName(protoreflect.Name(b.body)) == nil {
+		return fmt.Errorf("method %s: unknown body field %s", md.FullName(), b.body)
+	}
+	if b.responseBody != "" && md.Output().Fields().ByName(protoreflect.Name(b.responseBody)) == nil {
+		return fmt.Errorf("method %s: unknown response body field %s", md.FullName(), b.responseBody)
+	}
+	tc.bindings = append(tc.bindings, b)
+	return nil
+}
+
+// compileTemplate turns an http rule path like /v1/{name=shelves/*}/books:list
+// into a regular expression with one group per variable.
+func compileTemplate(template string) (*regexp.Regexp, []string, error) {
+	var (
+		b    strings.Builder
+		vars []string
+	)
+	b.WriteString("^")
+	for rest := template; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			writeTemplateSegments(&b, rest)
+			break
+		}
+		end := strings.IndexByte(rest, '}')
+		if end < start {
+			return nil, nil, fmt.Errorf("unbalanced braces in %q", template)
+		}
+		writeTemplateSegments(&b, rest[:start])
+		field, pattern, found := strings.Cut(rest[start+1:end], "=")
+		if !found {
+			pattern = "*"
+		}
+		b.WriteString("(")
+		writeTemplateSegments(&b, pattern)
+		b.WriteString(")")
+		vars = append(vars, field)
+		rest = rest[end+1:]
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return re, vars, err
+}
+
+func writeTemplateSegments(b *strings.Builder, s string) {
+	for s != "" {
+		i := strings.IndexByte(s, '*')
+		if i < 0 {
+			b.WriteString(regexp.QuoteMeta(s))
+			return
+		}
+		b.WriteString(regexp.QuoteMeta(s[:i]))
+		if strings.HasPrefix(s[i:], "**") {
+			b.WriteString(".+")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString("[^/]+")
+		s = s[i+1:]
+	}
+}
+
+func (tc *transcoder) match(r *http.Request) (*httpBinding, []string) {
+	path := r.URL.EscapedPath()
+	for _, b := range tc.bindings {
+		if b.verb != r.Method {
+			continue
+		}
+		if m := b.pattern.FindStringSubmatch(path); m != nil {
+			return b, m[1:]
+		}
+	}
+	return nil, nil
+}
+
+func (tc *transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, params := tc.match(r)
+	if b == nil {
+		writeError(w, http.StatusNotFound, "no gRPC method bound to "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	in := dynamicpb.NewMessage(b.method.Input())
+	if err := tc.decode(in, b, params, r); err != nil {
+		if message, ok := bodyTooLarge(err); ok {
+			writeError(w, http.StatusRequestEntityTooLarge, message)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := tc.request(r, b.method, in)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp, err := tc.transport.RoundTrip(req)
+	if err != nil {
+		tc.onError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tc.onError(w, r, err)
+		return
+	}
+
+	code, message, ok := grpcStatus(resp.Trailer)
+	if !ok {
+		code, message, ok = grpcStatus(resp.Header)
+	}
+	if !ok {
+		log.Printf("transcode %s: %s answered %s without gRPC status", tc.name, b.method.FullName(), resp.Status)
+		writeError(w, http.StatusBadGateway, "upstream is not a gRPC service")
+		return
+	}
+	if code != grpcOK {
+		log.Printf("transcode %s: %s failed with %s %q", tc.name, b.method.FullName(), code, message)
+		if message == "" {
+			message = code.String()
+		}
+		writeError(w, httpStatusFromGRPC(code), message)
+		return
+	}
+
+	body, err := tc.encode(b, data)
+	if err != nil {
+		log.Printf("transcode %s: %s: %v", tc.name, b.method.FullName(), err)
+		writeError(w, http.StatusBadGateway, "invalid gRPC response")
+		return
+	}
+	if upstream := resp.Header.Get(UpstreamHeader); upstream != "" {
+		w.Header().Set(UpstreamHeader, upstream)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// decode fills the request message from the body, the path variables and,
+// unless the whole body is the message, the query parameters.
+func (tc *transcoder) decode(in *dynamicpb.Message, b *httpBinding, params []string, r *http.Request) error {
+	if b.body != "" && r.Body != nil {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(raw)) > 0 {
+			if b.body != "*" {
+				fd := in.Descriptor().Fields().ByName(protoreflect.Name(b.body))
+				raw = []byte(`{"` + fd.JSONName() + `":` + string(raw) + `}`)
+			}
+			// Unmarshal resets the message, it has to run first.
+			if err := (protojson.UnmarshalOptions{Resolver: tc.types}).Unmarshal(raw, in); err != nil {
+				return fmt.Errorf("invalid request body: %w", err)
+			}
+		}
+	}
+
+	for i, field := range b.vars {
+		value, err := url.PathUnescape(params[i])
+		if err != nil {
+			return err
+		}
+		if err := setField(in, field, []string{value}); err != nil {
+			return err
+		}
+	}
+
+	if b.body == "*" {
+		return nil
+	}
+	for key, values := range r.URL.Query() {
+		if slices.Contains(b.vars, key) || (b.body != "" && strings.SplitN(key, ".", 2)[0] == b.body) {
+			continue
+		}
+		if err := setField(in, key, values); err != nil && !errors.Is(err, errUnknownField) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tc *transcoder) request(r *http.Request, md protoreflect.MethodDescriptor, in *dynamicpb.Message) (*http.Request, error) {
+	payload, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+
+	path := "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, path, bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	// HTTP/2 refuses connection specific headers.
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Content-Length", "Accept-Encoding"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if deadline, ok := r.Context().Deadline(); ok {
+		timeout := max(time.Until(deadline).Milliseconds(), 1)
+		req.Header.Set("Grpc-Timeout", strconv.FormatInt(timeout, 10)+"m")
+	}
+	req.Host = r.Host
+	return req, nil
+}
+
+// encode unpacks the single message of a unary response into JSON.
+func (tc *transcoder) encode(b *httpBinding, data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, errors.New("short gRPC message")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("compressed gRPC message")
+	}
+	size := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < size {
+		return nil, errors.New("truncated gRPC message")
+	}
+	out := dynamicpb.NewMessage(b.method.Output())
+	if err := proto.Unmarshal(data[5:5+size], out); err != nil {
+		return nil, err
+	}
+	body, err := protojson.MarshalOptions{Resolver: tc.types, EmitUnpopulated: true}.Marshal(out)
+	if err != nil || b.responseBody == "" {
+		return body, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	return fields[b.method.Output().Fields().ByName(protoreflect.Name(b.responseBody)).JSONName()], nil
+}
+
+// setField assigns a path variable or query parameter to the field at the
+// dotted path, e.g. book.author.name.
+func setField(msg protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fields := msg.Descriptor().Fields()
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = fields.ByJSONName(name)
+		}
+		if fd == nil {
+			return fmt.Errorf("%w %s", errUnknownField, path)
+		}
+		if i < len(names)-1 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %s of %s is not a message", name, path)
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+		if fd.IsMap() {
+			return fmt.Errorf("map field %s can't be set from the url", path)
+		}
+		if fd.IsList() {
+			list := msg.Mutable(fd).List()
+			for _, s := range values {
+				v, err := fieldValue(fd, s)
+				if err != nil {
+					return fmt.Errorf("invalid value for %s: %w", path, err)
+				}
+				list.Append(v)
+			}
+			return nil
+		}
+		v, err := fieldValue(fd, values[0])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", path, err)
+		}
+		msg.Set(fd, v)
+	}
+	return nil
+}
+
+func fieldValue(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.MessageKind:
+		// Well known types like Timestamp or StringValue have a JSON string
+		// form, numeric and bool wrappers take the bare value.
+		m := dynamicpb.NewMessage(fd.Message())
+		quoted, _ := json.Marshal(s)
+		if err := protojson.Unmarshal(quoted, m); err == nil {
+			return protoreflect.ValueOfMessage(m), nil
+		}
+		if err := protojson.Unmarshal([]byte(s), m); err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfMessage(m), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported field type %s", fd.Kind())
+}
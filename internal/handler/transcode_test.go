@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCompileTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		vars     []string
+		match    map[string][]string
+		miss     []string
+	}{
+		{
+			template: "/v1/shelves/{shelf}",
+			vars:     []string{"shelf"},
+			match:    map[string][]string{"/v1/shelves/7": {"7"}},
+			miss:     []string{"/v1/shelves/7/books", "/v1/shelves/"},
+		},
+		{
+			template: "/v1/{name=shelves/*}/books:list",
+			vars:     []string{"name"},
+			match:    map[string][]string{"/v1/shelves/7/books:list": {"shelves/7"}},
+			miss:     []string{"/v1/shelves/7/books", "/v1/shelves/7/books:listx"},
+		},
+		{
+			template: "/v1/{book.name=shelves/*/books/*}",
+			vars:     []string{"book.name"},
+			match:    map[string][]string{"/v1/shelves/1/books/2": {"shelves/1/books/2"}},
+			miss:     []string{"/v1/shelves/1/books"},
+		},
+		{
+			template: "/v1/files/{path=**}",
+			vars:     []string{"path"},
+			match:    map[string][]string{"/v1/files/a/b/c.txt": {"a/b/c.txt"}},
+			miss:     []string{"/v1/files/"},
+		},
+		{
+			template: "/v1/shelves/{shelf}/books/{book}",
+			vars:     []string{"shelf", "book"},
+			match:    map[string][]string{"/v1/shelves/1/books/2": {"1", "2"}},
+		},
+		{
+			template: "/v1/a.b+c",
+			match:    map[string][]string{"/v1/a.b+c": {}},
+			miss:     []string{"/v1/aXb+c", "/v1/a.bbc"},
+		},
+	} {
+		t.Run(tc.template, func(t *testing.T) {
+			re, vars, err := compileTemplate(tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vars) != len(tc.vars) {
+				t.Fatalf("vars = %v, want %v", vars, tc.vars)
+			}
+			for i := range vars {
+				if vars[i] != tc.vars[i] {
+					t.Fatalf("vars = %v, want %v", vars, tc.vars)
+				}
+			}
+			for path, want := range tc.match {
+				m := re.FindStringSubmatch(path)
+				if m == nil {
+					t.Fatalf("%s didn't match", path)
+				}
+				for i, v := range want {
+					if m[i+1] != v {
+						t.Fatalf("%s captured %v, want %v", path, m[1:], want)
+					}
+				}
+			}
+			for _, path := range tc.miss {
+				if re.MatchString(path) {
+					t.Fatalf("%s matched", path)
+				}
+			}
+		})
+	}
+
+	if _, _, err := compileTemplate("/v1/}{name"); err == nil {
+		t.Fatal("unbalanced braces accepted")
+	}
+}
+
+// bookDescriptor describes
+//
+//	message Book {
+//	  string name = 1;
+//	  int64 pages = 2;
+//	  repeated string tags = 3;
+//	  Author author = 4;
+//	  Genre genre = 5;
+//	  google.protobuf.Timestamp published = 6;
+//	  bytes cover = 7;
+//	  map<string, string> labels = 8;
+//	  message Author { string display_name = 1; }
+//	  enum Genre { GENRE_UNSPECIFIED = 0; NOVEL = 1; }
+//	}
+func bookDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	label := func(l descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto_Label { return &l }
+	kind := func(k descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto_Type { return &k }
+	optional := label(descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL)
+	field := func(name string, number int32, k descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: optional, Type: kind(k)}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	tags := field("tags", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")
+	tags.Label = label(descriptorpb.FieldDescriptorProto_LABEL_REPEATED)
+	labels := field("labels", 8, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".library.Book.LabelsEntry")
+	labels.Label = label(descriptorpb.FieldDescriptorProto_LABEL_REPEATED)
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("library.proto"),
+		Package:    proto.String("library"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Book"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("pages", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+				tags,
+				field("author", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".library.Book.Author"),
+				field("genre", 5, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".library.Book.Genre"),
+				field("published", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp"),
+				field("cover", 7, descriptorpb.FieldDescriptorProto_TYPE_BYTES, ""),
+				labels,
+			},
+			NestedType: []*descriptorpb.DescriptorProto{
+				{
+					Name:  proto.String("Author"),
+					Field: []*descriptorpb.FieldDescriptorProto{field("display_name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")},
+				},
+				{
+					Name: proto.String("LabelsEntry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+						field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				},
+			},
+			EnumType: []*descriptorpb.EnumDescriptorProto{{
+				Name: proto.String("Genre"),
+				Value: []*descriptorpb.EnumValueDescriptorProto{
+					{Name: proto.String("GENRE_UNSPECIFIED"), Number: proto.Int32(0)},
+					{Name: proto.String("NOVEL"), Number: proto.Int32(1)},
+				},
+			}},
+		}},
+	}
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd.Messages().ByName("Book")
+}
+
+func TestSetField(t *testing.T) {
+	md := bookDescriptor(t)
+	msg := dynamicpb.NewMessage(md)
+	fields := md.Fields()
+
+	for _, f := range []struct {
+		path   string
+		values []string
+	}{
+		{"name", []string{"shelves/1/books/2"}},
+		{"pages", []string{"320"}},
+		{"tags", []string{"sci-fi", "classic"}},
+		{"author.display_name", []string{"Ursula"}},
+		{"author.displayName", []string{"Ursula K."}},
+		{"genre", []string{"NOVEL"}},
+		{"published", []string{"2024-05-01T10:00:00Z"}},
+		{"cover", []string{"aGk="}},
+	} {
+		if err := setField(msg, f.path, f.values); err != nil {
+			t.Fatalf("%s: %v", f.path, err)
+		}
+	}
+
+	if got := msg.Get(fields.ByName("name")).String(); got != "shelves/1/books/2" {
+		t.Errorf("name = %q", got)
+	}
+	if got := msg.Get(fields.ByName("pages")).Int(); got != 320 {
+		t.Errorf("pages = %d", got)
+	}
+	if got := msg.Get(fields.ByName("tags")).List(); got.Len() != 2 || got.Get(1).String() != "classic" {
+		t.Errorf("tags = %v", got)
+	}
+	author := msg.Get(fields.ByName("author")).Message()
+	if got := author.Get(author.Descriptor().Fields().ByName("display_name")).String(); got != "Ursula K." {
+		t.Errorf("author.display_name = %q", got)
+	}
+	if got := msg.Get(fields.ByName("genre")).Enum(); got != 1 {
+		t.Errorf("genre = %d", got)
+	}
+	published := msg.Get(fields.ByName("published")).Message()
+	seconds := published.Get(published.Descriptor().Fields().ByName("seconds")).Int()
+	if got := time.Unix(seconds, 0).UTC(); !got.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("published = %s", got)
+	}
+	if got := string(msg.Get(fields.ByName("cover")).Bytes()); got != "hi" {
+		t.Errorf("cover = %q", got)
+	}
+}
+
+func TestSetFieldErrors(t *testing.T) {
+	md := bookDescriptor(t)
+	for path, value := range map[string]string{
+		"title":        "x",
+		"pages":        "many",
+		"name.first":   "x",
+		"labels":       "x",
+		"genre":        "POEM",
+		"author.title": "x",
+	} {
+		err := setField(dynamicpb.NewMessage(md), path, []string{value})
+		if err == nil {
+			t.Errorf("%s=%s accepted", path, value)
+		}
+		if path == "title" && !errors.Is(err, errUnknownField) {
+			t.Errorf("unknown field error = %v", err)
+		}
+	}
+}
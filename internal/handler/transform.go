@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+// transformer applies the transform of a resource to the request sent
+// upstream and to the response sent back.
+type transformer struct {
+	name         string
+	request      *messageTransform
+	response     *messageTransform
+	status       map[int]int
+	maxBodyBytes int64
+}
+
+type headerValue struct {
+	name  string
+	value *template.Template
+}
+
+type fieldAddition struct {
+	pointer []string
+	value   any
+}
+
+type fieldRename struct {
+	from []string
+	to   []string
+}
+
+type messageTransform struct {
+	set     []headerValue
+	remove  []string
+	rename  []config.Rename
+	add     []fieldAddition
+	drop    [][]string
+	move    []fieldRename
+	hasBody bool
+}
+
+func newTransformer(resource config.Resource) (*transformer, error) {
+	cfg := resource.Transform.SetDefaultIfEmpty()
+	request, err := newMessageTransform(cfg.Request)
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: request transform: %w", resource.Name, err)
+	}
+	response, err := newMessageTransform(cfg.Response)
+	if err != nil {
+		return nil, fmt.Errorf("resource %s: response transform: %w", resource.Name, err)
+	}
+	for from, to := range cfg.Status {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			return nil, fmt.Errorf("resource %s: invalid status mapping %d: %d", resource.Name, from, to)
+		}
+	}
+	return &transformer{name: resource.Name, request: request, response: response, status: cfg.Status, maxBodyBytes: cfg.MaxBodyBytes}, nil
+}
+
+func newMessageTransform(cfg config.MessageTransform) (*messageTransform, error) {
+	mt := &messageTransform{rename: cfg.Headers.Rename, hasBody: !cfg.Body.IsEmpty()}
+	for _, kv := range cfg.Headers.Set {
+		tmpl, err := template.New(kv.Name).Option("missingkey=zero").Parse(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", kv.Name, err)
+		}
+		mt.set = append(mt.set, headerValue{name: kv.Name, value: tmpl})
+	}
+	for _, name := range cfg.Headers.Remove {
+		mt.remove = append(mt.remove, http.CanonicalHeaderKey(name))
+	}
+	for _, field := range cfg.Body.Add {
+		pointer, err := parsePointer(field.Pointer)
+		if err != nil {
+			return nil, err
+		}
+		value := field.Value
+		if s, ok := value.(string); ok {
+			if value, err = template.New(field.Pointer).Parse(s); err != nil {
+				return nil, fmt.Errorf("field %s: %w", field.Pointer, err)
+			}
+		}
+		mt.add = append(mt.add, fieldAddition{pointer: pointer, value: value})
+	}
+	for _, p := range cfg.Body.Remove {
+		pointer, err := parsePointer(p)
+		if err != nil {
+			return nil, err
+		}
+		mt.drop = append(mt.drop, pointer)
+	}
+	for _, r := range cfg.Body.Rename {
+		from, err := parsePointer(r.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePointer(r.To)
+		if err != nil {
+			return nil, err
+		}
+		mt.move = append(mt.move, fieldRename{from: from, to: to})
+	}
+	return mt, nil
+}
+
+// parsePointer splits a JSON pointer (RFC 6901) into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" || !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+func requestClaims(r *http.Request) *authentication.Claims {
+	if claims, ok := r.Context().Value(identity.AuthenticatedUser).(*authentication.Claims); ok {
+		return claims
+	}
+	return authentication.NewClaims()
+}
+
+func (t *transformer) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := requestClaims(r)
+		if err := t.request.headers(r.Header, claims); err != nil {
+			log.Printf("transform %s: request headers: %v", t.name, err)
+		}
+		if t.request.hasBody && r.Body != nil && isJSON(r.Header.Get("Content-Type")) {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if message, ok := bodyTooLarge(err); ok {
+				writeRequestError(w, r, http.StatusRequestEntityTooLarge, message)
+				return
+			}
+			if err != nil {
+				writeRequestError(w, r, http.StatusBadRequest, "reading request body failed")
+				return
+			}
+			if transformed, err := t.request.body(body, claims); err != nil {
+				log.Printf("transform %s: request body: %v", t.name, err)
+			} else {
+				body = transformed
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+
+		if isStream(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Response bodies are edited as they come, the upstream must not
+		// compress them.
+		if t.response.hasBody {
+			r.Header.Del("Accept-Encoding")
+		}
+		tw := &transformWriter{ResponseWriter: w, t: t, claims: claims}
+		h.ServeHTTP(tw, r)
+		tw.finish()
+	})
+}
+
+// headers applies renames, removals and then the templated values. A value
+// executing to nothing removes the header so clients can't forge it.
+func (mt *messageTransform) headers(h http.Header, claims *authentication.Claims) error {
+	for _, r := range mt.rename {
+		if values := h.Values(r.From); len(values) > 0 {
+			h.Del(r.From)
+			h[http.CanonicalHeaderKey(r.To)] = values
+		}
+	}
+	for _, name := range mt.remove {
+		h.Del(name)
+	}
+	for _, hv := range mt.set {
+		var b strings.Builder
+		if err := hv.value.Execute(&b, claims); err != nil {
+			return err
+		}
+		if b.Len() == 0 {
+			h.Del(hv.name)
+			continue
+		}
+		h.Set(hv.name, b.String())
+	}
+	return nil
+}
+
+// body applies removals, renames and then additions to a JSON document.
+func (mt *messageTransform) body(data []byte, claims *authentication.Claims) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return data, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	for _, p := range mt.drop {
+		doc, _ = removePointer(doc, p)
+	}
+	for _, m := range mt.move {
+		var value any
+		var ok bool
+		if value, ok = getPointer(doc, m.from); !ok {
+			continue
+		}
+		doc, _ = removePointer(doc, m.from)
+		if doc, ok = setPointer(doc, m.to, value); !ok {
+			return nil, fmt.Errorf("can't rename to /%s", strings.Join(m.to, "/"))
+		}
+	}
+	for _, f := range mt.add {
+		value := f.value
+		if tmpl, ok := value.(*template.Template); ok {
+			var b strings.Builder
+			if err := tmpl.Execute(&b, claims); err != nil {
+				return nil, err
+			}
+			value = b.String()
+		}
+		var ok bool
+		if doc, ok = setPointer(doc, f.pointer, value); !ok {
+			return nil, fmt.Errorf("can't add /%s", strings.Join(f.pointer, "/"))
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func arrayIndex(token string, length int) (int, bool) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= length {
+		return 0, false
+	}
+	return i, true
+}
+
+func getPointer(doc any, pointer []string) (any, bool) {
+	for _, token := range pointer {
+		switch node := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = node[token]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, ok := arrayIndex(token, len(node))
+			if !ok {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// setPointer places value at pointer creating missing objects on the way,
+// "-" appends to an array. It returns the possibly replaced document.
+func setPointer(doc any, pointer []string, value any) (any, bool) {
+	if len(pointer) == 0 {
+		return value, true
+	}
+	token, rest := pointer[0], pointer[1:]
+	switch node := doc.(type) {
+	case nil:
+		child, ok := setPointer(nil, rest, value)
+		return map[string]any{token: child}, ok
+	case map[string]any:
+		child, ok := setPointer(node[token], rest, value)
+		node[token] = child
+		return node, ok
+	case []any:
+		if token == "-" {
+			child, ok := setPointer(nil, rest, value)
+			return append(node, child), ok
+		}
+		i, ok := arrayIndex(token, len(node))
+		if !ok {
+			return node, false
+		}
+		node[i], ok = setPointer(node[i], rest, value)
+		return node, ok
+	}
+	return doc, false
+}
+
+func removePointer(doc any, pointer []string) (any, bool) {
+	if len(pointer) == 0 {
+		return doc, false
+	}
+	token, rest := pointer[0], pointer[1:]
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[token]
+		if !ok {
+			return node, false
+		}
+		if len(rest) == 0 {
+			delete(node, token)
+			return node, true
+		}
+		node[token], ok = removePointer(child, rest)
+		return node, ok
+	case []any:
+		i, ok := arrayIndex(token, len(node))
+		if !ok {
+			return node, false
+		}
+		if len(rest) == 0 {
+			return append(node[:i], node[i+1:]...), true
+		}
+		node[i], ok = removePointer(node[i], rest)
+		return node, ok
+	}
+	return doc, false
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// transformWriter edits the response on its way to the client. JSON bodies
+// are held back until the handler is done when fields have to change.
+type transformWriter struct {
+	http.ResponseWriter
+	t        *transformer
+	claims   *authentication.Claims
+	status   int
+	buffer   bool
+	encoded  bool
+	overflow bool
+	body     bytes.Buffer
+}
+
+func (tw *transformWriter) WriteHeader(code int) {
+	if tw.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 {
+		tw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if to, ok := tw.t.status[code]; ok {
+		code = to
+	}
+	tw.status = code
+	h := tw.ResponseWriter.Header()
+	if err := tw.t.response.headers(h, tw.claims); err != nil {
+		log.Printf("transform %s: response headers: %v", tw.t.name, err)
+	}
+	if tw.t.response.hasBody && isJSON(h.Get("Content-Type")) {
+		tw.buffer = true
+		encoding := h.Get("Content-Encoding")
+		tw.encoded = encoding != "" && !strings.EqualFold(encoding, "identity")
+		return
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *transformWriter) Write(b []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.buffer {
+		// Whatever doesn't fit is dropped, finish answers 502 instead.
+		if tw.overflow || int64(tw.body.Len()+len(b)) > tw.t.maxBodyBytes {
+			tw.overflow = true
+			tw.body = bytes.Buffer{}
+			return len(b), nil
+		}
+		return tw.body.Write(b)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush is held back together with the body.
+func (tw *transformWriter) Flush() {
+	if tw.buffer {
+		return
+	}
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *transformWriter) finish() {
+	if !tw.buffer {
+		return
+	}
+	var (
+		body []byte
+		err  error
+	)
+	switch {
+	case tw.overflow:
+		err = fmt.Errorf("response body exceeds %d bytes", tw.t.maxBodyBytes)
+	case tw.encoded:
+		err = fmt.Errorf("response body encoded with %s", tw.ResponseWriter.Header().Get("Content-Encoding"))
+	default:
+		body, err = tw.t.response.body(tw.body.Bytes(), tw.claims)
+	}
+	// The untouched body could carry what the transform was to remove.
+	if err != nil {
+		log.Printf("transform %s: response body: %v", tw.t.name, err)
+		h := tw.ResponseWriter.Header()
+		for k := range h {
+			delete(h, k)
+		}
+		writeError(tw.ResponseWriter, http.StatusBadGateway, "transforming response failed")
+		return
+	}
+	tw.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	tw.ResponseWriter.WriteHeader(tw.status)
+	tw.ResponseWriter.Write(body)
+}
+
+func (tw *transformWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"github.com/swavan.io/gateway/pkg/authentication"
+	"github.com/swavan.io/gateway/pkg/authentication/domain"
+	"github.com/swavan.io/gateway/pkg/identity"
+)
+
+func TestParsePointer(t *testing.T) {
+	for pointer, want := range map[string][]string{
+		"/a":         {"a"},
+		"/a/0/b":     {"a", "0", "b"},
+		"/a~1b/c~0d": {"a/b", "c~d"},
+		"/":          {""},
+	} {
+		got, err := parsePointer(pointer)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, %v, want %v", pointer, got, err, want)
+		}
+	}
+	for _, pointer := range []string{"", "a/b"} {
+		if _, err := parsePointer(pointer); err == nil {
+			t.Errorf("%q accepted", pointer)
+		}
+	}
+}
+
+func TestMessageTransformBody(t *testing.T) {
+	claims := authentication.NewClaims().SetUsername("alice")
+	for _, tc := range []struct {
+		name string
+		cfg  config.BodyTransform
+		in   string
+		want string
+	}{
+		{
+			name: "add",
+			cfg:  config.BodyTransform{Add: []config.Field{{Pointer: "/meta/owner", Value: "{{ .Username }}"}, {Pointer: "/count", Value: 3}}},
+			in:   `{"id":1}`,
+			want: `{"count":3,"id":1,"meta":{"owner":"alice"}}`,
+		},
+		{
+			name: "append",
+			cfg:  config.BodyTransform{Add: []config.Field{{Pointer: "/tags/-", Value: "new"}}},
+			in:   `{"tags":["old"]}`,
+			want: `{"tags":["old","new"]}`,
+		},
+		{
+			name: "remove",
+			cfg:  config.BodyTransform{Remove: []string{"/secret", "/items/0", "/missing"}},
+			in:   `{"secret":"x","items":[1,2]}`,
+			want: `{"items":[2]}`,
+		},
+		{
+			name: "rename",
+			cfg:  config.BodyTransform{Rename: []config.Rename{{From: "/user_name", To: "/user/name"}, {From: "/absent", To: "/there"}}},
+			in:   `{"user_name":"bob"}`,
+			want: `{"user":{"name":"bob"}}`,
+		},
+		{
+			name: "numbers kept",
+			cfg:  config.BodyTransform{Remove: []string{"/a"}},
+			in:   `{"a":1,"big":12345678901234567890}`,
+			want: `{"big":12345678901234567890}`,
+		},
+		{
+			name: "empty body",
+			cfg:  config.BodyTransform{Add: []config.Field{{Pointer: "/a", Value: 1}}},
+			in:   ``,
+			want: ``,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mt, err := newMessageTransform(config.MessageTransform{Body: tc.cfg})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := mt.body([]byte(tc.in), claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("body = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMessageTransformBodyErrors(t *testing.T) {
+	mt, err := newMessageTransform(config.MessageTransform{Body: config.BodyTransform{Add: []config.Field{{Pointer: "/list/5", Value: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mt.body([]byte(`{"list":[]}`), authentication.NewClaims()); err == nil {
+		t.Error("adding past the end of an array accepted")
+	}
+	if _, err := mt.body([]byte(`{"list":`), authentication.NewClaims()); err == nil {
+		t.Error("invalid JSON accepted")
+	}
+	if _, err := newMessageTransform(config.MessageTransform{Body: config.BodyTransform{Remove: []string{"secret"}}}); err == nil {
+		t.Error("invalid pointer accepted")
+	}
+}
+
+func TestMessageTransformHeaders(t *testing.T) {
+	mt, err := newMessageTransform(config.MessageTransform{Headers: config.HeaderTransform{
+		Set: []config.KeyValue{
+			{Name: "X-Domain", Value: "{{ .Domain.ID }}"},
+			{Name: "X-User", Value: "{{ .Username }}"},
+		},
+		Remove: []string{"x-internal"},
+		Rename: []config.Rename{{From: "X-Old", To: "x-new"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.Header{}
+	h.Set("X-Old", "v")
+	h.Set("X-Internal", "secret")
+	h.Set("X-User", "forged")
+	h.Set("X-Domain", "forged")
+	claims := authentication.NewClaims().SetDomain(&domain.Domain{ID: "acme"})
+	if err := mt.headers(h, claims); err != nil {
+		t.Fatal(err)
+	}
+	want := http.Header{"X-New": {"v"}, "X-Domain": {"acme"}}
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("headers = %v, want %v", h, want)
+	}
+}
+
+func TestNewTransformerErrors(t *testing.T) {
+	for name, cfg := range map[string]config.Transform{
+		"header template": {Request: config.MessageTransform{Headers: config.HeaderTransform{Set: []config.KeyValue{{Name: "X", Value: "{{ .Username"}}}}},
+		"body template":   {Response: config.MessageTransform{Body: config.BodyTransform{Add: []config.Field{{Pointer: "/a", Value: "{{"}}}}},
+		"rename pointer":  {Request: config.MessageTransform{Body: config.BodyTransform{Rename: []config.Rename{{From: "/a", To: "b"}}}}},
+		"status":          {Status: map[int]int{502: 42}},
+	} {
+		if _, err := newTransformer(config.Resource{Name: "books", Transform: cfg}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestTransformerWrap(t *testing.T) {
+	tr, err := newTransformer(config.Resource{Name: "books", Transform: config.Transform{
+		Request: config.MessageTransform{
+			Headers: config.HeaderTransform{Set: []config.KeyValue{{Name: "X-User", Value: "{{ .Username }}"}}},
+			Body:    config.BodyTransform{Add: []config.Field{{Pointer: "/owner", Value: "{{ .Username }}"}}},
+		},
+		Response: config.MessageTransform{
+			Headers: config.HeaderTransform{Remove: []string{"Server"}},
+			Body:    config.BodyTransform{Remove: []string{"/internal"}},
+		},
+		Status: map[int]int{http.StatusCreated: http.StatusOK},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream struct {
+		user string
+		body string
+	}
+	h := tr.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream.user, upstream.body = r.Header.Get("X-User"), string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server", "books/1.0")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":7,`)
+		io.WriteString(w, `"internal":true}`)
+	}))
+
+	r := httptest.NewRequest("POST", "/books", strings.NewReader(`{"title":"Dune"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), identity.AuthenticatedUser, authentication.NewClaims().SetUsername("alice")))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if upstream.user != "alice" || upstream.body != `{"owner":"alice","title":"Dune"}` {
+		t.Fatalf("upstream got %q %s", upstream.user, upstream.body)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Server") != "" {
+		t.Fatalf("response %d %v", w.Code, w.Header())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 1 || got["id"] != 7.0 {
+		t.Fatalf("response body %s", w.Body)
+	}
+	if w.Header().Get("Content-Length") != "8" {
+		t.Fatalf("content length %s", w.Header().Get("Content-Length"))
+	}
+}
+
+func TestTransformerResponseRejected(t *testing.T) {
+	tr, err := newTransformer(config.Resource{Name: "books", Transform: config.Transform{
+		Response:     config.MessageTransform{Body: config.BodyTransform{Remove: []string{"/internal"}}},
+		MaxBodyBytes: 32,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		encoding string
+		body     string
+	}{
+		"encoded":   {encoding: "gzip", body: `{"internal":true}`},
+		"invalid":   {body: `{"internal":true`},
+		"too large": {body: `{"internal":true,"title":"` + strings.Repeat("x", 32) + `"}`},
+	} {
+		var acceptEncoding string
+		h := tr.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", tc.encoding)
+			io.WriteString(w, tc.body)
+		}))
+		r := httptest.NewRequest("GET", "/books/1", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if acceptEncoding != "" {
+			t.Errorf("%s: upstream asked for %s", name, acceptEncoding)
+		}
+		if w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "internal") || w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: answered %d %v %s", name, w.Code, w.Header(), w.Body)
+		}
+	}
+}
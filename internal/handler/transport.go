@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newTransport(cfg config.Transport, tlsConfig *tls.Config) *http.Transport {
+	cfg = cfg.SetDefaultIfEmpty()
+	return &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+	}
+}
+
+// NewServer builds the gateway http server with the configured timeouts and
+// TLS settings. Certificates are reloaded from disk until ctx is done.
+func NewServer(ctx context.Context, cfg config.Server, h http.Handler) (*http.Server, error) {
+	cfg = cfg.SetDefaultIfEmpty()
+	if cfg.H2C {
+		h = h2c.NewHandler(h, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	server := &http.Server{
+		Addr:              cfg.Port,
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.TLS.Enabled() {
+		tlsConfig, certs, err := newServerTLS(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = tlsConfig
+		go certs.Watch(ctx)
+	}
+	return server, nil
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/swavan.io/gateway/internal/config"
+)
+
+func TestNewTransport(t *testing.T) {
+	tr := newTransport(config.Transport{
+		DialTimeout:           time.Second,
+		TLSHandshakeTimeout:   2 * time.Second,
+		ResponseHeaderTimeout: 3 * time.Second,
+		IdleConnTimeout:       4 * time.Second,
+		MaxIdleConns:          5,
+		MaxIdleConnsPerHost:   6,
+		MaxConnsPerHost:       7,
+	}, nil)
+	if tr.TLSHandshakeTimeout != 2*time.Second || tr.ResponseHeaderTimeout != 3*time.Second || tr.IdleConnTimeout != 4*time.Second {
+		t.Fatalf("timeouts %v %v %v", tr.TLSHandshakeTimeout, tr.ResponseHeaderTimeout, tr.IdleConnTimeout)
+	}
+	if tr.MaxIdleConns != 5 || tr.MaxIdleConnsPerHost != 6 || tr.MaxConnsPerHost != 7 {
+		t.Fatalf("limits %d %d %d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost)
+	}
+
+	defaults := newTransport(config.Transport{}, nil)
+	if defaults.TLSHandshakeTimeout != 10*time.Second || defaults.IdleConnTimeout != 90*time.Second || defaults.MaxIdleConns != 100 {
+		t.Fatalf("defaults %+v", defaults)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		io.WriteString(w, "late")
+	}
+	for _, protocol := range []string{ProtocolHTTP, ProtocolHTTP2} {
+		upstream := h2cServer(t, slow)
+		resource := resourceTo("books", "/books/*", upstream.URL)
+		resource.Protocol = protocol
+		resource.Transport.ResponseHeaderTimeout = 50 * time.Millisecond
+		rv, err := NewReverseProxy(resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		begin := time.Now()
+		if code, _ := get(t, rv, "/books/1"); code != http.StatusGatewayTimeout {
+			t.Errorf("%s: slow upstream answered %d", protocol, code)
+		}
+		if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+			t.Errorf("%s: gave up after %v", protocol, elapsed)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	upstream := h2cServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	resource := resourceTo("books", "/books/*", upstream.URL)
+	resource.Transport.RequestTimeout = 50 * time.Millisecond
+	rv, err := NewReverseProxy(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(t, rv, "/books/1"); code != http.StatusGatewayTimeout {
+		t.Fatalf("hanging upstream answered %d", code)
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	release := make(chan struct{})
+	requests := make(chan struct{}, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	resource := resourceTo("books", "/books/*", upstream.URL)
+	resource.Transport.MaxConnsPerHost = 1
+	rv, err := NewReverseProxy(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		go rv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/books/1", nil).WithContext(ctx))
+	}
+	// Further requests queue for the only connection.
+	time.Sleep(200 * time.Millisecond)
+	n := len(requests)
+	close(release)
+	if n != 1 {
+		t.Fatalf("%d requests reached the upstream at once", n)
+	}
+}
@@ -0,0 +1,143 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type Config struct {
+	// Drain is how long the server keeps serving after reporting itself
+	// unhealthy, so load balancers stop routing to it first.
+	Drain time.Duration `mapstructure:"drain"`
+	// Timeout bounds the wait for in-flight requests once the listener is
+	// closed.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func (c Config) SetDefaultIfEmpty() Config {
+	if c.Drain <= 0 {
+		c.Drain = 5 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	return c
+}
+
+type closer struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+// Lifecycle serves an http.Server until SIGINT or SIGTERM and then shuts it
+// down in order: drain hooks, drain period, connection draining, timeout
+// hooks when the draining took too long, closers.
+type Lifecycle struct {
+	cfg     Config
+	drain   []func()
+	awaits  []func(ctx context.Context) error
+	timeout []func()
+	closers []closer
+}
+
+func New(cfg Config) *Lifecycle {
+	return &Lifecycle{cfg: cfg.SetDefaultIfEmpty()}
+}
+
+// OnDrain registers f to run as soon as the shutdown starts, e.g. to fail
+// health checks.
+func (l *Lifecycle) OnDrain(f func()) *Lifecycle {
+	l.drain = append(l.drain, f)
+	return l
+}
+
+// Await registers f to be waited for along with the in-flight requests, for
+// work net/http doesn't track such as hijacked connections. f returns once
+// the work is done or with the error of ctx.
+func (l *Lifecycle) Await(f func(ctx context.Context) error) *Lifecycle {
+	l.awaits = append(l.awaits, f)
+	return l
+}
+
+// OnTimeout registers f to run when the draining outlasts Timeout, right
+// before the remaining connections are closed.
+func (l *Lifecycle) OnTimeout(f func()) *Lifecycle {
+	l.timeout = append(l.timeout, f)
+	return l
+}
+
+// OnClose registers f to run after the server stopped, in registration order.
+func (l *Lifecycle) OnClose(name string, f func(ctx context.Context) error) *Lifecycle {
+	l.closers = append(l.closers, closer{name, f})
+	return l
+}
+
+// Run calls serve, usually server.ListenAndServe, and blocks until the
+// server is shut down. A second signal stops the process right away.
+func (l *Lifecycle) Run(ctx context.Context, server *http.Server, serve func() error) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve()
+	}()
+
+	select {
+	case err := <-errc:
+		l.close()
+		return err
+	case <-ctx.Done():
+		stop()
+	}
+
+	log.Printf("shutting down, draining for %v", l.cfg.Drain)
+	for _, f := range l.drain {
+		f()
+	}
+	time.Sleep(l.cfg.Drain)
+
+	shutdown, cancel := context.WithTimeout(context.Background(), l.cfg.Timeout)
+	defer cancel()
+	err := server.Shutdown(shutdown)
+	for _, f := range l.awaits {
+		if awaitErr := f(shutdown); err == nil {
+			err = awaitErr
+		}
+	}
+	if err != nil {
+		log.Printf("requests still in flight after %v, closing their connections: %v", l.cfg.Timeout, err)
+		if shutdown.Err() != nil {
+			for _, f := range l.timeout {
+				f()
+			}
+		}
+		server.Close()
+	}
+	if serveErr := <-errc; !errors.Is(serveErr, http.ErrServerClosed) {
+		err = errors.Join(err, serveErr)
+	}
+	l.close()
+	return err
+}
+
+func (l *Lifecycle) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.cfg.Timeout)
+	defer cancel()
+	for _, c := range l.closers {
+		if err := c.close(ctx); err != nil {
+			log.Printf("closing %s failed: %v", c.name, err)
+		}
+	}
+	log.Printf("shutdown complete")
+	// The standard logger doesn't buffer, files still need a sync.
+	if f, ok := log.Writer().(interface{ Sync() error }); ok {
+		f.Sync()
+	}
+}
@@ -0,0 +1,209 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// events records what happened in which order.
+type events struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (e *events) add(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, event)
+}
+
+func (e *events) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.list)
+}
+
+// start runs l with server in the background, cancelling the returned
+// context starts the shutdown.
+func start(t *testing.T, l *Lifecycle, handler http.Handler) (url string, shutdown context.CancelFunc, done <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.Run(ctx, server, func() error { return server.Serve(ln) })
+	}()
+	t.Cleanup(cancel)
+	return "http://" + ln.Addr().String(), cancel, errc
+}
+
+func wait(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish")
+		return nil
+	}
+}
+
+func TestRunShutdownOrder(t *testing.T) {
+	var ev events
+	release := make(chan struct{})
+	l := New(Config{Drain: 50 * time.Millisecond, Timeout: time.Second}).
+		OnDrain(func() { ev.add("drain") }).
+		Await(func(ctx context.Context) error {
+			ev.add("await")
+			return nil
+		}).
+		OnTimeout(func() { ev.add("timeout") }).
+		OnClose("first", func(context.Context) error {
+			ev.add("close first")
+			return nil
+		}).
+		OnClose("second", func(context.Context) error {
+			ev.add("close second")
+			return errors.New("closing failed")
+		}).
+		OnClose("third", func(context.Context) error {
+			ev.add("close third")
+			return nil
+		})
+	url, shutdown, done := start(t, l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "finished")
+	}))
+
+	// The request in flight is let finish within the timeout.
+	answered := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			answered <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		answered <- string(body)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	shutdown()
+	time.Sleep(100 * time.Millisecond)
+	ev.add("request done")
+	close(release)
+
+	if err := wait(t, done); err != nil {
+		t.Fatalf("run returned %v", err)
+	}
+	if body := <-answered; body != "finished" {
+		t.Fatalf("in-flight request got %q", body)
+	}
+	want := []string{"drain", "request done", "await", "close first", "close second", "close third"}
+	if got := ev.get(); !slices.Equal(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+}
+
+func TestRunDrainKeepsServing(t *testing.T) {
+	drained := make(chan struct{})
+	l := New(Config{Drain: 300 * time.Millisecond, Timeout: time.Second}).
+		OnDrain(func() { close(drained) })
+	url, shutdown, done := start(t, l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	shutdown()
+	<-drained
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request while draining: %v", err)
+	}
+	resp.Body.Close()
+	if err := wait(t, done); err != nil {
+		t.Fatalf("run returned %v", err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	var ev events
+	l := New(Config{Drain: time.Millisecond, Timeout: 100 * time.Millisecond}).
+		OnTimeout(func() { ev.add("timeout") }).
+		OnClose("store", func(context.Context) error {
+			ev.add("close")
+			return nil
+		})
+	url, shutdown, done := start(t, l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	begin := time.Now()
+	shutdown()
+
+	if err := wait(t, done); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("run returned %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	if err := <-failed; err == nil {
+		t.Fatal("hanging request answered")
+	}
+	if got, want := ev.get(), []string{"timeout", "close"}; !slices.Equal(got, want) {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+}
+
+func TestRunAwaitTimeout(t *testing.T) {
+	var ev events
+	l := New(Config{Drain: time.Millisecond, Timeout: 100 * time.Millisecond}).
+		Await(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		OnTimeout(func() { ev.add("timeout") })
+	_, shutdown, done := start(t, l, http.NotFoundHandler())
+
+	shutdown()
+	if err := wait(t, done); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("run returned %v", err)
+	}
+	if got := ev.get(); !slices.Equal(got, []string{"timeout"}) {
+		t.Fatalf("events %v", got)
+	}
+}
+
+func TestRunServeError(t *testing.T) {
+	closed := false
+	l := New(Config{}).
+		OnDrain(func() { t.Error("drained without shutdown") }).
+		OnClose("store", func(context.Context) error {
+			closed = true
+			return nil
+		})
+	failure := errors.New("listen failed")
+	err := l.Run(context.Background(), &http.Server{}, func() error { return failure })
+	if !errors.Is(err, failure) || !closed {
+		t.Fatalf("run returned %v, closed %v", err, closed)
+	}
+}
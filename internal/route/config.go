@@ -0,0 +1,105 @@
+package route
+
+import "time"
+
+type Config struct {
+	Refresh   time.Duration `mapstructure:"refresh"`
+	Migration struct {
+		Run     bool     `mapstructure:"run"`
+		Scripts []string `mapstructure:"scripts"`
+	} `mapstructure:"migration"`
+	Scripts struct {
+		FetchAll   string `mapstructure:"fetch_all"`
+		FetchByID  string `mapstructure:"fetch_by_id"`
+		Create     string `mapstructure:"save"`
+		UpdateByID string `mapstructure:"update_by_id"`
+		DeleteByID string `mapstructure:"delete_by_id"`
+	} `mapstructure:"scripts"`
+}
+
+func (c *Config) SetDefaultIfEmpty() *Config {
+	if c.Migration.Run {
+		if len(c.Migration.Scripts) == 0 {
+			c.Migration.Scripts = []string{
+				`
+					CREATE TABLE IF NOT EXISTS route_store (
+					id VARCHAR(255) PRIMARY KEY,
+					name VARCHAR(255) NOT NULL UNIQUE,
+					endpoint VARCHAR(255) NOT NULL,
+					destinations TEXT NOT NULL DEFAULT '[]',
+					authenticated BOOLEAN NOT NULL DEFAULT TRUE,
+					active BOOLEAN NOT NULL DEFAULT TRUE,
+					modifier VARCHAR(255) NOT NULL DEFAULT '',
+					created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+					updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+				`}
+		}
+	}
+
+	sqlSelect := `
+		SELECT
+			id,
+			name,
+			endpoint,
+			destinations,
+			authenticated,
+			active,
+			modifier,
+			created_at,
+			updated_at
+		FROM
+			route_store`
+
+	if c.Scripts.FetchAll == "" {
+		c.Scripts.FetchAll = sqlSelect + `
+		ORDER BY
+			created_at`
+	}
+	if c.Scripts.FetchByID == "" {
+		c.Scripts.FetchByID = sqlSelect + `
+		WHERE
+			id = $1
+		LIMIT 1`
+	}
+	if c.Scripts.Create == "" {
+		c.Scripts.Create = `
+		INSERT INTO route_store (
+			id,
+			name,
+			endpoint,
+			destinations,
+			authenticated,
+			active,
+			modifier)
+		VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7)`
+	}
+	if c.Scripts.UpdateByID == "" {
+		c.Scripts.UpdateByID = `
+		UPDATE route_store
+		SET
+			name = $2,
+			endpoint = $3,
+			destinations = $4,
+			authenticated = $5,
+			active = $6,
+			modifier = $7,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+	}
+	if c.Scripts.DeleteByID == "" {
+		c.Scripts.DeleteByID = `
+		DELETE
+			FROM
+		route_store
+			WHERE
+		id = $1`
+	}
+	return c
+}
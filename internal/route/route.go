@@ -0,0 +1,222 @@
+package route
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrNotFound is returned when changing a route that doesn't exist.
+var ErrNotFound = errors.New("route not found")
+
+type Destination struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Destinations is stored as a JSON document in the route_store table.
+type Destinations []Destination
+
+func (d Destinations) Value() (driver.Value, error) {
+	if d == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(d)
+	return string(b), err
+}
+
+func (d *Destinations) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	case []byte:
+		return json.Unmarshal(v, d)
+	case nil:
+		*d = Destinations{}
+		return nil
+	}
+	return errors.New("unsupported destinations value")
+}
+
+type Route struct {
+	ID            string       `json:"id" db:"id"`
+	Name          string       `json:"name" db:"name"`
+	Endpoint      string       `json:"endpoint" db:"endpoint"`
+	Destinations  Destinations `json:"destinations" db:"destinations"`
+	Authenticated bool         `json:"authenticated" db:"authenticated"`
+	Active        bool         `json:"active" db:"active"`
+	Modifier      string       `json:"modifier" db:"modifier"`
+	CreatedAt     string       `json:"created_at" db:"created_at"`
+	UpdatedAt     string       `json:"updated_at" db:"updated_at"`
+}
+
+func NewRoute() *Route {
+	return &Route{
+		Destinations:  Destinations{},
+		Authenticated: true,
+		Active:        true,
+	}
+}
+
+func (r *Route) IsNew() bool {
+	return r.ID == ""
+}
+
+func (r *Route) SetID(id string) *Route {
+	r.ID = id
+	return r
+}
+
+func (r *Route) SetName(name string) *Route {
+	r.Name = name
+	return r
+}
+
+func (r *Route) SetEndpoint(endpoint string) *Route {
+	r.Endpoint = endpoint
+	return r
+}
+
+func (r *Route) SetDestinations(destinations ...Destination) *Route {
+	r.Destinations = destinations
+	return r
+}
+
+func (r *Route) SetAuthenticated(authenticated bool) *Route {
+	r.Authenticated = authenticated
+	return r
+}
+
+func (r *Route) SetActive(active bool) *Route {
+	r.Active = active
+	return r
+}
+
+func (r *Route) SetModifier(modifier string) *Route {
+	r.Modifier = modifier
+	return r
+}
+
+type RouteAPI interface {
+	Migration(ctx context.Context) error
+	All(ctx context.Context) ([]Route, error)
+	Find(ctx context.Context, id string) (*Route, error)
+	Save(ctx context.Context, route *Route) error
+	Delete(ctx context.Context, id string) error
+	Config() *Config
+}
+
+type RouteService struct {
+	database *sqlx.DB
+	cfg      *Config
+}
+
+// Config implements RouteAPI.
+func (rs *RouteService) Config() *Config {
+	return rs.cfg
+}
+
+// Migration implements RouteAPI.
+func (rs *RouteService) Migration(ctx context.Context) error {
+	if !rs.cfg.Migration.Run {
+		return nil
+	}
+	for _, script := range rs.cfg.Migration.Scripts {
+		_, err := rs.database.ExecContext(ctx, script)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// All implements RouteAPI.
+func (rs *RouteService) All(ctx context.Context) ([]Route, error) {
+	routes := []Route{}
+	err := rs.database.SelectContext(
+		ctx,
+		&routes,
+		rs.cfg.Scripts.FetchAll)
+	return routes, err
+}
+
+// Find implements RouteAPI.
+func (rs *RouteService) Find(ctx context.Context, id string) (*Route, error) {
+	route := NewRoute()
+	err := rs.database.GetContext(
+		ctx,
+		route,
+		rs.cfg.Scripts.FetchByID,
+		id)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return route, err
+}
+
+// Save implements RouteAPI, routes without an id are created. ErrNotFound
+// tells the id of an update is unknown.
+func (rs *RouteService) Save(ctx context.Context, route *Route) error {
+	script := rs.cfg.Scripts.UpdateByID
+	if route.IsNew() {
+		route.SetID(uuid.New().String())
+		script = rs.cfg.Scripts.Create
+	}
+	result, err := rs.database.ExecContext(
+		ctx,
+		script,
+		route.ID,
+		route.Name,
+		route.Endpoint,
+		route.Destinations,
+		route.Authenticated,
+		route.Active,
+		route.Modifier,
+	)
+	if err != nil {
+		return err
+	}
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete implements RouteAPI, ErrNotFound tells the id is unknown.
+func (rs *RouteService) Delete(ctx context.Context, id string) error {
+	result, err := rs.database.ExecContext(
+		ctx,
+		rs.cfg.Scripts.DeleteByID,
+		id)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func New(database *sqlx.DB, cfg *Config) (RouteAPI, error) {
+	rs := &RouteService{
+		database: database,
+		cfg:      cfg.SetDefaultIfEmpty(),
+	}
+	if err := rs.Migration(context.Background()); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
@@ -10,9 +10,13 @@ import (
 	"github.com/swavan.io/gateway/pkg/authentication/domain"
 	"github.com/swavan.io/gateway/pkg/authentication/key"
 	"github.com/swavan.io/gateway/pkg/authentication/oidc"
+	"github.com/swavan.io/gateway/pkg/authentication/refresh"
 	"github.com/swavan.io/gateway/pkg/authentication/resource"
+	"github.com/swavan.io/gateway/pkg/authentication/revocation"
 	"github.com/swavan.io/gateway/pkg/authentication/role"
+	"github.com/swavan.io/gateway/pkg/authentication/salt"
 	"github.com/swavan.io/gateway/pkg/authentication/secret"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
 	"github.com/swavan.io/gateway/pkg/authentication/user"
 
 	"github.com/google/uuid"
@@ -27,19 +31,25 @@ type AuthenticationAPI interface {
 	Secret() secret.SecretAPI
 	Access() access.API
 	OIDC() oidc.OauthClients
+	Refresh() refresh.RefreshAPI
+	Revocation() revocation.RevocationAPI
+	Session() session.SessionAPI
 	Config() *AuthConfig
 }
 
 type Authentication struct {
-	resource resource.ResourceAPI
-	role     role.RoleAPI
-	domain   domain.DomainAPI
-	user     user.UserAPI
-	access   access.API
-	secret   secret.SecretAPI
-	oidc     oidc.OauthClients
-	cfg      *AuthConfig
-	key      key.KeyManagerAPI
+	resource   resource.ResourceAPI
+	role       role.RoleAPI
+	domain     domain.DomainAPI
+	user       user.UserAPI
+	access     access.API
+	secret     secret.SecretAPI
+	oidc       oidc.OauthClients
+	refresh    refresh.RefreshAPI
+	revocation revocation.RevocationAPI
+	session    session.SessionAPI
+	cfg        *AuthConfig
+	key        key.KeyManagerAPI
 }
 
 // Token implements AuthenticationAPI.
@@ -77,6 +87,21 @@ func (a *Authentication) OIDC() oidc.OauthClients {
 	return a.oidc
 }
 
+// Refresh implements AuthenticationAPI.
+func (a *Authentication) Refresh() refresh.RefreshAPI {
+	return a.refresh
+}
+
+// Revocation implements AuthenticationAPI.
+func (a *Authentication) Revocation() revocation.RevocationAPI {
+	return a.revocation
+}
+
+// Session implements AuthenticationAPI.
+func (a *Authentication) Session() session.SessionAPI {
+	return a.session
+}
+
 // Config implements AuthenticationAPI.
 func (a *Authentication) Config() *AuthConfig {
 	return a.cfg
@@ -132,6 +157,21 @@ func New(dep *sqlx.DB, configs ...*AuthConfig) (AuthenticationAPI, error) {
 		return nil, err
 	}
 
+	rt, err := refresh.New(dep, &cfg.RefreshConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rv, err := revocation.New(dep, &cfg.RevocationConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ss, err := session.New(dep, &cfg.SessionConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := CreateUsers(usr, cfg); err != nil {
 		return nil, err
 	}
@@ -141,15 +181,18 @@ func New(dep *sqlx.DB, configs ...*AuthConfig) (AuthenticationAPI, error) {
 	}
 
 	auth := &Authentication{
-		user:     usr,
-		resource: res,
-		role:     rl,
-		domain:   dm,
-		access:   access,
-		oidc:     oidc,
-		cfg:      cfg,
-		key:      key,
-		secret:   sec,
+		user:       usr,
+		resource:   res,
+		role:       rl,
+		domain:     dm,
+		access:     access,
+		oidc:       oidc,
+		cfg:        cfg,
+		key:        key,
+		secret:     sec,
+		refresh:    rt,
+		revocation: rv,
+		session:    ss,
 	}
 
 	return auth, nil
@@ -168,7 +211,11 @@ func CreateUsers(usr user.UserAPI, cfg *AuthConfig) error {
 			return err
 		}
 
-		if err := usr.ChangePassword(context.Background(), newUser.Username, u.Password); err != nil {
+		password, err := salt.HashPassword(u.Password)
+		if err != nil {
+			return err
+		}
+		if err := usr.ChangePassword(context.Background(), newUser.Username, password); err != nil {
 			return err
 		}
 	}
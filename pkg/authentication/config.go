@@ -7,25 +7,31 @@ import (
 	"github.com/swavan.io/gateway/pkg/authentication/domain"
 	"github.com/swavan.io/gateway/pkg/authentication/key"
 	"github.com/swavan.io/gateway/pkg/authentication/oidc"
+	"github.com/swavan.io/gateway/pkg/authentication/refresh"
 	"github.com/swavan.io/gateway/pkg/authentication/resource"
+	"github.com/swavan.io/gateway/pkg/authentication/revocation"
 	"github.com/swavan.io/gateway/pkg/authentication/role"
 	"github.com/swavan.io/gateway/pkg/authentication/secret"
+	"github.com/swavan.io/gateway/pkg/authentication/session"
 	"github.com/swavan.io/gateway/pkg/authentication/user"
 )
 
 type AuthConfig struct {
-	Confidential   string               `mapstructure:"confidential"`
-	Migration      bool                 `mapstructure:"migration"`
-	OpenIDConnects []oidc.OpenIDConnect `mapstructure:"oidc"`
-	AccessConfig   access.Config        `mapstructure:"access"`
-	KeyConfig      key.Config           `mapstructure:"key"`
-	DomainConfig   domain.Config        `mapstructure:"domain"`
-	RoleConfig     role.Config          `mapstructure:"role"`
-	UserConfig     user.Config          `mapstructure:"user"`
-	ResourceConfig resource.Config      `mapstructure:"resource"`
-	SecretConfig   secret.Config        `mapstructure:"secret"`
-	IgnoreAccess   []string             `mapstructure:"ignore_access"`
-	SuperAdmins    []struct {
+	Confidential     string               `mapstructure:"confidential"`
+	Migration        bool                 `mapstructure:"migration"`
+	OpenIDConnects   []oidc.OpenIDConnect `mapstructure:"oidc"`
+	AccessConfig     access.Config        `mapstructure:"access"`
+	KeyConfig        key.Config           `mapstructure:"key"`
+	DomainConfig     domain.Config        `mapstructure:"domain"`
+	RoleConfig       role.Config          `mapstructure:"role"`
+	UserConfig       user.Config          `mapstructure:"user"`
+	ResourceConfig   resource.Config      `mapstructure:"resource"`
+	SecretConfig     secret.Config        `mapstructure:"secret"`
+	RefreshConfig    refresh.Config       `mapstructure:"refresh"`
+	RevocationConfig revocation.Config    `mapstructure:"revocation"`
+	SessionConfig    session.Config       `mapstructure:"session"`
+	IgnoreAccess     []string             `mapstructure:"ignore_access"`
+	SuperAdmins      []struct {
 		Domain   string   `mapstructure:"domain"`
 		Resource string   `mapstructure:"resource"`
 		Role     string   `mapstructure:"role"`
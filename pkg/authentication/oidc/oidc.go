@@ -2,6 +2,7 @@ package oidc
 
 import (
 	"context"
+	"slices"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -73,12 +74,17 @@ func newProvider(ctx context.Context, issuerURL string) (*oidc.Provider, error)
 }
 
 func newAuthConfig(cfg OpenIDConnect, provider *oidc.Provider) oauth2.Config {
+	scopes := cfg.Scopes
+	// Without the openid scope providers answer with no ID token.
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
 	return oauth2.Config{
 		ClientID:     cfg.ClientID,
 		ClientSecret: cfg.Secret,
 		Endpoint:     provider.Endpoint(),
 		RedirectURL:  cfg.RedirectURL,
-		Scopes:       cfg.Scopes,
+		Scopes:       scopes,
 	}
 }
 
@@ -0,0 +1,100 @@
+package refresh
+
+type Config struct {
+	Migration struct {
+		Run     bool     `mapstructure:"run"`
+		Scripts []string `mapstructure:"scripts"`
+	}
+	Scripts struct {
+		FetchByID     string `mapstructure:"fetch_by_id"`
+		Save          string `mapstructure:"save"`
+		Use           string `mapstructure:"use"`
+		RevokeFamily  string `mapstructure:"revoke_family"`
+		RevokeUser    string `mapstructure:"revoke_user"`
+		DeleteExpired string `mapstructure:"delete_expired"`
+	} `mapstructure:"scripts"`
+}
+
+func (c *Config) SetDefaultIfEmpty() *Config {
+	if c.Migration.Run {
+		if len(c.Migration.Scripts) == 0 {
+			c.Migration.Scripts = []string{
+				`
+					CREATE TABLE IF NOT EXISTS refresh_token_store (
+						id VARCHAR(255) PRIMARY KEY,
+						family_id VARCHAR(255) NOT NULL,
+						parent_id VARCHAR(255) NOT NULL DEFAULT '',
+						user_name VARCHAR(255) NOT NULL,
+						expires_at TIMESTAMP NOT NULL,
+						used BOOLEAN NOT NULL DEFAULT FALSE,
+						revoked BOOLEAN NOT NULL DEFAULT FALSE,
+						created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+					);
+				`,
+				`CREATE INDEX IF NOT EXISTS refresh_token_store_family_id ON refresh_token_store (family_id);`,
+				`CREATE INDEX IF NOT EXISTS refresh_token_store_user_name ON refresh_token_store (user_name);`,
+			}
+		}
+	}
+
+	sqlSelect := `
+	SELECT
+		id,
+		family_id,
+		parent_id,
+		user_name,
+		expires_at,
+		used,
+		revoked,
+		created_at
+	FROM
+		refresh_token_store`
+
+	if c.Scripts.FetchByID == "" {
+		c.Scripts.FetchByID = sqlSelect + `
+		WHERE
+			id=$1`
+	}
+	if c.Scripts.Save == "" {
+		c.Scripts.Save = `
+		INSERT INTO refresh_token_store (
+			id,
+			family_id,
+			parent_id,
+			user_name,
+			expires_at)
+		VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5)`
+	}
+	if c.Scripts.Use == "" {
+		c.Scripts.Use = `
+		UPDATE refresh_token_store
+		SET
+			used=TRUE
+		WHERE
+			id=$1 AND used=FALSE AND revoked=FALSE
+		RETURNING
+			id,
+			family_id,
+			parent_id,
+			user_name,
+			expires_at,
+			used,
+			revoked,
+			created_at`
+	}
+	if c.Scripts.RevokeFamily == "" {
+		c.Scripts.RevokeFamily = "UPDATE refresh_token_store SET revoked=TRUE WHERE family_id=$1"
+	}
+	if c.Scripts.RevokeUser == "" {
+		c.Scripts.RevokeUser = "UPDATE refresh_token_store SET revoked=TRUE WHERE user_name=$1"
+	}
+	if c.Scripts.DeleteExpired == "" {
+		c.Scripts.DeleteExpired = "DELETE FROM refresh_token_store WHERE expires_at < $1"
+	}
+	return c
+}
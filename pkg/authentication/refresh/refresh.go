@@ -0,0 +1,175 @@
+package refresh
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrReused is returned for a refresh token presented after it was already
+// exchanged, its whole family gets revoked.
+var ErrReused = errors.New("refresh token reused")
+
+// ErrInvalid is returned for unknown, revoked and expired refresh tokens.
+var ErrInvalid = errors.New("invalid refresh token")
+
+type RefreshAPI interface {
+	Migration(ctx context.Context) error
+	Find(ctx context.Context, id string) (*RefreshToken, error)
+	Save(ctx context.Context, token *RefreshToken) error
+	Use(ctx context.Context, id string) (*RefreshToken, error)
+	RevokeFamily(ctx context.Context, family string) error
+	RevokeUser(ctx context.Context, username string) error
+	DeleteExpired(ctx context.Context) error
+}
+
+// RefreshToken is one link of a rotation chain. Every login starts a new
+// family, every refresh adds a child of the token it used.
+type RefreshToken struct {
+	ID        string    `json:"id" db:"id"`
+	Family    string    `json:"family_id" db:"family_id"`
+	Parent    string    `json:"parent_id" db:"parent_id"`
+	Username  string    `json:"username" db:"user_name"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	Used      bool      `json:"used" db:"used"`
+	Revoked   bool      `json:"revoked" db:"revoked"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func NewRefreshToken() *RefreshToken {
+	return &RefreshToken{}
+}
+
+func (t *RefreshToken) SetID(id string) *RefreshToken {
+	t.ID = id
+	return t
+}
+
+func (t *RefreshToken) SetFamily(family string) *RefreshToken {
+	t.Family = family
+	return t
+}
+
+func (t *RefreshToken) SetParent(parent string) *RefreshToken {
+	t.Parent = parent
+	return t
+}
+
+func (t *RefreshToken) SetUsername(username string) *RefreshToken {
+	t.Username = username
+	return t
+}
+
+func (t *RefreshToken) SetExpiresAt(expiresAt time.Time) *RefreshToken {
+	t.ExpiresAt = expiresAt
+	return t
+}
+
+type RefreshService struct {
+	database *sqlx.DB
+	cfg      *Config
+}
+
+func New(dep *sqlx.DB, cfg *Config) (RefreshAPI, error) {
+	rs := &RefreshService{
+		database: dep,
+		cfg:      cfg.SetDefaultIfEmpty(),
+	}
+	if err := rs.Migration(context.Background()); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Migration implements RefreshAPI.
+func (rs *RefreshService) Migration(ctx context.Context) error {
+	if !rs.cfg.Migration.Run {
+		return nil
+	}
+	for _, script := range rs.cfg.Migration.Scripts {
+		if _, err := rs.database.ExecContext(ctx, script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find implements RefreshAPI.
+func (rs *RefreshService) Find(ctx context.Context, id string) (*RefreshToken, error) {
+	token := NewRefreshToken()
+	err := rs.database.
+		GetContext(
+			ctx,
+			token,
+			rs.cfg.Scripts.FetchByID,
+			id)
+	return token, err
+}
+
+// Save implements RefreshAPI.
+func (rs *RefreshService) Save(ctx context.Context, token *RefreshToken) error {
+	_, err := rs.database.ExecContext(ctx, rs.cfg.Scripts.Save,
+		token.ID,
+		token.Family,
+		token.Parent,
+		token.Username,
+		// The column has no time zone, expiries are kept in UTC.
+		token.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// Use implements RefreshAPI. It marks the token used in a single statement
+// so concurrent refreshes can't both succeed, and revokes the family when
+// the token was used before. Expiry is checked on the token itself.
+func (rs *RefreshService) Use(ctx context.Context, id string) (*RefreshToken, error) {
+	token := NewRefreshToken()
+	err := rs.database.
+		GetContext(
+			ctx,
+			token,
+			rs.cfg.Scripts.Use,
+			id)
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	token, err = rs.Find(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if token.Used && !token.Revoked {
+		if err := rs.RevokeFamily(ctx, token.Family); err != nil {
+			return nil, err
+		}
+		return token, ErrReused
+	}
+	return nil, ErrInvalid
+}
+
+// RevokeFamily implements RefreshAPI.
+func (rs *RefreshService) RevokeFamily(ctx context.Context, family string) error {
+	_, err := rs.database.ExecContext(ctx, rs.cfg.Scripts.RevokeFamily, family)
+	return err
+}
+
+// RevokeUser implements RefreshAPI.
+func (rs *RefreshService) RevokeUser(ctx context.Context, username string) error {
+	_, err := rs.database.ExecContext(ctx, rs.cfg.Scripts.RevokeUser, username)
+	return err
+}
+
+// DeleteExpired implements RefreshAPI.
+func (rs *RefreshService) DeleteExpired(ctx context.Context) error {
+	_, err := rs.database.ExecContext(ctx, rs.cfg.Scripts.DeleteExpired, time.Now().UTC())
+	return err
+}
@@ -0,0 +1,68 @@
+package revocation
+
+type Config struct {
+	Migration struct {
+		Run     bool     `mapstructure:"run"`
+		Scripts []string `mapstructure:"scripts"`
+	}
+	Scripts struct {
+		FetchActive   string `mapstructure:"fetch_active"`
+		Save          string `mapstructure:"save"`
+		DeleteExpired string `mapstructure:"delete_expired"`
+	} `mapstructure:"scripts"`
+}
+
+func (c *Config) SetDefaultIfEmpty() *Config {
+	if c.Migration.Run {
+		if len(c.Migration.Scripts) == 0 {
+			c.Migration.Scripts = []string{
+				`
+					CREATE TABLE IF NOT EXISTS revocation_store (
+						id VARCHAR(255) NOT NULL,
+						kind VARCHAR(16) NOT NULL,
+						user_name VARCHAR(255) NOT NULL DEFAULT '',
+						revoked_at TIMESTAMP NOT NULL,
+						expires_at TIMESTAMP NOT NULL,
+						PRIMARY KEY (kind, id)
+					);
+				`}
+		}
+	}
+
+	if c.Scripts.FetchActive == "" {
+		c.Scripts.FetchActive = `
+		SELECT
+			id,
+			kind,
+			user_name,
+			revoked_at,
+			expires_at
+		FROM
+			revocation_store
+		WHERE
+			expires_at > $1`
+	}
+	if c.Scripts.Save == "" {
+		c.Scripts.Save = `
+		INSERT INTO revocation_store (
+			id,
+			kind,
+			user_name,
+			revoked_at,
+			expires_at)
+		VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5)
+		ON CONFLICT (kind, id) DO UPDATE
+		SET
+			revoked_at=GREATEST(revocation_store.revoked_at, $4),
+			expires_at=GREATEST(revocation_store.expires_at, $5)`
+	}
+	if c.Scripts.DeleteExpired == "" {
+		c.Scripts.DeleteExpired = "DELETE FROM revocation_store WHERE expires_at < $1"
+	}
+	return c
+}
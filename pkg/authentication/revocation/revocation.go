@@ -0,0 +1,141 @@
+package revocation
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// KindToken revokes the token whose jti is the ID.
+	KindToken = "token"
+	// KindUser revokes every token of the user, the ID, issued up to
+	// RevokedAt.
+	KindUser = "user"
+	// KindSession revokes every token issued for the session, the ID.
+	KindSession = "session"
+)
+
+type RevocationAPI interface {
+	Migration(ctx context.Context) error
+	Save(ctx context.Context, revocation *Revocation) error
+	Active(ctx context.Context) ([]Revocation, error)
+	DeleteExpired(ctx context.Context) error
+}
+
+// Revocation is kept until ExpiresAt, by then the tokens it covers have
+// expired on their own.
+type Revocation struct {
+	ID        string    `json:"id" db:"id"`
+	Kind      string    `json:"kind" db:"kind"`
+	Username  string    `json:"username" db:"user_name"`
+	RevokedAt time.Time `json:"revoked_at" db:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// NewTokenRevocation revokes a single token until it expires.
+func NewTokenRevocation(jti, username string, expiresAt time.Time) *Revocation {
+	return &Revocation{
+		ID:        jti,
+		Kind:      KindToken,
+		Username:  username,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+}
+
+// NewSessionRevocation revokes the tokens of a session, ttl is the longest
+// lifetime any of them can have.
+func NewSessionRevocation(id, username string, ttl time.Duration) *Revocation {
+	now := time.Now()
+	return &Revocation{
+		ID:        id,
+		Kind:      KindSession,
+		Username:  username,
+		RevokedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// NewUserRevocation revokes the tokens a user holds now, ttl is the longest
+// lifetime any of them can have.
+func NewUserRevocation(username string, ttl time.Duration) *Revocation {
+	now := time.Now()
+	return &Revocation{
+		ID:        username,
+		Kind:      KindUser,
+		Username:  username,
+		RevokedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+type RevocationService struct {
+	database *sqlx.DB
+	cfg      *Config
+}
+
+func New(dep *sqlx.DB, cfg *Config) (RevocationAPI, error) {
+	rs := &RevocationService{
+		database: dep,
+		cfg:      cfg.SetDefaultIfEmpty(),
+	}
+	if err := rs.Migration(context.Background()); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Migration implements RevocationAPI.
+func (rs *RevocationService) Migration(ctx context.Context) error {
+	if !rs.cfg.Migration.Run {
+		return nil
+	}
+	for _, script := range rs.cfg.Migration.Scripts {
+		if _, err := rs.database.ExecContext(ctx, script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save implements RevocationAPI. The columns have no time zone, times are
+// kept in UTC.
+func (rs *RevocationService) Save(ctx context.Context, revocation *Revocation) error {
+	_, err := rs.database.ExecContext(ctx, rs.cfg.Scripts.Save,
+		revocation.ID,
+		revocation.Kind,
+		revocation.Username,
+		revocation.RevokedAt.UTC(),
+		revocation.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// Active implements RevocationAPI.
+func (rs *RevocationService) Active(ctx context.Context) ([]Revocation, error) {
+	revocations := []Revocation{}
+	err := rs.database.
+		SelectContext(
+			ctx,
+			&revocations,
+			rs.cfg.Scripts.FetchActive,
+			time.Now().UTC())
+	for i := range revocations {
+		// Read back as UTC wall clock without a location.
+		revocations[i].RevokedAt = utc(revocations[i].RevokedAt)
+		revocations[i].ExpiresAt = utc(revocations[i].ExpiresAt)
+	}
+	return revocations, err
+}
+
+// DeleteExpired implements RevocationAPI.
+func (rs *RevocationService) DeleteExpired(ctx context.Context) error {
+	_, err := rs.database.ExecContext(ctx, rs.cfg.Scripts.DeleteExpired, time.Now().UTC())
+	return err
+}
+
+func utc(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
@@ -1,8 +1,8 @@
 package salt
 
 import (
-	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"errors"
 
 	"golang.org/x/crypto/argon2"
@@ -112,7 +112,7 @@ func (a *PasswordManager) Compare(hash, password []byte) error {
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(hash, salt.Value) {
+	if subtle.ConstantTimeCompare(hash, salt.Value) != 1 {
 		return errors.New("hash doesn't match")
 	}
 	return nil
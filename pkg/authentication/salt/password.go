@@ -0,0 +1,96 @@
+package salt
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Stored passwords use the PHC string format of argon2id, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>", so the parameters can
+// change without locking anybody out. Values without the prefix predate
+// hashing and hold the password itself.
+const passwordPrefix = "$argon2id$"
+
+var ErrInvalidPassword = errors.New("invalid password")
+
+// DefaultPasswordConfig follows the argon2id recommendation of RFC 9106
+// for memory constrained environments.
+func DefaultPasswordConfig() *PasswordManagerConfig {
+	return NewPasswordManagerConfig().
+		SetTime(3).
+		SetMemory(64 * 1024).
+		SetThreads(4).
+		SetKeyLen(32).
+		SetSaltLen(16)
+}
+
+// Encode formats hash, made by the manager, for storage.
+func (a *PasswordManager) Encode(hash *Hash) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		passwordPrefix,
+		argon2.Version,
+		a.config.memory,
+		a.config.time,
+		a.config.threads,
+		base64.RawStdEncoding.EncodeToString(a.secret),
+		base64.RawStdEncoding.EncodeToString(hash.Value))
+}
+
+// HashPassword hashes password with a fresh salt for storage.
+func HashPassword(password string) (string, error) {
+	pm, err := NewPasswordManager(DefaultPasswordConfig())
+	if err != nil {
+		return "", err
+	}
+	hash, err := pm.GenerateHash([]byte(password))
+	if err != nil {
+		return "", err
+	}
+	return pm.Encode(hash), nil
+}
+
+// ParsePassword reads a value made by Encode back into the manager that
+// made it and the hash to compare against.
+func ParsePassword(stored string) (*PasswordManager, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, passwordPrefix), "$")
+	if !strings.HasPrefix(stored, passwordPrefix) || len(parts) != 4 {
+		return nil, nil, ErrInvalidPassword
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, ErrInvalidPassword
+	}
+	config := NewPasswordManagerConfig()
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &config.memory, &config.time, &config.threads); err != nil {
+		return nil, nil, ErrInvalidPassword
+	}
+	secret, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(secret) == 0 {
+		return nil, nil, ErrInvalidPassword
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) == 0 {
+		return nil, nil, ErrInvalidPassword
+	}
+	config.SetKeyLen(uint32(len(hash))).SetSaltLen(uint32(len(secret)))
+	return (&PasswordManager{config: config}).SetSecret(secret), hash, nil
+}
+
+// IsLegacyPassword tells whether stored predates hashing.
+func IsLegacyPassword(stored string) bool {
+	return !strings.HasPrefix(stored, passwordPrefix)
+}
+
+// NeedsRehash tells whether stored, once the password matched, should be
+// replaced by a hash with the current parameters.
+func NeedsRehash(stored string) bool {
+	if IsLegacyPassword(stored) {
+		return true
+	}
+	pm, _, err := ParsePassword(stored)
+	return err == nil && *pm.config != *DefaultPasswordConfig()
+}
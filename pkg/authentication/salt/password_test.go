@@ -0,0 +1,87 @@
+package salt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	stored, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Fatalf("stored as %s", stored)
+	}
+	if again, _ := HashPassword("correct horse"); again == stored {
+		t.Fatal("salt reused")
+	}
+
+	pm, hash, err := ParsePassword(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pm.config != *DefaultPasswordConfig() {
+		t.Fatalf("parsed config %+v", *pm.config)
+	}
+	if err := pm.Compare(hash, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Compare(hash, []byte("battery staple")); err == nil {
+		t.Fatal("wrong password matched")
+	}
+	if NeedsRehash(stored) || IsLegacyPassword(stored) {
+		t.Fatal("fresh hash flagged")
+	}
+}
+
+func TestParsePasswordKeepsParameters(t *testing.T) {
+	config := NewPasswordManagerConfig().SetTime(1).SetMemory(1024).SetThreads(1).SetKeyLen(16).SetSaltLen(8)
+	pm, err := NewPasswordManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := pm.GenerateHash([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := pm.Encode(hash)
+
+	parsed, value, err := ParsePassword(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed.config != *config {
+		t.Fatalf("parsed config %+v, want %+v", *parsed.config, *config)
+	}
+	if err := parsed.Compare(value, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if !NeedsRehash(stored) {
+		t.Fatal("outdated parameters not flagged")
+	}
+}
+
+func TestParsePasswordErrors(t *testing.T) {
+	for _, stored := range []string{
+		"",
+		"plain text",
+		"c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA",
+		"$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=lots,t=3,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536,t=3,p=4$!!$aGFzaA",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$",
+	} {
+		if _, _, err := ParsePassword(stored); !errors.Is(err, ErrInvalidPassword) {
+			t.Errorf("%q parsed, %v", stored, err)
+		}
+	}
+}
+
+func TestIsLegacyPassword(t *testing.T) {
+	if !IsLegacyPassword("hunter2") || !NeedsRehash("hunter2") {
+		t.Fatal("plain text password not flagged")
+	}
+}
@@ -0,0 +1,128 @@
+package session
+
+import "time"
+
+// Config of the session store. Ended and expired sessions stay in the store
+// for Retention, 30 days by default, before DeleteExpired prunes them.
+type Config struct {
+	Retention time.Duration `mapstructure:"retention"`
+	Migration struct {
+		Run     bool     `mapstructure:"run"`
+		Scripts []string `mapstructure:"scripts"`
+	}
+	Scripts struct {
+		FetchByID     string `mapstructure:"fetch_by_id"`
+		FetchByUser   string `mapstructure:"fetch_by_user"`
+		Save          string `mapstructure:"save"`
+		Touch         string `mapstructure:"touch"`
+		Seen          string `mapstructure:"seen"`
+		EndByID       string `mapstructure:"end_by_id"`
+		EndByUser     string `mapstructure:"end_by_user"`
+		DeleteExpired string `mapstructure:"delete_expired"`
+	} `mapstructure:"scripts"`
+}
+
+func (c *Config) SetDefaultIfEmpty() *Config {
+	if c.Retention <= 0 {
+		c.Retention = 30 * 24 * time.Hour
+	}
+	if c.Migration.Run {
+		if len(c.Migration.Scripts) == 0 {
+			c.Migration.Scripts = []string{
+				`
+					CREATE TABLE IF NOT EXISTS session_store (
+						id VARCHAR(255) PRIMARY KEY,
+						user_name VARCHAR(255) NOT NULL,
+						domain VARCHAR(255) NOT NULL DEFAULT '',
+						ip VARCHAR(255) NOT NULL DEFAULT '',
+						user_agent TEXT NOT NULL DEFAULT '',
+						method VARCHAR(64) NOT NULL DEFAULT '',
+						access_jti VARCHAR(255) NOT NULL DEFAULT '',
+						created_at TIMESTAMP NOT NULL,
+						last_seen_at TIMESTAMP NOT NULL,
+						expires_at TIMESTAMP NOT NULL,
+						ended_at TIMESTAMP
+					);
+				`,
+				`CREATE INDEX IF NOT EXISTS session_store_user_name ON session_store (user_name);`,
+			}
+		}
+	}
+
+	sqlSelect := `
+	SELECT
+		id,
+		user_name,
+		domain,
+		ip,
+		user_agent,
+		method,
+		access_jti,
+		created_at,
+		last_seen_at,
+		expires_at
+	FROM
+		session_store`
+
+	if c.Scripts.FetchByID == "" {
+		c.Scripts.FetchByID = sqlSelect + `
+		WHERE
+			id=$1 AND ended_at IS NULL AND expires_at > $2`
+	}
+	if c.Scripts.FetchByUser == "" {
+		c.Scripts.FetchByUser = sqlSelect + `
+		WHERE
+			user_name=$1 AND ended_at IS NULL AND expires_at > $2
+		ORDER BY
+			last_seen_at DESC`
+	}
+	if c.Scripts.Save == "" {
+		c.Scripts.Save = `
+		INSERT INTO session_store (
+			id,
+			user_name,
+			domain,
+			ip,
+			user_agent,
+			method,
+			access_jti,
+			created_at,
+			last_seen_at,
+			expires_at)
+		VALUES (
+			$1,
+			$2,
+			$3,
+			$4,
+			$5,
+			$6,
+			$7,
+			$8,
+			$9,
+			$10)`
+	}
+	if c.Scripts.Touch == "" {
+		c.Scripts.Touch = `
+		UPDATE session_store
+		SET
+			access_jti=$2,
+			last_seen_at=$3,
+			expires_at=$4
+		WHERE
+			id=$1`
+	}
+	if c.Scripts.Seen == "" {
+		c.Scripts.Seen = "UPDATE session_store SET last_seen_at=$2 WHERE id=$1 AND ended_at IS NULL"
+	}
+	if c.Scripts.EndByID == "" {
+		c.Scripts.EndByID = "UPDATE session_store SET ended_at=$2 WHERE id=$1 AND ended_at IS NULL"
+	}
+	if c.Scripts.EndByUser == "" {
+		c.Scripts.EndByUser = "UPDATE session_store SET ended_at=$2 WHERE user_name=$1 AND ended_at IS NULL"
+	}
+	if c.Scripts.DeleteExpired == "" {
+		// $1 is the current time less the retention.
+		c.Scripts.DeleteExpired = "DELETE FROM session_store WHERE expires_at < $1 OR ended_at < $1"
+	}
+	return c
+}
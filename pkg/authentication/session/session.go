@@ -0,0 +1,191 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Authentication methods a session can start with.
+const (
+	MethodPassword = "password"
+	MethodOIDC     = "oidc"
+)
+
+type SessionAPI interface {
+	Migration(ctx context.Context) error
+	Find(ctx context.Context, id string) (*Session, error)
+	FindByUser(ctx context.Context, username string) ([]Session, error)
+	Save(ctx context.Context, session *Session) error
+	Touch(ctx context.Context, id string, accessJTI string, expiresAt time.Time) error
+	Seen(ctx context.Context, id string) error
+	End(ctx context.Context, id string) error
+	EndUser(ctx context.Context, username string) error
+	DeleteExpired(ctx context.Context) error
+}
+
+// Session is one login of a user. Its ID is the family of the refresh
+// tokens issued for it and AccessJTI the jti of the latest access token.
+// LastSeenAt follows the requests made with it, see Seen.
+type Session struct {
+	ID         string    `json:"id" db:"id"`
+	Username   string    `json:"username" db:"user_name"`
+	Domain     string    `json:"domain" db:"domain"`
+	IP         string    `json:"ip" db:"ip"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	Method     string    `json:"method" db:"method"`
+	AccessJTI  string    `json:"-" db:"access_jti"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at"`
+}
+
+func NewSession() *Session {
+	now := time.Now()
+	return &Session{CreatedAt: now, LastSeenAt: now}
+}
+
+func (s *Session) SetID(id string) *Session {
+	s.ID = id
+	return s
+}
+
+func (s *Session) SetUsername(username string) *Session {
+	s.Username = username
+	return s
+}
+
+func (s *Session) SetDomain(domain string) *Session {
+	s.Domain = domain
+	return s
+}
+
+func (s *Session) SetIP(ip string) *Session {
+	s.IP = ip
+	return s
+}
+
+func (s *Session) SetUserAgent(userAgent string) *Session {
+	s.UserAgent = userAgent
+	return s
+}
+
+func (s *Session) SetMethod(method string) *Session {
+	s.Method = method
+	return s
+}
+
+func (s *Session) SetExpiresAt(expiresAt time.Time) *Session {
+	s.ExpiresAt = expiresAt
+	return s
+}
+
+type SessionService struct {
+	database *sqlx.DB
+	cfg      *Config
+}
+
+func New(dep *sqlx.DB, cfg *Config) (SessionAPI, error) {
+	ss := &SessionService{
+		database: dep,
+		cfg:      cfg.SetDefaultIfEmpty(),
+	}
+	if err := ss.Migration(context.Background()); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// Migration implements SessionAPI.
+func (ss *SessionService) Migration(ctx context.Context) error {
+	if !ss.cfg.Migration.Run {
+		return nil
+	}
+	for _, script := range ss.cfg.Migration.Scripts {
+		if _, err := ss.database.ExecContext(ctx, script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find implements SessionAPI, ended and expired sessions aren't found.
+func (ss *SessionService) Find(ctx context.Context, id string) (*Session, error) {
+	session := NewSession()
+	err := ss.database.
+		GetContext(
+			ctx,
+			session,
+			ss.cfg.Scripts.FetchByID,
+			id,
+			time.Now().UTC())
+	return session, err
+}
+
+// FindByUser implements SessionAPI, the most recently used come first.
+func (ss *SessionService) FindByUser(ctx context.Context, username string) ([]Session, error) {
+	sessions := []Session{}
+	err := ss.database.
+		SelectContext(
+			ctx,
+			&sessions,
+			ss.cfg.Scripts.FetchByUser,
+			username,
+			time.Now().UTC())
+	return sessions, err
+}
+
+// Save implements SessionAPI. The columns have no time zone, times are kept
+// in UTC.
+func (ss *SessionService) Save(ctx context.Context, session *Session) error {
+	_, err := ss.database.ExecContext(ctx, ss.cfg.Scripts.Save,
+		session.ID,
+		session.Username,
+		session.Domain,
+		session.IP,
+		session.UserAgent,
+		session.Method,
+		session.AccessJTI,
+		session.CreatedAt.UTC(),
+		session.LastSeenAt.UTC(),
+		session.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// Touch implements SessionAPI.
+func (ss *SessionService) Touch(ctx context.Context, id string, accessJTI string, expiresAt time.Time) error {
+	_, err := ss.database.ExecContext(ctx, ss.cfg.Scripts.Touch,
+		id,
+		accessJTI,
+		time.Now().UTC(),
+		expiresAt.UTC(),
+	)
+	return err
+}
+
+// Seen implements SessionAPI.
+func (ss *SessionService) Seen(ctx context.Context, id string) error {
+	_, err := ss.database.ExecContext(ctx, ss.cfg.Scripts.Seen, id, time.Now().UTC())
+	return err
+}
+
+// End implements SessionAPI.
+func (ss *SessionService) End(ctx context.Context, id string) error {
+	_, err := ss.database.ExecContext(ctx, ss.cfg.Scripts.EndByID, id, time.Now().UTC())
+	return err
+}
+
+// EndUser implements SessionAPI.
+func (ss *SessionService) EndUser(ctx context.Context, username string) error {
+	_, err := ss.database.ExecContext(ctx, ss.cfg.Scripts.EndByUser, username, time.Now().UTC())
+	return err
+}
+
+// DeleteExpired implements SessionAPI, sessions that ended or expired within
+// the retention are kept.
+func (ss *SessionService) DeleteExpired(ctx context.Context) error {
+	_, err := ss.database.ExecContext(ctx, ss.cfg.Scripts.DeleteExpired, time.Now().UTC().Add(-ss.cfg.Retention))
+	return err
+}
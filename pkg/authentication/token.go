@@ -90,6 +90,7 @@ func (t *TokenHeader) SetNotBefore(data time.Time) *TokenHeader {
 }
 
 type Claims struct {
+	ID                string        `json:"jti,omitempty"`
 	Subject           string        `json:"sub,omitempty"`
 	Username          string        `json:"username,omitempty"`
 	PreferredUsername string        `json:"preferred_username,omitempty"`
@@ -100,6 +101,9 @@ type Claims struct {
 	EmailVerified     bool          `json:"email_verified,omitempty"`
 	Domain            domain.Domain `json:"domain,omitempty"`
 	Roles             []string      `json:"roles,omitempty"`
+	Session           string        `json:"sid,omitempty"`
+	IssuedAt          time.Time     `json:"iat,omitempty"`
+	ExpiresAt         time.Time     `json:"exp,omitempty"`
 }
 
 func FromIDClaims(claims IDTokenClaims) *Claims {
@@ -130,6 +134,12 @@ func FromPasetoJSON(claims paseto.JSONToken) *Claims {
 		SetFamilyName(claims.Get("family_name")).
 		SetGivenName(claims.Get("given_name")).
 		SetPreferredUsername(claims.Get("preferred_username")).
+		SetID(claims.Jti).
+		SetSession(claims.Get("sid")).
+		SetIssuedAt(claims.IssuedAt).
+		SetExpiresAt(claims.Expiration).
+		SetSubject(claims.Subject).
+		SetRoles(strings.Split(claims.Get("roles"), ",")...).
 		SetUsername(
 			claims.Get("username"),
 			claims.Get("preferred_username"),
@@ -155,6 +165,26 @@ func (t *Claims) SetPreferredUsername(preferredUsername string) *Claims {
 	return t
 }
 
+func (t *Claims) SetID(id string) *Claims {
+	t.ID = id
+	return t
+}
+
+func (t *Claims) SetSession(session string) *Claims {
+	t.Session = session
+	return t
+}
+
+func (t *Claims) SetIssuedAt(issuedAt time.Time) *Claims {
+	t.IssuedAt = issuedAt
+	return t
+}
+
+func (t *Claims) SetExpiresAt(expiresAt time.Time) *Claims {
+	t.ExpiresAt = expiresAt
+	return t
+}
+
 func (t *Claims) SetSubject(subject string) *Claims {
 	t.Subject = subject
 	return t
@@ -189,6 +219,14 @@ func (t *Claims) SetEmailVerified(emailVerified bool) *Claims {
 	return t
 }
 
+// SetRoles skips empty names, tokens without roles carry an empty list.
+func (t *Claims) SetRoles(roles ...string) *Claims {
+	t.Roles = slices.DeleteFunc(roles, func(role string) bool {
+		return strings.TrimSpace(role) == ""
+	})
+	return t
+}
+
 func (t *Claims) SetDomain(domain *domain.Domain) *Claims {
 	if domain != nil {
 		t.Domain = *domain
@@ -197,10 +235,16 @@ func (t *Claims) SetDomain(domain *domain.Domain) *Claims {
 }
 
 func (t *Claims) build(tkn *TokenHeader) paseto.JSONToken {
+	// Tokens are meant for the domain of the user unless the header names
+	// another audience.
+	audience := tkn.Audience
+	if audience == "" {
+		audience = t.Domain.Name
+	}
 	token := paseto.JSONToken{
 		Jti:        tkn.ID,
 		Subject:    tkn.Subject,
-		Audience:   (t.Domain.Name),
+		Audience:   audience,
 		Issuer:     tkn.Issuer,
 		Expiration: tkn.Expiration,
 		NotBefore:  tkn.NotBefore,
@@ -216,6 +260,9 @@ func (t *Claims) build(tkn *TokenHeader) paseto.JSONToken {
 	token.Set("did", t.Domain.ID)
 	token.Set("domain", t.Domain.Name)
 	token.Set("email_verified", fmt.Sprint(t.EmailVerified))
+	if t.Session != "" {
+		token.Set("sid", t.Session)
+	}
 	return token
 }
 
@@ -288,6 +335,10 @@ func ParseAsymmetricToken(token string, key string) (*Claims, string, error) {
 		publicKey,
 		&claims,
 		&footer)
+	if err == nil {
+		// Verify only checks the signature, expired tokens pass it.
+		err = claims.Validate()
+	}
 	return FromPasetoJSON(claims), footer, err
 }
 
@@ -299,5 +350,8 @@ func ParseSymmetricToken(token string, secret string) (*Claims, string, error) {
 		[]byte(secret),
 		&pastoClaims,
 		&footer)
+	if err == nil {
+		err = pastoClaims.Validate()
+	}
 	return FromPasetoJSON(pastoClaims), footer, err
 }
@@ -8,12 +8,14 @@ type Config struct {
 	Scripts struct {
 		FetchAll              string `mapstructure:"fetch_all"`
 		FetchByUsername       string `mapstructure:"fetch_by_username"`
+		FetchBySubject        string `mapstructure:"fetch_by_subject"`
 		FetchDomainByUsername string `mapstructure:"fetch_domain_by_username"`
 		FetchByID             string `mapstructure:"fetch_by_id"`
 		Save                  string `mapstructure:"save"`
 		DeleteByID            string `mapstructure:"delete_by_id"`
 		UpdateByUsername      string `mapstructure:"update_by_username"`
 		ChangePassword        string `mapstructure:"change_password"`
+		Link                  string `mapstructure:"link"`
 		CheckCredentials      string `mapstructure:"check_credentials"`
 	} `mapstructure:"scripts"`
 }
@@ -38,7 +40,13 @@ func (c *Config) SetDefaultIfEmpty() *Config {
 						none_user BOOLEAN NOT NULL DEFAULT FALSE,
 						created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 					);
-				`}
+				`,
+				// Users signing in with an identity provider are known by
+				// the issuer and subject of their ID token.
+				`ALTER TABLE users_store ADD COLUMN IF NOT EXISTS issuer VARCHAR(255) NOT NULL DEFAULT '';`,
+				`ALTER TABLE users_store ADD COLUMN IF NOT EXISTS subject VARCHAR(255) NOT NULL DEFAULT '';`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS users_store_subject ON users_store (issuer, subject) WHERE subject <> '';`,
+			}
 		}
 	}
 
@@ -55,6 +63,8 @@ func (c *Config) SetDefaultIfEmpty() *Config {
 		avatar,
 		domains,
 		none_user,
+		issuer,
+		subject,
 		created_at
 	FROM
 		users_store`
@@ -67,6 +77,11 @@ func (c *Config) SetDefaultIfEmpty() *Config {
 		WHERE
 			user_name=$1`
 	}
+	if c.Scripts.FetchBySubject == "" {
+		c.Scripts.FetchBySubject = sqlSelect + `
+		WHERE
+			issuer=$1 AND subject=$2`
+	}
 	if c.Scripts.Save == "" {
 		c.Scripts.Save = `
 		INSERT INTO users_store (
@@ -131,6 +146,9 @@ func (c *Config) SetDefaultIfEmpty() *Config {
 	if c.Scripts.ChangePassword == "" {
 		c.Scripts.ChangePassword = "UPDATE users_store SET secret=$1 WHERE user_name=$2"
 	}
+	if c.Scripts.Link == "" {
+		c.Scripts.Link = "UPDATE users_store SET issuer=$2, subject=$3 WHERE user_name=$1"
+	}
 	if c.Scripts.CheckCredentials == "" {
 		c.Scripts.CheckCredentials = `
 		SELECT
@@ -145,6 +163,10 @@ func (c *Config) SetDefaultIfEmpty() *Config {
 			avatar,
 			domains,
 			none_user,
+			issuer,
+			subject,
+			created_at,
+			secret
 		FROM
 			users_store
 		WHERE
@@ -15,9 +15,11 @@ type UserAPI interface {
 	All(ctx context.Context) ([]User, error)
 	Find(ctx context.Context, id string) (*User, error)
 	FindByUsername(ctx context.Context, username string) (*User, error)
+	FindBySubject(ctx context.Context, issuer string, subject string) (*User, error)
 	AddDomains(ctx context.Context, username string, domains ...string) error
 	RemoveDomains(ctx context.Context, username string, domains ...string) error
 	ChangePassword(ctx context.Context, username string, password string) error
+	Link(ctx context.Context, username string, issuer string, subject string) error
 	GetUserForCredential(ctx context.Context, username string) (*UserStore, error)
 	GetDomains(ctx context.Context, username string) ([]string, error)
 	Save(ctx context.Context, user *User) error
@@ -35,6 +37,8 @@ type User struct {
 	Avatar            string `json:"avatar" db:"avatar"`
 	Domains           string `json:"domains" db:"domains"`
 	NoneUser          bool   `json:"none_user" db:"none_user"`
+	Issuer            string `json:"issuer" db:"issuer"`
+	Subject           string `json:"subject" db:"subject"`
 	CreatedAt         string `json:"created_at" db:"created_at"`
 }
 
@@ -241,6 +245,30 @@ func (us *UserService) FindByUsername(ctx context.Context, username string) (*Us
 	return user, err
 }
 
+// FindBySubject implements UserAPI. Issuer and subject identify the account
+// of a user at an identity provider once linked, an empty user is returned
+// when none is.
+func (us *UserService) FindBySubject(ctx context.Context, issuer string, subject string) (*User, error) {
+	user := NewUser()
+	err := us.database.
+		GetContext(
+			ctx,
+			user,
+			us.cfg.Scripts.FetchBySubject,
+			issuer,
+			subject)
+	if err == sql.ErrNoRows {
+		return user, nil
+	}
+	return user, err
+}
+
+// Link implements UserAPI.
+func (us *UserService) Link(ctx context.Context, username string, issuer string, subject string) error {
+	_, err := us.database.ExecContext(ctx, us.cfg.Scripts.Link, username, issuer, subject)
+	return err
+}
+
 func (us *UserService) GetUserForCredential(ctx context.Context, username string) (*UserStore, error) {
 	user := &UserStore{
 		User: NewUser(),
@@ -262,7 +290,7 @@ func (us *UserService) Save(ctx context.Context, user *User) error {
 		user.Name,
 		user.GivenName,
 		user.FamilyName,
-		user.Username,
+		user.Email,
 		user.EmailVerified,
 		user.Avatar,
 		user.Domains,
@@ -4,5 +4,6 @@ type Identity string
 
 const (
 	AccessToken       Identity = "access_token"
+	RefreshToken      Identity = "refresh_token"
 	AuthenticatedUser Identity = "authenticated_user"
 )